@@ -0,0 +1,576 @@
+package clientapi
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+
+	"assuredrelease.com/cypherlock-pe/binencode"
+	"assuredrelease.com/cypherlock-pe/memprotect"
+	"assuredrelease.com/cypherlock-pe/messages"
+	"assuredrelease.com/cypherlock-pe/protectedcrypto"
+	"assuredrelease.com/cypherlock-pe/secretsharing"
+	"assuredrelease.com/cypherlock-pe/transport"
+	"assuredrelease.com/cypherlock-pe/types"
+)
+
+var (
+	ErrNoOracles  = errors.New("clientapi: No oracles configured")
+	ErrNoLock     = errors.New("clientapi: No cypherlock found")
+	ErrLockExists = errors.New("clientapi: Cypherlock exists")
+	ErrVersion    = errors.New("clientapi: Unknown version")
+	ErrSecretSize = errors.New("clientapi: Secret too long")
+	ErrNoTimelock = errors.New("clientapi: No timelock keys for duration")
+	ErrNoShares   = errors.New("clientapi: Not enough shares recovered")
+	ErrDeviceKey  = errors.New("clientapi: Device key operation failed")
+)
+
+var RandomSource = rand.Reader
+
+var timeNow = func() int64 { return time.Now().Unix() }
+
+// Key derivation parameters for scrypt.
+var (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+const saltSize = 32
+const deviceSecretSize = 32
+const generatedSecretSize = 32
+
+// Oracle describes an oracle that holds shares.
+type Oracle struct {
+	URL          string                  // The URL of the oracle.
+	LongTermKey  [32]byte                // The long-term public key of the oracle.
+	SignatureKey [32]byte                // The long-term signature key of the oracle.
+	ConfigURL    string                  // The location of the config of the oracle.
+	TimeLockURL  string                  // The location of the timelock list of the oracle.
+	TimeLocks    *types.RatchetPublicKey // The timelock keys published by the oracle.
+}
+
+// Client implements the API over the messages package. Each cypherlock is stored in its own directory.
+type Client struct {
+	Oracles       []Oracle                     // Oracles to distribute shares to.
+	Threshold     int                          // Number of oracles required to unveil the secret. 0 means all.
+	ShortTermKeys messages.ShortTermKeyFactory // Returns the current short term key of an oracle. Configs is used if nil.
+	Transport     transport.Transport          // Delivers oracle messages.
+	Retry         transport.Retry              // Retry policy for oracle requests.
+	Fetch         transport.Fetcher            // Retrieves published oracle data.
+	TimeLocks     *TimeLockCache               // Verified timelock lists of the oracles, kept in the client directory.
+	Configs       *ConfigCache                 // Verified configs of the oracles.
+
+	dir        string
+	engine     memprotect.Engine
+	mutex      *sync.Mutex
+	queue      *WorkQueue // Never replaced, Worker and Completed access it without holding mutex.
+	wipe       func(filename string) (ok bool)
+	keyWipe    func(publickey string) (ok bool)
+	keyCreate  func() (publickey string, ok bool)
+	keyEncrypt func(cleartext string, publickey string) (cyphertext string, ok bool)
+	keyDecrypt func(cyphertext string, publickey string) (cleartext string, ok bool)
+}
+
+var _ API = (*Client)(nil)
+
+// NewClient returns a client that stores its cypherlock in dir. The timelock pins recorded in dir are loaded.
+func NewClient(dir string, engine memprotect.Engine) *Client {
+	return &Client{
+		TimeLocks: openClientTimeLockCache(dir),
+		Configs:   NewConfigCache(),
+		dir:       dir,
+		engine:    engine,
+		mutex:     new(sync.Mutex),
+		queue:     NewWorkQueue(DefaultTaskTimeout),
+	}
+}
+
+// UseWorkerQueue routes all platform operations through the worker queue instead of registered callbacks.
+// Each task must be completed within timeout.
+func (self *Client) UseWorkerQueue(timeout time.Duration) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	queue := self.queue
+	queue.setTimeout(timeout)
+	self.wipe = func(filename string) bool {
+		_, err := queue.Submit(MethodWipeFile, filename, "", "")
+		return err == nil
+	}
+	self.keyWipe = func(publickey string) bool {
+		_, err := queue.Submit(MethodWipeKey, publickey, "", "")
+		return err == nil
+	}
+	self.keyCreate = func() (string, bool) {
+		publickey, err := queue.Submit(MethodCreateKey, "", "", "")
+		return publickey, err == nil
+	}
+	self.keyEncrypt = func(cleartext, publickey string) (string, bool) {
+		cyphertext, err := queue.Submit(MethodEncrypt, publickey, cleartext, "")
+		return cyphertext, err == nil
+	}
+	self.keyDecrypt = func(cyphertext, publickey string) (string, bool) {
+		cleartext, err := queue.Submit(MethodDecrypt, publickey, cyphertext, "")
+		return cleartext, err == nil
+	}
+}
+
+// deriveKey calculates the container key from passphrase, pin and the optional device secret.
+func (self *Client) deriveKey(passphrase, pin string, salt, deviceSecret []byte) (memprotect.Cell, error) {
+	input, err := binencode.Encode(nil, []byte(passphrase), []byte(pin))
+	if err != nil {
+		return nil, err
+	}
+	defer wipeBytes(input)
+	k, err := scrypt.Key(input, salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+	defer wipeBytes(k)
+	key := self.engine.Cell(32)
+	if deviceSecret != nil {
+		protectedcrypto.SHA256HMAC(k, deviceSecret, key.Bytes())
+	} else {
+		key.Load(k)
+	}
+	return key, nil
+}
+
+func wipeBytes(d []byte) {
+	for i := range d {
+		d[i] = 0x00
+	}
+}
+
+// createDeviceSecret creates a device key and a secret encrypted to it, if the platform supports it.
+func (self *Client) createDeviceSecret(header *lockHeader) ([]byte, error) {
+	if self.keyCreate == nil || self.keyEncrypt == nil || self.keyDecrypt == nil {
+		return nil, nil
+	}
+	publicKey, ok := self.keyCreate()
+	if !ok {
+		return nil, ErrDeviceKey
+	}
+	deviceSecret := make([]byte, deviceSecretSize)
+	if _, err := io.ReadFull(RandomSource, deviceSecret); err != nil {
+		return nil, err
+	}
+	encrypted, ok := self.keyEncrypt(base64.StdEncoding.EncodeToString(deviceSecret), publicKey)
+	if !ok {
+		return nil, ErrDeviceKey
+	}
+	header.DeviceKey = []byte(publicKey)
+	header.DeviceSecret = []byte(encrypted)
+	return deviceSecret, nil
+}
+
+// deviceSecret decrypts the device secret of a cypherlock.
+func (self *Client) deviceSecret(header *lockHeader) ([]byte, error) {
+	if len(header.DeviceKey) == 0 {
+		return nil, nil
+	}
+	if self.keyDecrypt == nil {
+		return nil, ErrDeviceKey
+	}
+	cleartext, ok := self.keyDecrypt(string(header.DeviceSecret), string(header.DeviceKey))
+	if !ok {
+		return nil, ErrDeviceKey
+	}
+	return base64.StdEncoding.DecodeString(cleartext)
+}
+
+// containerKey returns the key that protects the containers of the cypherlock described by header.
+func (self *Client) containerKey(passphrase, pin string, header *lockHeader) (memprotect.Cell, error) {
+	deviceSecret, err := self.deviceSecret(header)
+	if err != nil {
+		return nil, err
+	}
+	defer wipeBytes(deviceSecret)
+	return self.deriveKey(passphrase, pin, header.Salt, deviceSecret)
+}
+
+// createCypherLock creates a new cypherlock that makes secret available from now until duration seconds have passed.
+func (self *Client) createCypherLock(passphrase, pin string, secret []byte, duration int64) error {
+	if len(self.Oracles) == 0 {
+		return ErrNoOracles
+	}
+	if len(secret) == 0 || secretsharing.ShareSize(len(secret)) > messages.MaxShareSize {
+		return ErrSecretSize
+	}
+	threshold := self.Threshold
+	if threshold <= 0 {
+		threshold = len(self.Oracles)
+	}
+	if self.hasLock() {
+		return ErrLockExists
+	}
+	header := &lockHeader{
+		Version:        lockHeaderVersion,
+		ShareThreshold: int32(threshold),
+		Salt:           make([]byte, saltSize),
+	}
+	if _, err := io.ReadFull(RandomSource, header.Salt); err != nil {
+		return err
+	}
+	deviceSecret, err := self.createDeviceSecret(header)
+	if err != nil {
+		return err
+	}
+	key, err := self.deriveKey(passphrase, pin, header.Salt, deviceSecret)
+	wipeBytes(deviceSecret)
+	if err != nil {
+		return err
+	}
+	defer key.Destroy()
+	secretElement := self.engine.Element(len(secret))
+	defer secretElement.Destroy()
+	secretCopy := append([]byte{}, secret...)
+	err = secretElement.Set(secretCopy)
+	wipeBytes(secretCopy) // Not every engine wipes it, none does on error.
+	if err != nil {
+		return err
+	}
+	shares, err := secretsharing.Split(secretElement, len(self.Oracles), threshold, self.engine)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, share := range shares {
+			share.Destroy()
+		}
+	}()
+	now := timeNow()
+	written := make([]string, 0, len(self.Oracles))
+	for i, oracle := range self.Oracles {
+		if err = self.createContainers(i, &oracle, shares[i], header.ShareThreshold, key, now, now+duration, &written); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = self.writeHeader(header)
+	}
+	if err != nil {
+		for _, name := range written {
+			self.removeFile(name)
+		}
+		return err
+	}
+	return nil
+}
+
+// createContainers writes one container per timelock key of oracle that is valid between begin and end.
+func (self *Client) createContainers(oracleIndex int, oracle *Oracle, shareElement memprotect.Element, threshold int32, key memprotect.Cell, begin, end int64, written *[]string) error {
+	share, err := shareElement.Bytes()
+	if err != nil {
+		return err
+	}
+	defer shareElement.Seal()
+	if oracle.TimeLocks == nil {
+		return ErrNoTimelock
+	}
+	if begin < oracle.TimeLocks.StartTime {
+		begin = oracle.TimeLocks.StartTime
+	}
+	timeKeys := oracle.TimeLocks.SelectKeyRange(begin, end)
+	if len(timeKeys) == 0 {
+		return ErrNoTimelock
+	}
+	for _, timeKey := range timeKeys {
+		msg := &messages.OracleMessage{
+			OracleURL:               []byte(oracle.URL),
+			LongTermOraclePublicKey: oracle.LongTermKey,
+			TimelockPublicKey:       timeKey.PublicKey,
+			ValidFrom:               timeKey.ValidFrom,
+			ValidTo:                 timeKey.ValidTo,
+			Share:                   append([]byte{}, share...),
+			ShareThreshold:          threshold,
+		}
+		container, err := msg.Encrypt(key.Bytes(), self.engine)
+		if err != nil {
+			return err
+		}
+		f := &lockFile{
+			name:      lockFileName(oracleIndex, timeKey.ValidFrom, timeKey.ValidTo),
+			oracle:    oracleIndex,
+			validFrom: timeKey.ValidFrom,
+			validTo:   timeKey.ValidTo,
+		}
+		if err := self.writeLockFile(f, container); err != nil {
+			return err
+		}
+		*written = append(*written, f.name)
+	}
+	return nil
+}
+
+// unveilSecret collects the shares from the oracles and recombines the secret.
+func (self *Client) unveilSecret(passphrase, pin string) ([]byte, error) {
+	header, err := self.readHeader()
+	if err != nil {
+		return nil, err
+	}
+	key, err := self.containerKey(passphrase, pin, header)
+	if err != nil {
+		return nil, err
+	}
+	defer key.Destroy()
+	files, err := self.listLockFiles()
+	if err != nil {
+		return nil, err
+	}
+	now := timeNow()
+	futures := make([]*messages.OracleFuture, 0, len(files))
+	var lastErr error
+	for _, f := range files {
+		if !f.isValid(now) {
+			continue
+		}
+		future, err := self.future(f, key)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		futures = append(futures, future)
+	}
+	if len(futures) < int(header.ShareThreshold) {
+		if lastErr != nil {
+			return nil, lastErr
+		}
+		return nil, ErrNoShares
+	}
+	retry := self.Retry
+	if self.ShortTermKeys == nil && retry.Renew == nil {
+		// The oracle may have a new short term key before the cached config expires, ie. after a restart.
+		retry.Renew = self.Configs.Renew(self.Oracles)
+	}
+	received, err := transport.Collect(context.Background(), self.Transport, futures, int(header.ShareThreshold), retry)
+	if err != nil {
+		if err == transport.ErrNoShares {
+			return nil, ErrNoShares
+		}
+		return nil, err
+	}
+	shares := make([]memprotect.Element, 0, len(received))
+	defer func() {
+		for _, share := range shares {
+			share.Destroy()
+		}
+	}()
+	for i, share := range received {
+		shareElement := self.engine.Element(len(share))
+		err = shareElement.Set(share)
+		wipeBytes(share)
+		if err != nil {
+			shareElement.Destroy()
+			for _, share := range received[i+1:] {
+				wipeBytes(share)
+			}
+			return nil, err
+		}
+		shares = append(shares, shareElement)
+	}
+	secret, err := secretsharing.Combine(shares, self.engine)
+	if err != nil {
+		return nil, err
+	}
+	defer secret.Destroy()
+	d, err := secret.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	defer secret.Seal()
+	return append([]byte{}, d...), nil
+}
+
+// future decrypts the container in f and prepares the oracle message for it.
+func (self *Client) future(f *lockFile, key memprotect.Cell) (*messages.OracleFuture, error) {
+	d, err := self.readLockFile(f)
+	if err != nil {
+		return nil, err
+	}
+	shortTermKeys := self.ShortTermKeys
+	if shortTermKeys == nil {
+		shortTermKeys = self.Configs.ShortTermKeyFactory(self.Fetch, self.Oracles)
+	}
+	return new(messages.OracleMessageContainer).Send(key.Bytes(), d, shortTermKeys, self.engine)
+}
+
+// removeLockFiles removes all containers for which remove returns true. It returns the lowest assurance of all deletions.
+func (self *Client) removeLockFiles(remove func(f *lockFile) bool) (assurance int, err error) {
+	files, err := self.listLockFiles()
+	if err != nil {
+		return 0, err
+	}
+	assurance = 2
+	for _, f := range files {
+		if !remove(f) {
+			continue
+		}
+		assurance = minAssurance(assurance, self.removeFile(f.name))
+	}
+	return assurance, nil
+}
+
+func minAssurance(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// destroySecret removes all local data of the cypherlock.
+func (self *Client) destroySecret() (assurance int, err error) {
+	header, err := self.readHeader()
+	if err != nil {
+		return 0, err
+	}
+	assurance, err = self.removeLockFiles(func(f *lockFile) bool { return true })
+	if err != nil {
+		return 0, err
+	}
+	if len(header.DeviceKey) > 0 {
+		if self.keyWipe == nil || !self.keyWipe(string(header.DeviceKey)) {
+			assurance = minAssurance(assurance, 1)
+		}
+	}
+	return minAssurance(assurance, self.removeFile(headerFileName)), nil
+}
+
+// replaceCypherLock creates a new cypherlock for secret and replaces the existing cypherlock with it. The new
+// cypherlock is written to a staging directory first, the existing one is only removed after that succeeded.
+func (self *Client) replaceCypherLock(passphrase, pin string, secret []byte, duration int64) error {
+	stagingDir, err := ioutil.TempDir(self.dir, "replace")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(stagingDir)
+	staging := *self
+	staging.dir = stagingDir
+	if err := staging.createCypherLock(passphrase, pin, secret, duration); err != nil {
+		return err
+	}
+	files, err := staging.listLockFiles()
+	if err == nil {
+		_, err = self.destroySecret()
+	}
+	if err != nil {
+		staging.destroySecret()
+		return err
+	}
+	for _, f := range files {
+		if err := os.Rename(staging.path(f.name), self.path(f.name)); err != nil {
+			return err
+		}
+	}
+	return os.Rename(staging.path(headerFileName), self.path(headerFileName))
+}
+
+// CreateCypherLock creates a cypherlock that makes secret available for duration seconds.
+// If secret is empty, a random secret is generated.
+func (self *Client) CreateCypherLock(passphrase, pin, secret string, duration int) (ok bool) {
+	self.queue.begin()
+	defer self.queue.end()
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if secret == "" {
+		d := make([]byte, generatedSecretSize)
+		if _, err := io.ReadFull(RandomSource, d); err != nil {
+			return false
+		}
+		secret = hex.EncodeToString(d)
+	}
+	return self.createCypherLock(passphrase, pin, []byte(secret), int64(duration)) == nil
+}
+
+// UnveilSecret reveals the secret within a cypherlock.
+func (self *Client) UnveilSecret(passphrase, pin string) (secret string, err error) {
+	self.queue.begin()
+	defer self.queue.end()
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	d, err := self.unveilSecret(passphrase, pin)
+	if err != nil {
+		return "", err
+	}
+	return string(d), nil
+}
+
+// DestroySecret destroys all local data of the cypherlock.
+func (self *Client) DestroySecret() (assurance int, ok bool) {
+	self.queue.begin()
+	defer self.queue.end()
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	assurance, err := self.destroySecret()
+	return assurance, err == nil
+}
+
+// ModifyDuration recreates the cypherlock so that it is available for duration seconds from now. The existing
+// cypherlock is kept if the new one cannot be created.
+func (self *Client) ModifyDuration(passphrase, pin string, duration int) (ok bool) {
+	self.queue.begin()
+	defer self.queue.end()
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	secret, err := self.unveilSecret(passphrase, pin)
+	if err != nil {
+		return false
+	}
+	defer wipeBytes(secret)
+	return self.replaceCypherLock(passphrase, pin, secret, int64(duration)) == nil
+}
+
+// ShortenDuration deletes all containers that become valid after duration seconds from now.
+func (self *Client) ShortenDuration(duration int) (assurance int, ok bool) {
+	self.queue.begin()
+	defer self.queue.end()
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	end := timeNow() + int64(duration)
+	assurance, err := self.removeLockFiles(func(f *lockFile) bool { return f.validFrom > end })
+	return assurance, err == nil
+}
+
+// RegisterWipe registers a callback to securely delete files.
+func (self *Client) RegisterWipe(f func(filename string) (ok bool)) {
+	self.wipe = f
+}
+
+// RegisterKeyWipe registers a callback to delete a key from the secure enclave.
+func (self *Client) RegisterKeyWipe(f func(publickey string) (ok bool)) {
+	self.keyWipe = f
+}
+
+// RegisterKeyCreate registers a callback to create a key.
+func (self *Client) RegisterKeyCreate(f func() (publickey string, ok bool)) {
+	self.keyCreate = f
+}
+
+// RegisterKeyEncrypt registers a callback to encrypt to a key.
+func (self *Client) RegisterKeyEncrypt(f func(cleartext string, publickey string) (cyphertext string, ok bool)) {
+	self.keyEncrypt = f
+}
+
+// RegisterKeyDecrypt registers a callback to decrypt with a key.
+func (self *Client) RegisterKeyDecrypt(f func(cyphertext string, publickey string) (cleartext string, ok bool)) {
+	self.keyDecrypt = f
+}
+
+// Worker returns the next task of the worker queue.
+func (self *Client) Worker() (task int, method, param1, param2, param3 string) {
+	return self.queue.Worker()
+}
+
+// Completed signals the worker queue that a task is complete.
+func (self *Client) Completed(task int, withError bool, returnData string) {
+	self.queue.Completed(task, withError, returnData)
+}
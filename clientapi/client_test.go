@@ -0,0 +1,274 @@
+package clientapi
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"assuredrelease.com/cypherlock-pe/memprotect"
+	"assuredrelease.com/cypherlock-pe/messages"
+	"assuredrelease.com/cypherlock-pe/signalstore"
+	"assuredrelease.com/cypherlock-pe/transport"
+)
+
+type testOracle struct {
+	dir    string
+	store  *signalstore.Store
+	oracle *messages.Oracle
+}
+
+func newTestOracles(t *testing.T, count int, ratchetTime int64, engine memprotect.Engine) ([]*testOracle, []Oracle) {
+	testOracles := make([]*testOracle, 0, count)
+	oracles := make([]Oracle, 0, count)
+	for i := 0; i < count; i++ {
+		tdir, err := ioutil.TempDir("", "CLPEtestStore")
+		if err != nil {
+			t.Fatalf("Cannot create temporary directory: %s", err)
+		}
+		store, err := signalstore.New(tdir)
+		if err != nil {
+			t.Fatalf("New store: %s", err)
+		}
+		oracle := messages.NewOracle(store, engine)
+		if err := oracle.Generate(time.Now().Unix(), ratchetTime, 100000); err != nil {
+			t.Fatalf("Oracle.Generate: %s", err)
+		}
+		longTermKey, _ := oracle.PublicKeys()
+		timeLocks, err := oracle.TimelockKeys(10)
+		if err != nil {
+			t.Fatalf("TimelockKeys: %s", err)
+		}
+		testOracles = append(testOracles, &testOracle{dir: tdir, store: store, oracle: oracle})
+		oracles = append(oracles, Oracle{
+			URL:         "http://oracle" + strconv.Itoa(i) + ".test",
+			LongTermKey: *longTermKey,
+			TimeLocks:   timeLocks,
+		})
+	}
+	return testOracles, oracles
+}
+
+func closeTestOracles(testOracles []*testOracle) {
+	for _, o := range testOracles {
+		o.store.Close()
+		os.RemoveAll(o.dir)
+	}
+}
+
+func newTestClient(t *testing.T, engine memprotect.Engine, testOracles []*testOracle, oracles []Oracle) *Client {
+	dir, err := ioutil.TempDir("", "CLPEtestClient")
+	if err != nil {
+		t.Fatalf("Cannot create temporary directory: %s", err)
+	}
+	byURL := make(map[string]*messages.Oracle)
+	for i, o := range oracles {
+		byURL[o.URL] = testOracles[i].oracle
+	}
+	client := NewClient(dir, engine)
+	client.Oracles = oracles
+	client.ShortTermKeys = func(url string, longTermKey *[32]byte) (*[32]byte, error) {
+		_, shortTermKey := byURL[url].PublicKeys()
+		return shortTermKey, nil
+	}
+	inProcess := transport.NewInProcess()
+	for url, oracle := range byURL {
+		inProcess.Add(url, oracle)
+	}
+	client.Transport = inProcess
+	client.Retry = transport.Retry{Attempts: 2, Backoff: time.Millisecond}
+	return client
+}
+
+func TestClient(t *testing.T) {
+	scryptN = 1 << 10
+	engine := new(memprotect.Unprotected)
+	engine.Init(new(memprotect.Unprotected).Cell(32))
+	testOracles, oracles := newTestOracles(t, 3, 1000000, engine)
+	defer closeTestOracles(testOracles)
+	client := newTestClient(t, engine, testOracles, oracles)
+	defer os.RemoveAll(client.dir)
+
+	if !client.CreateCypherLock("passphrase", "1234", "my secret", 3600) {
+		t.Fatal("CreateCypherLock failed")
+	}
+	if client.CreateCypherLock("passphrase", "1234", "my secret", 3600) {
+		t.Error("CreateCypherLock overwrote existing lock")
+	}
+	secret, err := client.UnveilSecret("passphrase", "1234")
+	if err != nil {
+		t.Fatalf("UnveilSecret: %s", err)
+	}
+	if secret != "my secret" {
+		t.Errorf("Wrong secret: %s", secret)
+	}
+	if _, err := client.UnveilSecret("passphrase", "4321"); err == nil {
+		t.Error("UnveilSecret with wrong pin")
+	}
+	if !client.ModifyDuration("passphrase", "1234", 7200) {
+		t.Fatal("ModifyDuration failed")
+	}
+	if secret, err := client.UnveilSecret("passphrase", "1234"); err != nil || secret != "my secret" {
+		t.Errorf("UnveilSecret after ModifyDuration: %s %v", secret, err)
+	}
+	assurance, ok := client.DestroySecret()
+	if !ok || assurance != 1 {
+		t.Errorf("DestroySecret: %d %t", assurance, ok)
+	}
+	if _, err := client.UnveilSecret("passphrase", "1234"); err != ErrNoLock {
+		t.Errorf("UnveilSecret after DestroySecret: %v", err)
+	}
+}
+
+func TestClientModifyDurationFailure(t *testing.T) {
+	scryptN = 1 << 10
+	engine := new(memprotect.Unprotected)
+	engine.Init(new(memprotect.Unprotected).Cell(32))
+	testOracles, oracles := newTestOracles(t, 2, 1000000, engine)
+	defer closeTestOracles(testOracles)
+	client := newTestClient(t, engine, testOracles, oracles)
+	defer os.RemoveAll(client.dir)
+
+	if !client.CreateCypherLock("passphrase", "1234", "my secret", 3600) {
+		t.Fatal("CreateCypherLock failed")
+	}
+	before, err := ioutil.ReadDir(client.dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %s", err)
+	}
+	// The second oracle has no timelock keys, creating the new cypherlock fails after some containers were written.
+	timeLocks := client.Oracles[1].TimeLocks
+	client.Oracles[1].TimeLocks = nil
+	if client.ModifyDuration("passphrase", "1234", 7200) {
+		t.Fatal("ModifyDuration without timelock keys")
+	}
+	after, err := ioutil.ReadDir(client.dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %s", err)
+	}
+	if len(after) != len(before) {
+		t.Errorf("Files changed by failed ModifyDuration: %d != %d", len(after), len(before))
+	}
+	if secret, err := client.UnveilSecret("passphrase", "1234"); err != nil || secret != "my secret" {
+		t.Errorf("UnveilSecret after failed ModifyDuration: %s %v", secret, err)
+	}
+	client.Oracles[1].TimeLocks = timeLocks
+	if !client.ModifyDuration("passphrase", "1234", 7200) {
+		t.Fatal("ModifyDuration failed")
+	}
+	if secret, err := client.UnveilSecret("passphrase", "1234"); err != nil || secret != "my secret" {
+		t.Errorf("UnveilSecret after ModifyDuration: %s %v", secret, err)
+	}
+	if after, _ := ioutil.ReadDir(client.dir); len(after) != len(before) {
+		t.Errorf("Files left by ModifyDuration: %d != %d", len(after), len(before))
+	}
+}
+
+func TestClientShortenDuration(t *testing.T) {
+	scryptN = 1 << 10
+	engine := new(memprotect.Unprotected)
+	engine.Init(new(memprotect.Unprotected).Cell(32))
+	testOracles, oracles := newTestOracles(t, 2, 100, engine)
+	defer closeTestOracles(testOracles)
+	client := newTestClient(t, engine, testOracles, oracles)
+	defer os.RemoveAll(client.dir)
+	var wiped int
+	client.RegisterWipe(func(filename string) bool {
+		wiped++
+		return true
+	})
+	if !client.CreateCypherLock("passphrase", "", "", 500) {
+		t.Fatal("CreateCypherLock failed")
+	}
+	before, err := client.listLockFiles()
+	if err != nil {
+		t.Fatalf("listLockFiles: %s", err)
+	}
+	assurance, ok := client.ShortenDuration(150)
+	if !ok || assurance != 2 {
+		t.Errorf("ShortenDuration: %d %t", assurance, ok)
+	}
+	after, err := client.listLockFiles()
+	if err != nil {
+		t.Fatalf("listLockFiles: %s", err)
+	}
+	if len(after) >= len(before) || wiped != len(before)-len(after) {
+		t.Errorf("ShortenDuration removed wrong files: %d %d %d", len(before), len(after), wiped)
+	}
+	end := timeNow() + 150
+	for _, f := range after {
+		if f.validFrom > end {
+			t.Errorf("Container not removed: %s", f.name)
+		}
+	}
+}
+
+func TestClientDeviceKey(t *testing.T) {
+	scryptN = 1 << 10
+	engine := new(memprotect.Unprotected)
+	engine.Init(new(memprotect.Unprotected).Cell(32))
+	testOracles, oracles := newTestOracles(t, 2, 1000000, engine)
+	defer closeTestOracles(testOracles)
+	client := newTestClient(t, engine, testOracles, oracles)
+	defer os.RemoveAll(client.dir)
+	enclave := make(map[string]string)
+	client.RegisterKeyCreate(func() (string, bool) { return "devicekey", true })
+	client.RegisterKeyEncrypt(func(cleartext, publickey string) (string, bool) {
+		enclave["cyphertext"] = cleartext
+		return "cyphertext", true
+	})
+	client.RegisterKeyDecrypt(func(cyphertext, publickey string) (string, bool) {
+		cleartext, ok := enclave[cyphertext]
+		return cleartext, ok && publickey == "devicekey"
+	})
+	client.RegisterKeyWipe(func(publickey string) bool {
+		delete(enclave, "cyphertext")
+		return true
+	})
+	if !client.CreateCypherLock("passphrase", "1234", "my secret", 3600) {
+		t.Fatal("CreateCypherLock failed")
+	}
+	if secret, err := client.UnveilSecret("passphrase", "1234"); err != nil || secret != "my secret" {
+		t.Errorf("UnveilSecret: %s %v", secret, err)
+	}
+	delete(enclave, "cyphertext")
+	if _, err := client.UnveilSecret("passphrase", "1234"); err != ErrDeviceKey {
+		t.Errorf("UnveilSecret without device key: %v", err)
+	}
+}
+
+func TestClientThreshold(t *testing.T) {
+	scryptN = 1 << 10
+	engine := new(memprotect.Unprotected)
+	engine.Init(new(memprotect.Unprotected).Cell(32))
+	testOracles, oracles := newTestOracles(t, 3, 1000000, engine)
+	defer closeTestOracles(testOracles)
+	client := newTestClient(t, engine, testOracles, oracles)
+	defer os.RemoveAll(client.dir)
+	client.Threshold = 2
+	if !client.CreateCypherLock("passphrase", "1234", "my secret", 3600) {
+		t.Fatal("CreateCypherLock failed")
+	}
+	inProcess := client.Transport
+	client.Transport = transport.Func(func(ctx context.Context, url string, message []byte) ([]byte, error) {
+		if url == oracles[0].URL {
+			return nil, errors.New("oracle unreachable")
+		}
+		return inProcess.Send(ctx, url, message)
+	})
+	if secret, err := client.UnveilSecret("passphrase", "1234"); err != nil || secret != "my secret" {
+		t.Errorf("UnveilSecret with one oracle down: %s %v", secret, err)
+	}
+	client.Transport = transport.Func(func(ctx context.Context, url string, message []byte) ([]byte, error) {
+		if url != oracles[2].URL {
+			return nil, errors.New("oracle unreachable")
+		}
+		return inProcess.Send(ctx, url, message)
+	})
+	if _, err := client.UnveilSecret("passphrase", "1234"); err == nil {
+		t.Error("UnveilSecret below threshold")
+	}
+}
@@ -0,0 +1,105 @@
+package clientapi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+
+	"assuredrelease.com/cypherlock-pe/messages"
+	"assuredrelease.com/cypherlock-pe/transport"
+)
+
+var (
+	ErrUnknownOracle = errors.New("clientapi: Unknown oracle")
+	ErrConfigKey     = errors.New("clientapi: Config does not match long term key of oracle")
+	ErrConfigExpired = errors.New("clientapi: Config expired")
+)
+
+// ConfigCache keeps verified oracle configs until their short term keys expire.
+type ConfigCache struct {
+	mutex   *sync.Mutex
+	configs map[string]*messages.OracleConfig // By config URL.
+}
+
+// NewConfigCache returns an empty cache.
+func NewConfigCache() *ConfigCache {
+	return &ConfigCache{
+		mutex:   new(sync.Mutex),
+		configs: make(map[string]*messages.OracleConfig),
+	}
+}
+
+// Invalidate removes the config of oracle from the cache, it is fetched again on next use.
+func (self *ConfigCache) Invalidate(oracle *Oracle) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	delete(self.configs, oracle.ConfigURL)
+}
+
+// Get returns the config of oracle. Cached configs are returned until their short term keys expire or they are
+// invalidated, then the config is fetched again. Fetched configs must be signed by the signature key of oracle and contain its
+// long term key.
+func (self *ConfigCache) Get(fetch transport.Fetcher, oracle *Oracle) (*messages.OracleConfig, error) {
+	self.mutex.Lock()
+	config, ok := self.configs[oracle.ConfigURL]
+	self.mutex.Unlock()
+	if ok && config.LongTermEncryptionKey == oracle.LongTermKey && config.ValidTo > timeNow() {
+		return config, nil
+	}
+	if fetch == nil {
+		return nil, ErrNoFetcher
+	}
+	d, err := fetch.Get(context.Background(), oracle.ConfigURL)
+	if err != nil {
+		return nil, err
+	}
+	config, err = messages.VerifyOracleConfig(d, &oracle.SignatureKey)
+	if err != nil {
+		return nil, err
+	}
+	if config.LongTermEncryptionKey != oracle.LongTermKey {
+		return nil, ErrConfigKey
+	}
+	if config.ValidTo <= timeNow() {
+		return nil, ErrConfigExpired
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.configs[oracle.ConfigURL] = config
+	return config, nil
+}
+
+// ShortTermKeyFactory returns a factory that resolves the short term keys of oracles from their configs.
+// The long term key requested by the container must match the configured oracle.
+func (self *ConfigCache) ShortTermKeyFactory(fetch transport.Fetcher, oracles []Oracle) messages.ShortTermKeyFactory {
+	return func(url string, longTermKey *[32]byte) (*[32]byte, error) {
+		for i := range oracles {
+			oracle := &oracles[i]
+			if oracle.URL != url || oracle.LongTermKey != *longTermKey || oracle.ConfigURL == "" {
+				continue
+			}
+			config, err := self.Get(fetch, oracle)
+			if err != nil {
+				return nil, err
+			}
+			shortTermKey := config.ShortTermEncryptionKey
+			return &shortTermKey, nil
+		}
+		return nil, ErrUnknownOracle
+	}
+}
+
+// Renew returns a function for transport.Retry.Renew. It removes the config of the oracle of a rejected future from
+// the cache, so that the future is renewed with the current short term key of the oracle.
+func (self *ConfigCache) Renew(oracles []Oracle) func(future *messages.OracleFuture) error {
+	return func(future *messages.OracleFuture) error {
+		for i := range oracles {
+			oracle := &oracles[i]
+			if oracle.URL == string(future.URL) && bytes.Equal(oracle.LongTermKey[:], future.OracleLongTermKey) {
+				self.Invalidate(oracle)
+			}
+		}
+		return future.Renew()
+	}
+}
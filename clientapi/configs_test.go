@@ -0,0 +1,92 @@
+package clientapi
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+
+	"assuredrelease.com/cypherlock-pe/memprotect"
+	"assuredrelease.com/cypherlock-pe/oracleserver"
+	"assuredrelease.com/cypherlock-pe/transport"
+)
+
+type countingFetcher struct {
+	fetcher transport.Fetcher
+	mutex   sync.Mutex
+	count   int
+}
+
+func (self *countingFetcher) Get(ctx context.Context, url string) ([]byte, error) {
+	self.mutex.Lock()
+	self.count++
+	self.mutex.Unlock()
+	return self.fetcher.Get(ctx, url)
+}
+
+func TestClientConfigs(t *testing.T) {
+	scryptN = 1 << 10
+	engine := new(memprotect.Unprotected)
+	engine.Init(new(memprotect.Unprotected).Cell(32))
+	testOracles, oracles := newTestOracles(t, 1, 1000000, engine)
+	defer closeTestOracles(testOracles)
+	client := newTestClient(t, engine, testOracles, oracles)
+	defer os.RemoveAll(client.dir)
+	server := oracleserver.New(oracleserver.Config{}, testOracles[0].oracle, testOracles[0].store, new(memprotect.Unprotected))
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+	signatureKey, err := testOracles[0].oracle.SignaturePublicKey()
+	if err != nil {
+		t.Fatalf("SignaturePublicKey: %s", err)
+	}
+	fetcher := &countingFetcher{fetcher: transport.NewHTTP()}
+	client.Fetch = fetcher
+	client.ShortTermKeys = nil
+	client.Oracles[0].SignatureKey = *signatureKey
+	client.Oracles[0].ConfigURL = ts.URL + oracleserver.ConfigPath
+
+	if !client.CreateCypherLock("passphrase", "1234", "my secret", 3600) {
+		t.Fatal("CreateCypherLock failed")
+	}
+	for i := 0; i < 2; i++ {
+		if secret, err := client.UnveilSecret("passphrase", "1234"); err != nil || secret != "my secret" {
+			t.Fatalf("UnveilSecret: %s %v", secret, err)
+		}
+	}
+	if fetcher.count != 1 {
+		t.Errorf("Config not cached: %d fetches", fetcher.count)
+	}
+	// The oracle drops the cached short term key before the config expires, like after a restart.
+	for i := 0; i < 2; i++ {
+		if _, err := testOracles[0].oracle.RotateShortTermKey(); err != nil {
+			t.Fatalf("RotateShortTermKey: %s", err)
+		}
+	}
+	if secret, err := client.UnveilSecret("passphrase", "1234"); err != nil || secret != "my secret" {
+		t.Fatalf("UnveilSecret after rotation: %s %v", secret, err)
+	}
+	if fetcher.count != 2 {
+		t.Errorf("Config not refreshed after rotation: %d fetches", fetcher.count)
+	}
+
+	factory := client.Configs.ShortTermKeyFactory(fetcher, client.Oracles)
+	if _, err := factory(oracles[0].URL, &[32]byte{0x01}); err != ErrUnknownOracle {
+		t.Errorf("Key for wrong long term key: %v", err)
+	}
+	config, err := client.Configs.Get(fetcher, &client.Oracles[0])
+	if err != nil {
+		t.Fatalf("Get: %s", err)
+	}
+	defer func(f func() int64) { timeNow = f }(timeNow)
+	timeNow = func() int64 { return config.ValidTo }
+	if _, err := factory(oracles[0].URL, &oracles[0].LongTermKey); err != ErrConfigExpired || fetcher.count != 3 {
+		t.Errorf("Expired config not refreshed: %v %d", err, fetcher.count)
+	}
+
+	client.Configs.Invalidate(&client.Oracles[0])
+	client.Oracles[0].SignatureKey = [32]byte{0x01}
+	if _, err := factory(oracles[0].URL, &oracles[0].LongTermKey); err == nil {
+		t.Error("Unverified config accepted")
+	}
+}
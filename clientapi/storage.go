@@ -0,0 +1,157 @@
+package clientapi
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"assuredrelease.com/cypherlock-pe/binencode"
+)
+
+const lockHeaderTypeID = 1200
+const lockHeaderVersion = 1
+
+const headerFileName = "cypherlock.hdr"
+const lockFileExt = ".lock"
+
+// lockHeader contains the unencrypted parameters of a cypherlock.
+type lockHeader struct {
+	Version        int32  // Format version.
+	ShareThreshold int32  // Number of shares required to unveil the secret.
+	Salt           []byte // Salt for passphrase key derivation.
+	DeviceKey      []byte // Public key of the device key. Empty if no device key is used.
+	DeviceSecret   []byte // Device secret, encrypted to DeviceKey.
+}
+
+func (self *lockHeader) marshal(out []byte) []byte {
+	d, err := binencode.Encode(out, 2,
+		&self.Version,
+		&self.ShareThreshold,
+		&self.Salt,
+		&self.DeviceKey,
+		&self.DeviceSecret,
+	)
+	if err != nil {
+		panic(err)
+	}
+	binencode.SetType(d, lockHeaderTypeID)
+	return d
+}
+
+func (self *lockHeader) unmarshal(d []byte) (r *lockHeader, remainder []byte, err error) {
+	if err := binencode.GetTypeExpect(d, lockHeaderTypeID); err != nil {
+		return nil, nil, err
+	}
+	if self != nil {
+		r = self
+	} else {
+		r = new(lockHeader)
+	}
+	remainder, err = binencode.Decode(d, 2,
+		&r.Version,
+		&r.ShareThreshold,
+		&r.Salt,
+		&r.DeviceKey,
+		&r.DeviceSecret,
+	)
+	if err != nil {
+		return nil, remainder, err
+	}
+	if r.Version != lockHeaderVersion {
+		return nil, remainder, ErrVersion
+	}
+	return r, remainder, nil
+}
+
+// lockFile describes a stored OracleMessageContainer.
+type lockFile struct {
+	name      string // Filename within the client directory.
+	oracle    int    // Index of the oracle the container is for.
+	validFrom int64  // Container is valid from.
+	validTo   int64  // Container is valid to.
+}
+
+func lockFileName(oracle int, validFrom, validTo int64) string {
+	return fmt.Sprintf("%d-%d-%d%s", oracle, validFrom, validTo, lockFileExt)
+}
+
+func parseLockFileName(name string) (*lockFile, bool) {
+	if !strings.HasSuffix(name, lockFileExt) {
+		return nil, false
+	}
+	r := &lockFile{name: name}
+	if _, err := fmt.Sscanf(strings.TrimSuffix(name, lockFileExt), "%d-%d-%d", &r.oracle, &r.validFrom, &r.validTo); err != nil {
+		return nil, false
+	}
+	return r, true
+}
+
+// isValid returns true if the container can be sent at time now.
+func (self *lockFile) isValid(now int64) bool {
+	return self.validFrom <= now && now <= self.validTo
+}
+
+func (self *Client) path(name string) string {
+	return filepath.Join(self.dir, name)
+}
+
+func (self *Client) hasLock() bool {
+	_, err := os.Stat(self.path(headerFileName))
+	return err == nil
+}
+
+func (self *Client) writeHeader(header *lockHeader) error {
+	return ioutil.WriteFile(self.path(headerFileName), header.marshal(nil), 0600)
+}
+
+func (self *Client) readHeader() (*lockHeader, error) {
+	d, err := ioutil.ReadFile(self.path(headerFileName))
+	if os.IsNotExist(err) {
+		return nil, ErrNoLock
+	} else if err != nil {
+		return nil, err
+	}
+	header, _, err := new(lockHeader).unmarshal(d)
+	return header, err
+}
+
+func (self *Client) writeLockFile(f *lockFile, container []byte) error {
+	return ioutil.WriteFile(self.path(f.name), container, 0600)
+}
+
+func (self *Client) readLockFile(f *lockFile) ([]byte, error) {
+	return ioutil.ReadFile(self.path(f.name))
+}
+
+// listLockFiles returns all containers stored in the client directory.
+func (self *Client) listLockFiles() ([]*lockFile, error) {
+	entries, err := ioutil.ReadDir(self.dir)
+	if err != nil {
+		return nil, err
+	}
+	r := make([]*lockFile, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		if f, ok := parseLockFileName(e.Name()); ok {
+			r = append(r, f)
+		}
+	}
+	return r, nil
+}
+
+// removeFile deletes a file from the client directory. It uses the registered wipe function if available.
+// It returns the assurance of the deletion: 2 for secure deletion, 1 for deletion, 0 on failure.
+func (self *Client) removeFile(name string) int {
+	wiped := self.wipe != nil && self.wipe(self.path(name))
+	if err := os.Remove(self.path(name)); err != nil && !os.IsNotExist(err) {
+		return 0
+	}
+	if wiped {
+		return 2
+	}
+	return 1
+}
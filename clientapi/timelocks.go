@@ -0,0 +1,241 @@
+package clientapi
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"assuredrelease.com/cypherlock-pe/binencode"
+	"assuredrelease.com/cypherlock-pe/messages"
+	"assuredrelease.com/cypherlock-pe/types"
+)
+
+var (
+	ErrTimeLockConflict = errors.New("clientapi: Timelock list conflicts with pinned list")
+	ErrNoFetcher        = errors.New("clientapi: No fetcher configured")
+)
+
+const timeLockPinTypeID = 1201
+
+// timeLockPinFileName is the file in the client directory that keeps the pinned timelock lists.
+const timeLockPinFileName = "timelocks.pin"
+
+// TimeLockCache keeps the timelock lists of oracles. The StartTime and RatchetTime of the first list
+// accepted for an oracle are pinned, later lists must continue it.
+type TimeLockCache struct {
+	mutex    *sync.Mutex
+	lists    map[[32]byte]*pinnedTimeLocks // By long term key of the oracle.
+	filename string                        // Pins are written here if not empty.
+	err      error                         // Returned by Add if the pins could not be loaded.
+}
+
+type pinnedTimeLocks struct {
+	startTime, ratchetTime int64
+	list                   *types.RatchetPublicKey
+}
+
+// NewTimeLockCache returns an empty cache that is kept in memory only.
+func NewTimeLockCache() *TimeLockCache {
+	return &TimeLockCache{
+		mutex: new(sync.Mutex),
+		lists: make(map[[32]byte]*pinnedTimeLocks),
+	}
+}
+
+// OpenTimeLockCache returns a cache that keeps its pins and lists in filename. The pins are loaded from filename
+// if it exists, and every change is written to it.
+func OpenTimeLockCache(filename string) (*TimeLockCache, error) {
+	r := NewTimeLockCache()
+	r.filename = filename
+	d, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return r, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for len(d) > 0 {
+		var longTermKey [32]byte
+		pinned := new(pinnedTimeLocks)
+		if d, err = pinned.unmarshal(d, &longTermKey); err != nil {
+			return nil, err
+		}
+		r.lists[longTermKey] = pinned
+	}
+	return r, nil
+}
+
+// openClientTimeLockCache returns the cache of the client directory dir. If the pins cannot be loaded, the
+// returned cache refuses all lists with the error, so that pins are never silently dropped.
+func openClientTimeLockCache(dir string) *TimeLockCache {
+	r, err := OpenTimeLockCache(filepath.Join(dir, timeLockPinFileName))
+	if err != nil {
+		r = NewTimeLockCache()
+		r.err = err
+	}
+	return r
+}
+
+func (self *pinnedTimeLocks) marshal(longTermKey [32]byte) []byte {
+	keys := make([]byte, 0, len(self.list.Key)*32)
+	for _, k := range self.list.Key {
+		keys = append(keys, k[:]...)
+	}
+	d, err := binencode.Encode(nil, 2,
+		binencode.SlicePointer(longTermKey[:]),
+		self.startTime,
+		self.ratchetTime,
+		self.list.StartTime,
+		&keys,
+	)
+	if err != nil {
+		panic(err)
+	}
+	binencode.SetType(d, timeLockPinTypeID)
+	return d
+}
+
+func (self *pinnedTimeLocks) unmarshal(d []byte, longTermKey *[32]byte) (remainder []byte, err error) {
+	var keys []byte
+	if err := binencode.GetTypeExpect(d, timeLockPinTypeID); err != nil {
+		return nil, err
+	}
+	self.list = new(types.RatchetPublicKey)
+	remainder, err = binencode.Decode(d, 2,
+		binencode.SlicePointer(longTermKey[:]),
+		&self.startTime,
+		&self.ratchetTime,
+		&self.list.StartTime,
+		&keys,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 || len(keys)%32 != 0 || self.ratchetTime <= 0 {
+		return nil, messages.ErrTimeLockList
+	}
+	self.list.RatchetTime = self.ratchetTime
+	self.list.Key = make([][32]byte, len(keys)/32)
+	for i := range self.list.Key {
+		copy(self.list.Key[i][:], keys[i*32:])
+	}
+	return remainder, nil
+}
+
+// write writes lists to the file of the cache. The file is replaced atomically.
+func (self *TimeLockCache) write(lists map[[32]byte]*pinnedTimeLocks) error {
+	if self.filename == "" {
+		return nil
+	}
+	var d []byte
+	for longTermKey, pinned := range lists {
+		d = append(d, pinned.marshal(longTermKey)...)
+	}
+	tmp := self.filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, d, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, self.filename)
+}
+
+// Get returns the cached list for the oracle with longTermKey, or nil.
+func (self *TimeLockCache) Get(longTermKey [32]byte) *types.RatchetPublicKey {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if pinned, ok := self.lists[longTermKey]; ok {
+		return pinned.list
+	}
+	return nil
+}
+
+// Add adds list for the oracle with longTermKey. It returns ErrTimeLockConflict if the list uses a
+// different ratchet period or alignment than the pinned list, or if it contains a different key for
+// a time already covered. The cached list is replaced if list reaches further into the future.
+// Changes are written to the file of the cache before they take effect.
+func (self *TimeLockCache) Add(longTermKey [32]byte, list *types.RatchetPublicKey) error {
+	if list.RatchetTime <= 0 || len(list.Key) == 0 {
+		return messages.ErrTimeLockList
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.err != nil {
+		return self.err
+	}
+	pinned, ok := self.lists[longTermKey]
+	if !ok {
+		pinned = &pinnedTimeLocks{
+			startTime:   list.StartTime,
+			ratchetTime: list.RatchetTime,
+		}
+	} else if pinned.conflicts(list) {
+		return ErrTimeLockConflict
+	} else if listEnd(list) < listEnd(pinned.list) {
+		return nil
+	}
+	lists := make(map[[32]byte]*pinnedTimeLocks, len(self.lists)+1)
+	for k, v := range self.lists {
+		lists[k] = v
+	}
+	lists[longTermKey] = &pinnedTimeLocks{startTime: pinned.startTime, ratchetTime: pinned.ratchetTime, list: list}
+	if err := self.write(lists); err != nil {
+		return err
+	}
+	self.lists = lists
+	return nil
+}
+
+func (self *pinnedTimeLocks) conflicts(list *types.RatchetPublicKey) bool {
+	if list.RatchetTime != self.ratchetTime || (list.StartTime-self.startTime)%self.ratchetTime != 0 {
+		return true
+	}
+	for i, key := range list.Key {
+		if timeKey := self.list.SelectKey(list.StartTime + int64(i)*list.RatchetTime); timeKey != nil && timeKey.PublicKey != key {
+			return true
+		}
+	}
+	return false
+}
+
+// listEnd returns the end of the validity of the last key in list.
+func listEnd(list *types.RatchetPublicKey) int64 {
+	return list.StartTime + int64(len(list.Key))*list.RatchetTime
+}
+
+// RefreshTimeLocks fetches the timelock lists of all oracles with a TimeLockURL, verifies them with the
+// signature key of the oracle and updates their TimeLocks from the cache. Lists that fail verification
+// or conflict with the pinned list are ignored and the first such error is returned.
+func (self *Client) RefreshTimeLocks() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.Fetch == nil {
+		return ErrNoFetcher
+	}
+	var err error
+	for i := range self.Oracles {
+		oracle := &self.Oracles[i]
+		if oracle.TimeLockURL == "" {
+			continue
+		}
+		if terr := self.refreshTimeLocks(oracle); terr != nil && err == nil {
+			err = terr
+		}
+		if list := self.TimeLocks.Get(oracle.LongTermKey); list != nil {
+			oracle.TimeLocks = list
+		}
+	}
+	return err
+}
+
+func (self *Client) refreshTimeLocks(oracle *Oracle) error {
+	d, err := self.Fetch.Get(context.Background(), oracle.TimeLockURL)
+	if err != nil {
+		return err
+	}
+	list, err := messages.VerifyTimeLockList(d, &oracle.SignatureKey, &oracle.LongTermKey)
+	if err != nil {
+		return err
+	}
+	return self.TimeLocks.Add(oracle.LongTermKey, list.RatchetPublicKey())
+}
@@ -0,0 +1,128 @@
+package clientapi
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"assuredrelease.com/cypherlock-pe/memprotect"
+	"assuredrelease.com/cypherlock-pe/oracleserver"
+	"assuredrelease.com/cypherlock-pe/transport"
+	"assuredrelease.com/cypherlock-pe/types"
+)
+
+func TestTimeLockCache(t *testing.T) {
+	cache := NewTimeLockCache()
+	oracle := [32]byte{0x01}
+	list := &types.RatchetPublicKey{StartTime: 1000, RatchetTime: 100, Key: [][32]byte{{0x01}, {0x02}, {0x03}}}
+	if err := cache.Add(oracle, list); err != nil {
+		t.Fatalf("Add: %s", err)
+	}
+	next := &types.RatchetPublicKey{StartTime: 1200, RatchetTime: 100, Key: [][32]byte{{0x03}, {0x04}}}
+	if err := cache.Add(oracle, next); err != nil {
+		t.Errorf("Continued list refused: %s", err)
+	}
+	if cache.Get(oracle) != next {
+		t.Error("Longer list not cached")
+	}
+	conflicts := []*types.RatchetPublicKey{
+		{StartTime: 1200, RatchetTime: 50, Key: [][32]byte{{0x03}}},
+		{StartTime: 1250, RatchetTime: 100, Key: [][32]byte{{0x05}}},
+		{StartTime: 1300, RatchetTime: 100, Key: [][32]byte{{0x05}}},
+	}
+	for i, conflict := range conflicts {
+		if err := cache.Add(oracle, conflict); err != ErrTimeLockConflict {
+			t.Errorf("Conflict %d accepted: %v", i, err)
+		}
+	}
+	if cache.Get(oracle) != next {
+		t.Error("Pinned list replaced")
+	}
+	if err := cache.Add([32]byte{0x02}, conflicts[0]); err != nil {
+		t.Errorf("Oracles not separated: %s", err)
+	}
+}
+
+func TestTimeLockCacheRestart(t *testing.T) {
+	engine := new(memprotect.Unprotected)
+	engine.Init(new(memprotect.Unprotected).Cell(32))
+	dir, err := ioutil.TempDir("", "CLPEtestClient")
+	if err != nil {
+		t.Fatalf("Cannot create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	oracle := [32]byte{0x01}
+	list := &types.RatchetPublicKey{StartTime: 1000, RatchetTime: 100, Key: [][32]byte{{0x01}, {0x02}, {0x03}}}
+	if err := NewClient(dir, engine).TimeLocks.Add(oracle, list); err != nil {
+		t.Fatalf("Add: %s", err)
+	}
+	if err := NewClient(dir, engine).TimeLocks.Add([32]byte{0x02}, list); err != nil {
+		t.Fatalf("Add second oracle: %s", err)
+	}
+	restarted := NewClient(dir, engine).TimeLocks
+	if got := restarted.Get(oracle); !reflect.DeepEqual(got, list) {
+		t.Errorf("List not loaded: %+v", got)
+	}
+	if restarted.Get([32]byte{0x02}) == nil {
+		t.Error("List of second oracle not loaded")
+	}
+	for i, conflict := range []*types.RatchetPublicKey{
+		{StartTime: 1000, RatchetTime: 50, Key: [][32]byte{{0x01}}},
+		{StartTime: 1050, RatchetTime: 100, Key: [][32]byte{{0x05}}},
+		{StartTime: 1100, RatchetTime: 100, Key: [][32]byte{{0x05}}},
+	} {
+		if err := restarted.Add(oracle, conflict); err != ErrTimeLockConflict {
+			t.Errorf("Conflict %d accepted after restart: %v", i, err)
+		}
+	}
+	next := &types.RatchetPublicKey{StartTime: 1200, RatchetTime: 100, Key: [][32]byte{{0x03}, {0x04}}}
+	if err := restarted.Add(oracle, next); err != nil {
+		t.Errorf("Continued list refused after restart: %s", err)
+	}
+	if got := NewClient(dir, engine).TimeLocks.Get(oracle); !reflect.DeepEqual(got, next) {
+		t.Errorf("Continued list not written: %+v", got)
+	}
+	// Unreadable pins are not dropped silently.
+	if err := ioutil.WriteFile(filepath.Join(dir, timeLockPinFileName), []byte("garbage"), 0600); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	if _, err := OpenTimeLockCache(filepath.Join(dir, timeLockPinFileName)); err == nil {
+		t.Error("Corrupt pins loaded")
+	}
+	if err := NewClient(dir, engine).TimeLocks.Add([32]byte{0x03}, list); err == nil {
+		t.Error("List accepted with corrupt pins")
+	}
+}
+
+func TestClientRefreshTimeLocks(t *testing.T) {
+	engine := new(memprotect.Unprotected)
+	engine.Init(new(memprotect.Unprotected).Cell(32))
+	testOracles, oracles := newTestOracles(t, 1, 1000000, engine)
+	defer closeTestOracles(testOracles)
+	client := newTestClient(t, engine, testOracles, oracles)
+	defer os.RemoveAll(client.dir)
+	server := oracleserver.New(oracleserver.Config{}, testOracles[0].oracle, testOracles[0].store, new(memprotect.Unprotected))
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+	signatureKey, err := testOracles[0].oracle.SignaturePublicKey()
+	if err != nil {
+		t.Fatalf("SignaturePublicKey: %s", err)
+	}
+	client.Fetch = transport.NewHTTP()
+	client.Oracles[0].TimeLocks = nil
+	client.Oracles[0].SignatureKey = *signatureKey
+	client.Oracles[0].TimeLockURL = ts.URL + oracleserver.TimeLockPath + "?count=10"
+	if err := client.RefreshTimeLocks(); err != nil {
+		t.Fatalf("RefreshTimeLocks: %s", err)
+	}
+	if timeLocks := client.Oracles[0].TimeLocks; timeLocks == nil || timeLocks.Key[0] != oracles[0].TimeLocks.Key[0] {
+		t.Fatalf("TimeLocks not updated: %+v", timeLocks)
+	}
+	client.Oracles[0].SignatureKey = [32]byte{0x01}
+	if err := client.RefreshTimeLocks(); err == nil {
+		t.Error("Unverified list accepted")
+	}
+}
@@ -0,0 +1,156 @@
+package clientapi
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Methods of the worker queue.
+const (
+	MethodWipeFile  = "WipeFile"
+	MethodWipeKey   = "WipeKey"
+	MethodCreateKey = "CreateKey"
+	MethodEncrypt   = "Encrypt"
+	MethodDecrypt   = "Decrypt"
+	MethodIdle      = "Idle"
+	MethodNone      = "None"
+)
+
+var (
+	ErrTaskFailed  = errors.New("clientapi: Task completed with error")
+	ErrTaskTimeout = errors.New("clientapi: Task timed out")
+)
+
+// DefaultTaskTimeout is the time a task may take from submission to completion.
+const DefaultTaskTimeout = 60 * time.Second
+
+type taskResult struct {
+	data string
+	err  error
+}
+
+type task struct {
+	id                     int
+	method                 string
+	param1, param2, param3 string
+	result                 chan taskResult
+}
+
+// WorkQueue hands tasks to the platform and returns their results to the waiting caller. It is safe for concurrent use.
+type WorkQueue struct {
+	mutex      *sync.Mutex
+	timeout    time.Duration
+	lastID     int
+	pending    []*task       // Tasks not yet handed to the platform.
+	active     map[int]*task // Tasks handed to the platform but not completed.
+	operations int           // Number of operations in progress that may submit tasks.
+}
+
+// NewWorkQueue returns a new WorkQueue. Tasks that are not completed within timeout fail.
+func NewWorkQueue(timeout time.Duration) *WorkQueue {
+	if timeout <= 0 {
+		timeout = DefaultTaskTimeout
+	}
+	return &WorkQueue{
+		mutex:   new(sync.Mutex),
+		timeout: timeout,
+		active:  make(map[int]*task),
+	}
+}
+
+func (self *WorkQueue) setTimeout(timeout time.Duration) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if timeout <= 0 {
+		timeout = DefaultTaskTimeout
+	}
+	self.timeout = timeout
+}
+
+// Submit queues a task and waits until the platform completes it or the timeout is reached.
+func (self *WorkQueue) Submit(method, param1, param2, param3 string) (returnData string, err error) {
+	t := &task{
+		method: method,
+		param1: param1,
+		param2: param2,
+		param3: param3,
+		result: make(chan taskResult, 1),
+	}
+	self.mutex.Lock()
+	self.lastID++
+	t.id = self.lastID
+	self.pending = append(self.pending, t)
+	timeout := self.timeout
+	self.mutex.Unlock()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-t.result:
+		return r.data, r.err
+	case <-timer.C:
+		self.remove(t.id)
+		return "", ErrTaskTimeout
+	}
+}
+
+// remove a task from the queue. Returns the task or nil if it is not known.
+func (self *WorkQueue) remove(id int) *task {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if t, ok := self.active[id]; ok {
+		delete(self.active, id)
+		return t
+	}
+	for i, t := range self.pending {
+		if t.id == id {
+			self.pending = append(self.pending[:i], self.pending[i+1:]...)
+			return t
+		}
+	}
+	return nil
+}
+
+// Worker returns the next task for the platform. If no task is waiting, method is MethodIdle while operations
+// are in progress and MethodNone otherwise.
+func (self *WorkQueue) Worker() (task int, method, param1, param2, param3 string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if len(self.pending) == 0 {
+		if self.operations > 0 {
+			return 0, MethodIdle, "", "", ""
+		}
+		return 0, MethodNone, "", "", ""
+	}
+	t := self.pending[0]
+	self.pending = self.pending[1:]
+	self.active[t.id] = t
+	return t.id, t.method, t.param1, t.param2, t.param3
+}
+
+// Completed signals that the platform has finished a task. Unknown or timed out tasks are ignored.
+func (self *WorkQueue) Completed(task int, withError bool, returnData string) {
+	t := self.remove(task)
+	if t == nil {
+		return
+	}
+	if withError {
+		t.result <- taskResult{err: ErrTaskFailed}
+		return
+	}
+	t.result <- taskResult{data: returnData}
+}
+
+// begin marks the start of an operation that may submit tasks.
+func (self *WorkQueue) begin() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.operations++
+}
+
+// end marks the end of an operation started with begin.
+func (self *WorkQueue) end() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.operations--
+}
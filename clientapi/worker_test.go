@@ -0,0 +1,134 @@
+package clientapi
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"assuredrelease.com/cypherlock-pe/memprotect"
+)
+
+func TestWorkQueue(t *testing.T) {
+	queue := NewWorkQueue(time.Second)
+	if id, method, _, _, _ := queue.Worker(); id != 0 || method != MethodNone {
+		t.Errorf("Empty queue returned: %d %s", id, method)
+	}
+	queue.begin()
+	if _, method, _, _, _ := queue.Worker(); method != MethodIdle {
+		t.Errorf("Empty queue during operation returned: %s", method)
+	}
+	wg := new(sync.WaitGroup)
+	results := make([]string, 3)
+	errs := make([]error, 3)
+	for i, p := range []string{"a", "b", "c"} {
+		wg.Add(1)
+		go func(i int, p string) {
+			defer wg.Done()
+			results[i], errs[i] = queue.Submit(MethodEncrypt, "key", p, "")
+		}(i, p)
+	}
+	seen := make(map[int]bool)
+	for len(seen) < 3 {
+		id, method, param1, param2, _ := queue.Worker()
+		if method == MethodIdle {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		if method != MethodEncrypt || param1 != "key" {
+			t.Fatalf("Wrong task: %s %s", method, param1)
+		}
+		if seen[id] {
+			t.Fatalf("Task id not unique: %d", id)
+		}
+		seen[id] = true
+		queue.Completed(id, param2 == "c", strings.ToUpper(param2))
+	}
+	wg.Wait()
+	queue.end()
+	if results[0] != "A" || results[1] != "B" || errs[0] != nil || errs[1] != nil {
+		t.Errorf("Wrong results: %v %v", results, errs)
+	}
+	if errs[2] != ErrTaskFailed {
+		t.Errorf("Error not propagated: %v", errs[2])
+	}
+	queue.Completed(1, false, "") // Unknown tasks are ignored.
+}
+
+func TestWorkQueueTimeout(t *testing.T) {
+	queue := NewWorkQueue(10 * time.Millisecond)
+	if _, err := queue.Submit(MethodWipeFile, "file", "", ""); err != ErrTaskTimeout {
+		t.Errorf("Pending task did not time out: %v", err)
+	}
+	go func() {
+		for {
+			if id, method, _, _, _ := queue.Worker(); method == MethodWipeKey {
+				time.Sleep(50 * time.Millisecond)
+				queue.Completed(id, false, "")
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	if _, err := queue.Submit(MethodWipeKey, "key", "", ""); err != ErrTaskTimeout {
+		t.Errorf("Active task did not time out: %v", err)
+	}
+	if id, method, _, _, _ := queue.Worker(); id != 0 || method != MethodNone {
+		t.Errorf("Timed out tasks remain in queue: %d %s", id, method)
+	}
+}
+
+func TestClientWorkerQueue(t *testing.T) {
+	scryptN = 1 << 10
+	engine := new(memprotect.Unprotected)
+	engine.Init(new(memprotect.Unprotected).Cell(32))
+	testOracles, oracles := newTestOracles(t, 2, 1000000, engine)
+	defer closeTestOracles(testOracles)
+	client := newTestClient(t, engine, testOracles, oracles)
+	defer os.RemoveAll(client.dir)
+	client.UseWorkerQueue(time.Second)
+	// Platform emulation.
+	stop := make(chan struct{})
+	defer close(stop)
+	enclave := make(map[string]string)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			id, method, param1, param2, _ := client.Worker()
+			switch method {
+			case MethodCreateKey:
+				client.Completed(id, false, "devicekey")
+			case MethodEncrypt:
+				enclave[param1] = param2
+				client.Completed(id, false, "cyphertext")
+			case MethodDecrypt:
+				cleartext, ok := enclave[param1]
+				client.Completed(id, !ok || param2 != "cyphertext", cleartext)
+			case MethodWipeKey:
+				delete(enclave, param1)
+				client.Completed(id, false, "")
+			case MethodWipeFile:
+				client.Completed(id, false, "")
+			default:
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+	if !client.CreateCypherLock("passphrase", "1234", "my secret", 3600) {
+		t.Fatal("CreateCypherLock failed")
+	}
+	if secret, err := client.UnveilSecret("passphrase", "1234"); err != nil || secret != "my secret" {
+		t.Errorf("UnveilSecret: %s %v", secret, err)
+	}
+	if assurance, ok := client.DestroySecret(); !ok || assurance != 2 {
+		t.Errorf("DestroySecret: %d %t", assurance, ok)
+	}
+	if _, ok := enclave["devicekey"]; ok {
+		t.Error("Device key not wiped")
+	}
+}
@@ -0,0 +1,217 @@
+// Command oracleserver runs a Cypherlock oracle over HTTP.
+//
+// With -keystore the oracle keys are loaded from the encrypted keystore file, or generated and written to it
+// if it does not exist. The passphrase is read from the environment variable CYPHERLOCK_PASSPHRASE. An existing
+// keystore is refused if the signal store records no timelock ratchet position for it. If the signal store was lost,
+// -recoverposition accepts the keystore once and records its position. Only use it with the latest keystore: an
+// older copy would rewind the ratchet.
+//
+// SIGTERM shuts the server down gracefully. With the default memguard engine, SIGINT purges
+// protected memory and exits immediately.
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"assuredrelease.com/cypherlock-pe/keystore"
+	"assuredrelease.com/cypherlock-pe/memprotect"
+	"assuredrelease.com/cypherlock-pe/messages"
+	"assuredrelease.com/cypherlock-pe/oracleserver"
+	"assuredrelease.com/cypherlock-pe/signalstore"
+	"assuredrelease.com/cypherlock-pe/transport"
+)
+
+var (
+	listen         = flag.String("listen", "127.0.0.1:8080", "Address to listen on")
+	storeDir       = flag.String("store", "signals", "Directory of the signal store")
+	ratchetTime    = flag.Int64("ratchet", 86400, "Seconds between timelock ratchet advances")
+	expireTime     = flag.Int64("expire", 3600, "Lifetime of the short term key in seconds")
+	maxRequestSize = flag.Int64("maxrequest", oracleserver.DefaultMaxRequestSize, "Maximum request size in bytes")
+	rate           = flag.Float64("rate", oracleserver.DefaultRate, "Requests per second per client")
+	burst          = flag.Int("burst", oracleserver.DefaultBurst, "Requests a client can make at once")
+	retention      = flag.Duration("retention", 0, "Remove signals this long after their window ended. 0 keeps them forever")
+	gcInterval     = flag.Duration("gc", time.Hour, "Interval of signal store garbage collection")
+	maxSemaphores  = flag.Int("maxsemaphores", messages.DefaultMaxSemaphores, "Semaphores of each kind accepted per message")
+	urls           = flag.String("urls", "", "Comma separated public URLs of the oracle endpoint, published in the config")
+	timeLockURL    = flag.String("timelockurl", "", "Public location of the timelock list, published in the config")
+	bspPeers       = flag.String("bsppeers", "", "Comma separated BSP peers that shares are relayed to, as signaturekey@baseurl. Relays are refused if empty")
+	keyStore       = flag.String("keystore", "", "Encrypted keystore file. Keys are not persisted if empty")
+	recoverPos     = flag.Bool("recoverposition", false, "Accept a keystore for which the signal store records no ratchet position. Only to recover from a lost signal store")
+	unprotected    = flag.Bool("unprotected", false, "Do not use protected memory. For testing only")
+)
+
+func newEngine() (memprotect.Engine, error) {
+	key := new(memprotect.Unprotected).Cell(32)
+	if _, err := io.ReadFull(rand.Reader, key.Bytes()); err != nil {
+		return nil, err
+	}
+	var engine memprotect.Engine
+	if *unprotected {
+		engine = new(memprotect.Unprotected)
+	} else {
+		engine = new(memprotect.MemGuard)
+	}
+	engine.Init(key)
+	return engine, nil
+}
+
+// passphraseEnv is the environment variable containing the keystore passphrase.
+const passphraseEnv = "CYPHERLOCK_PASSPHRASE"
+
+// loadKeys restores the keys of oracle from the keystore, or generates them if the keystore does not exist,
+// and writes them to the keystore. Without keystore, new keys are generated.
+func loadKeys(oracle *messages.Oracle, engine memprotect.Engine) error {
+	if *keyStore == "" {
+		return oracle.Generate(0, *ratchetTime, *expireTime)
+	}
+	passphrase := []byte(os.Getenv(passphraseEnv))
+	os.Unsetenv(passphraseEnv)
+	if len(passphrase) == 0 {
+		return fmt.Errorf("%s not set", passphraseEnv)
+	}
+	defer func() {
+		for i := range passphrase {
+			passphrase[i] = 0x00
+		}
+	}()
+	keys, err := keystore.Read(*keyStore, passphrase, engine)
+	if err == nil {
+		// Restore advances the ratchet to the present. Rewrite the keystore so that it does not keep keys of past periods.
+		// An existing keystore is only restored together with the signal store that records its ratchet position,
+		// otherwise a copy of an old keystore could rewind the ratchet.
+		err = oracle.Restore(keys.LongTermKey, keys.TimeLockKey, keys.SignatureKey, *expireTime)
+		if err == messages.ErrNoRatchetPosition {
+			return fmt.Errorf("signal store %s records no ratchet position for keystore %s, see -recoverposition", *storeDir, *keyStore)
+		}
+	} else if os.IsNotExist(err) {
+		err = oracle.Generate(0, *ratchetTime, *expireTime)
+	}
+	if err != nil {
+		return err
+	}
+	keys = new(keystore.Keys)
+	keys.LongTermKey, keys.TimeLockKey, keys.SignatureKey = oracle.Save()
+	return keystore.Write(*keyStore, passphrase, keys, engine)
+}
+
+// parseBSPPeers parses the -bsppeers flag. Each peer is given by its long term signature key in hex and the base
+// URL of its oracle server.
+func parseBSPPeers(s string) ([]messages.BSPPeer, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var peers []messages.BSPPeer
+	for _, p := range strings.Split(s, ",") {
+		i := strings.Index(p, "@")
+		if i < 0 {
+			return nil, fmt.Errorf("BSP peer %q: missing @", p)
+		}
+		key, err := hex.DecodeString(p[:i])
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("BSP peer %q: invalid signature key", p)
+		}
+		base := strings.TrimSuffix(p[i+1:], "/")
+		peer := messages.BSPPeer{URL: base + oracleserver.BSPSharePath, ConfigURL: base + oracleserver.ConfigPath}
+		copy(peer.SignatureKey[:], key)
+		peers = append(peers, peer)
+	}
+	return peers, nil
+}
+
+func main() {
+	flag.Parse()
+	peers, err := parseBSPPeers(*bspPeers)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(2)
+	}
+	engine, err := newEngine()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Memory engine: %s\n", err)
+		os.Exit(1)
+	}
+	store, err := signalstore.New(*storeDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Signal store: %s\n", err)
+		engine.Exit(1)
+	}
+	if *retention > 0 {
+		store.SetRetention(*retention)
+	}
+	store.RunGCService(context.Background(), *gcInterval)
+	oracle := messages.NewOracle(store, engine)
+	if *recoverPos {
+		fmt.Fprintf(os.Stderr, "Warning: Accepting keystore without recorded ratchet position\n")
+		oracle.SetRecoverRatchetPosition(true)
+	}
+	if err := loadKeys(oracle, engine); err != nil {
+		fmt.Fprintf(os.Stderr, "Load keys: %s\n", err)
+		store.Close()
+		engine.Exit(1)
+	}
+	oracle.SetMaxSemaphores(*maxSemaphores)
+	if *urls != "" {
+		oracle.SetURLs(*timeLockURL, strings.Split(*urls, ",")...)
+	} else {
+		oracle.SetURLs(*timeLockURL)
+	}
+	longTermKey, shortTermKey := oracle.PublicKeys()
+	signatureKey, err := oracle.SignaturePublicKey()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Signature key: %s\n", err)
+		store.Close()
+		engine.Exit(1)
+	}
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	oracle.SetLogger(logger)
+	logger.Printf("Long term key: %x", longTermKey[:])
+	logger.Printf("Short term key: %x", shortTermKey[:])
+	logger.Printf("Signature key: %x", signatureKey[:])
+	oracle.RunRotationService()
+	oracle.RunRatchetService(nil)
+	// BSP nodes are addressed by the URL of their BSPSharePath.
+	oracle.SetBSPPeers(peers...)
+	relayTransport := transport.NewHTTP()
+	oracle.RunRelayService(func(url string, signatureKey *[32]byte, message []byte) error {
+		_, err := relayTransport.Send(context.Background(), url, message)
+		return err
+	}, func(url string) ([]byte, error) {
+		return relayTransport.Get(context.Background(), url)
+	})
+	server := oracleserver.New(oracleserver.Config{
+		Addr:           *listen,
+		MaxRequestSize: *maxRequestSize,
+		Rate:           *rate,
+		Burst:          *burst,
+		ShareHandler: func(share *messages.BSPShareMsg) {
+			logger.Printf("Stored BSP share of round %x", share.RoundRoot)
+		},
+	}, oracle, store, engine)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM)
+	go func() {
+		<-signals
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		fmt.Fprintf(os.Stderr, "Serve: %s\n", err)
+		server.Shutdown(context.Background())
+		os.Exit(1)
+	}
+	server.Shutdown(context.Background())
+}
@@ -52,7 +52,8 @@ func (self *SecretCalculator) calculateSecret() (err error) {
 		return err
 	}
 	self.Keys[0].MyPublicKey = myPublicKey
-	secretState := self.Combiner.Combine(protocolConstant, tsecret.Bytes())
+	// Combine modifies the key during calculation, use a copy to allow concurrent calls.
+	secretState := self.Combiner.Combine(append([]byte{}, protocolConstant...), tsecret.Bytes())
 	tsecret.Destroy()
 	for i := 1; i < len(self.Keys); i++ {
 		myPublicKey, tsecret, err := self.Keys[i].SecretGenerator.SharedSecret(self.Keys[i].MyPublicKey, self.Keys[i].PeerPublicKey)
@@ -2,6 +2,7 @@ package hybridcrypto
 
 import (
 	"bytes"
+	"sync"
 	"testing"
 
 	"assuredrelease.com/cypherlock-pe/memprotect"
@@ -82,3 +83,60 @@ func TestCalculateSecret(t *testing.T) {
 		t.Error("Secret calculation failed")
 	}
 }
+
+// TestCalculateSecretConcurrent checks that concurrent calculations do not modify the shared protocol constant,
+// which the combiner changes during calculation.
+func TestCalculateSecretConcurrent(t *testing.T) {
+	engine := new(memprotect.Unprotected)
+	engine.Init(new(memprotect.Unprotected).Cell(32))
+	defer engine.Finish()
+	key1 := protectedcrypto.NewCurve25519(engine)
+	if err := key1.Generate(); err != nil {
+		t.Fatalf("Generate key1: %s", err)
+	}
+	key2 := protectedcrypto.NewCurve25519(engine)
+	if err := key2.Generate(); err != nil {
+		t.Fatalf("Generate key2: %s", err)
+	}
+	constant := append([]byte{}, protocolConstant...)
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 2000; j++ {
+				tsc := &SecretCalculator{
+					Combiner: protectedcrypto.NewSecretCombiner(engine),
+					Keys:     []KeyContainer{{SecretGenerator: key1, MyPublicKey: key1.PublicKey(), PeerPublicKey: key2.PublicKey()}},
+				}
+				secret1, err := tsc.Send()
+				if err != nil {
+					t.Errorf("Send: %s", err)
+					return
+				}
+				tsc2 := &SecretCalculator{
+					Combiner: protectedcrypto.NewSecretCombiner(engine),
+					Keys:     []KeyContainer{{SecretGenerator: key2}},
+				}
+				if err := tsc2.ParseHeaders(tsc.Headers(nil)); err != nil {
+					t.Errorf("ParseHeaders: %s", err)
+					return
+				}
+				secret2, err := tsc2.Receive()
+				if err != nil {
+					t.Errorf("Receive: %s", err)
+					return
+				}
+				if !bytes.Equal(secret1.Bytes(), secret2.Bytes()) {
+					t.Error("Concurrent secret calculation failed")
+				}
+				tsc.DestroySecret()
+				tsc2.DestroySecret()
+			}
+		}()
+	}
+	wg.Wait()
+	if !bytes.Equal(protocolConstant, constant) {
+		t.Error("Protocol constant modified")
+	}
+}
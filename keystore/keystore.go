@@ -0,0 +1,303 @@
+// Package keystore stores the private keys of an oracle encrypted on disk.
+//
+// The file contains a versioned header with the key derivation parameters and the encrypted keys. The key
+// encryption key and a MAC key are derived from the operator passphrase with scrypt. Each key is encrypted
+// with memprotect.EncryptElement, the whole header is authenticated with the MAC key.
+package keystore
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/scrypt"
+
+	"assuredrelease.com/cypherlock-pe/binencode"
+	"assuredrelease.com/cypherlock-pe/memprotect"
+	"assuredrelease.com/cypherlock-pe/protectedcrypto"
+)
+
+var (
+	ErrVersion    = errors.New("keystore: Unknown version")
+	ErrIntegrity  = errors.New("keystore: Integrity check failed")
+	ErrParameters = errors.New("keystore: Key derivation parameters out of bounds")
+)
+
+var RandomSource = rand.Reader
+
+// Key derivation parameters for scrypt. Existing keystores use the parameters stored in their header.
+var (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// Bounds for the scrypt parameters read from a keystore header. The header is only authenticated after the
+// key derivation, so the parameters must be checked before they are used.
+const (
+	maxScryptN  = 1 << 20
+	maxScryptRP = 64
+)
+
+const keyStoreTypeID = 1300
+const keyStoreHeaderTypeID = 1301
+const keyStoreVersion = 1
+
+const saltSize = 32
+
+// Keys are the private keys of an oracle.
+type Keys struct {
+	LongTermKey  memprotect.Element
+	TimeLockKey  memprotect.Element
+	SignatureKey memprotect.Element
+}
+
+// Destroy all keys. Do not call on keys still in use by an oracle.
+func (self *Keys) Destroy() {
+	self.LongTermKey.Destroy()
+	self.TimeLockKey.Destroy()
+	self.SignatureKey.Destroy()
+}
+
+// keyStoreHeader contains the key derivation parameters and the encrypted keys.
+type keyStoreHeader struct {
+	Version      int32
+	ScryptN      int32
+	ScryptR      int32
+	ScryptP      int32
+	Salt         []byte
+	LongTermKey  []byte
+	TimeLockKey  []byte
+	SignatureKey []byte
+}
+
+func (self *keyStoreHeader) marshal(out []byte) []byte {
+	d, err := binencode.Encode(out, 2,
+		&self.Version,
+		&self.ScryptN,
+		&self.ScryptR,
+		&self.ScryptP,
+		&self.Salt,
+		&self.LongTermKey,
+		&self.TimeLockKey,
+		&self.SignatureKey,
+	)
+	if err != nil {
+		panic(err)
+	}
+	binencode.SetType(d, keyStoreHeaderTypeID)
+	return d
+}
+
+func (self *keyStoreHeader) unmarshal(d []byte) (r *keyStoreHeader, remainder []byte, err error) {
+	if err := binencode.GetTypeExpect(d, keyStoreHeaderTypeID); err != nil {
+		return nil, nil, err
+	}
+	if self != nil {
+		r = self
+	} else {
+		r = new(keyStoreHeader)
+	}
+	// Read the version first, later versions may change the layout.
+	if _, err := binencode.Decode(d, 2, &r.Version); err != nil {
+		return nil, nil, err
+	}
+	if r.Version != keyStoreVersion {
+		return nil, nil, ErrVersion
+	}
+	remainder, err = binencode.Decode(d, 2,
+		&r.Version,
+		&r.ScryptN,
+		&r.ScryptR,
+		&r.ScryptP,
+		&r.Salt,
+		&r.LongTermKey,
+		&r.TimeLockKey,
+		&r.SignatureKey,
+	)
+	if err != nil {
+		return nil, remainder, err
+	}
+	return r, remainder, nil
+}
+
+// keyStoreFile is the file content: The marshalled header and its MAC.
+type keyStoreFile struct {
+	Header []byte
+	MAC    []byte
+}
+
+func (self *keyStoreFile) marshal(out []byte) []byte {
+	d, err := binencode.Encode(out, 2, &self.Header, &self.MAC)
+	if err != nil {
+		panic(err)
+	}
+	binencode.SetType(d, keyStoreTypeID)
+	return d
+}
+
+func (self *keyStoreFile) unmarshal(d []byte) (r *keyStoreFile, remainder []byte, err error) {
+	if err := binencode.GetTypeExpect(d, keyStoreTypeID); err != nil {
+		return nil, nil, err
+	}
+	if self != nil {
+		r = self
+	} else {
+		r = new(keyStoreFile)
+	}
+	remainder, err = binencode.Decode(d, 2, &r.Header, &r.MAC)
+	if err != nil {
+		return nil, remainder, err
+	}
+	return r, remainder, nil
+}
+
+// checkParameters verifies that the scrypt parameters in header are within bounds.
+func checkParameters(header *keyStoreHeader) error {
+	n, r, p := header.ScryptN, header.ScryptR, header.ScryptP
+	if n <= 1 || n > maxScryptN || n&(n-1) != 0 {
+		return ErrParameters
+	}
+	if r < 1 || p < 1 || r > maxScryptRP || p > maxScryptRP || r*p > maxScryptRP {
+		return ErrParameters
+	}
+	return nil
+}
+
+// deriveKeys returns the key encryption key and the MAC key for passphrase.
+func deriveKeys(passphrase []byte, header *keyStoreHeader, engine memprotect.Engine) (kek, macKey memprotect.Cell, err error) {
+	k, err := scrypt.Key(passphrase, header.Salt, int(header.ScryptN), int(header.ScryptR), int(header.ScryptP), 64)
+	if err != nil {
+		return nil, nil, err
+	}
+	kek, macKey = engine.Cell(32), engine.Cell(32)
+	kek.Load(k[:32])
+	macKey.Load(k[32:])
+	wipeBytes(k)
+	return kek, macKey, nil
+}
+
+// mac calculates the MAC of header. The key is copied since SHA256HMAC modifies it during calculation.
+func mac(macKey memprotect.Cell, header []byte, engine memprotect.Engine) []byte {
+	key := engine.Cell(32)
+	defer key.Destroy()
+	key.Load(macKey.Bytes())
+	return protectedcrypto.SHA256HMAC(key.Bytes(), header, make([]byte, 32))
+}
+
+func wipeBytes(d []byte) {
+	for i := range d {
+		d[i] = 0x00
+	}
+}
+
+// Write encrypts keys with passphrase and writes them to filename. The file is replaced atomically.
+func Write(filename string, passphrase []byte, keys *Keys, engine memprotect.Engine) error {
+	header := &keyStoreHeader{
+		Version: keyStoreVersion,
+		ScryptN: int32(scryptN),
+		ScryptR: int32(scryptR),
+		ScryptP: int32(scryptP),
+		Salt:    make([]byte, saltSize),
+	}
+	if _, err := io.ReadFull(RandomSource, header.Salt); err != nil {
+		return err
+	}
+	kek, macKey, err := deriveKeys(passphrase, header, engine)
+	if err != nil {
+		return err
+	}
+	defer kek.Destroy()
+	defer macKey.Destroy()
+	if header.LongTermKey, err = memprotect.EncryptElement(kek, keys.LongTermKey); err != nil {
+		return err
+	}
+	if header.TimeLockKey, err = memprotect.EncryptElement(kek, keys.TimeLockKey); err != nil {
+		return err
+	}
+	if header.SignatureKey, err = memprotect.EncryptElement(kek, keys.SignatureKey); err != nil {
+		return err
+	}
+	f := &keyStoreFile{Header: header.marshal(nil)}
+	f.MAC = mac(macKey, f.Header, engine)
+	return writeAtomic(filename, f.marshal(nil))
+}
+
+// Read loads and decrypts the keys in filename.
+func Read(filename string, passphrase []byte, engine memprotect.Engine) (*Keys, error) {
+	d, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	f, _, err := new(keyStoreFile).unmarshal(d)
+	if err != nil {
+		return nil, err
+	}
+	header, _, err := new(keyStoreHeader).unmarshal(f.Header)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkParameters(header); err != nil {
+		return nil, err
+	}
+	kek, macKey, err := deriveKeys(passphrase, header, engine)
+	if err != nil {
+		return nil, err
+	}
+	defer kek.Destroy()
+	defer macKey.Destroy()
+	if !hmac.Equal(f.MAC, mac(macKey, f.Header, engine)) {
+		return nil, ErrIntegrity
+	}
+	keys := new(Keys)
+	if keys.LongTermKey, err = memprotect.DecryptElement(kek, header.LongTermKey, engine); err != nil {
+		return nil, err
+	}
+	if keys.TimeLockKey, err = memprotect.DecryptElement(kek, header.TimeLockKey, engine); err != nil {
+		keys.LongTermKey.Destroy()
+		return nil, err
+	}
+	if keys.SignatureKey, err = memprotect.DecryptElement(kek, header.SignatureKey, engine); err != nil {
+		keys.LongTermKey.Destroy()
+		keys.TimeLockKey.Destroy()
+		return nil, err
+	}
+	return keys, nil
+}
+
+// writeAtomic writes d to a temporary file next to filename and renames it.
+func writeAtomic(filename string, d []byte) error {
+	dir := filepath.Dir(filename)
+	tmp, err := ioutil.TempFile(dir, filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // Fails after successful rename.
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(d); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		return err
+	}
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
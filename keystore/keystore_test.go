@@ -0,0 +1,118 @@
+package keystore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"assuredrelease.com/cypherlock-pe/memprotect"
+	"assuredrelease.com/cypherlock-pe/messages"
+)
+
+func newTestEngine() memprotect.Engine {
+	engine := new(memprotect.Unprotected)
+	engine.Init(new(memprotect.Unprotected).Cell(32))
+	return engine
+}
+
+func TestKeyStore(t *testing.T) {
+	scryptN = 1 << 10
+	engine := newTestEngine()
+	tdir, err := ioutil.TempDir("", "CLPEtestStore")
+	if err != nil {
+		t.Fatalf("Cannot create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tdir)
+	filename := filepath.Join(tdir, "keystore")
+	passphrase := []byte("correct horse battery staple")
+
+	oracle := messages.NewOracle(nil, engine)
+	if err := oracle.Generate(time.Now().Unix(), 3600, 600); err != nil {
+		t.Fatalf("Generate: %s", err)
+	}
+	keys := new(Keys)
+	keys.LongTermKey, keys.TimeLockKey, keys.SignatureKey = oracle.Save()
+	if err := Write(filename, passphrase, keys, engine); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	if fi, err := os.Stat(filename); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("Wrong file mode: %v %v", fi, err)
+	}
+	if files, _ := ioutil.ReadDir(tdir); len(files) != 1 {
+		t.Errorf("Temporary file remains: %d files", len(files))
+	}
+
+	loaded, err := Read(filename, passphrase, engine)
+	if err != nil {
+		t.Fatalf("Read: %s", err)
+	}
+	restored := messages.NewOracle(nil, engine)
+	if err := restored.Restore(loaded.LongTermKey, loaded.TimeLockKey, loaded.SignatureKey, 600); err != nil {
+		t.Fatalf("Restore: %s", err)
+	}
+	longTermKey, _ := oracle.PublicKeys()
+	restoredLongTermKey, _ := restored.PublicKeys()
+	if *longTermKey != *restoredLongTermKey {
+		t.Error("Long term key not restored")
+	}
+	signatureKey, _ := oracle.SignaturePublicKey()
+	restoredSignatureKey, _ := restored.SignaturePublicKey()
+	if *signatureKey != *restoredSignatureKey {
+		t.Error("Signature key not restored")
+	}
+	timeLocks, _ := oracle.TimelockKeys(2)
+	restoredTimeLocks, _ := restored.TimelockKeys(2)
+	if timeLocks.StartTime != restoredTimeLocks.StartTime || timeLocks.Key[1] != restoredTimeLocks.Key[1] {
+		t.Error("Timelock key not restored")
+	}
+
+	if _, err := Read(filename, []byte("wrong"), engine); err != ErrIntegrity {
+		t.Errorf("Wrong passphrase accepted: %v", err)
+	}
+
+	d, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("ReadFile: %s", err)
+	}
+	tampered := append([]byte{}, d...)
+	tampered[len(tampered)-40] ^= 0x01
+	if err := ioutil.WriteFile(filename, tampered, 0600); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	if _, err := Read(filename, passphrase, engine); err == nil {
+		t.Error("Tampered keystore accepted")
+	}
+
+	// Replace with a keystore of a future version, correctly authenticated.
+	f, _, err := new(keyStoreFile).unmarshal(d)
+	if err != nil {
+		t.Fatalf("unmarshal: %s", err)
+	}
+	header, _, err := new(keyStoreHeader).unmarshal(f.Header)
+	if err != nil {
+		t.Fatalf("unmarshal header: %s", err)
+	}
+	header.Version++
+	f.Header = header.marshal(nil)
+	if err := ioutil.WriteFile(filename, f.marshal(nil), 0600); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	if _, err := Read(filename, passphrase, engine); err != ErrVersion {
+		t.Errorf("Unknown version accepted: %v", err)
+	}
+
+	// Replace with a keystore demanding excessive key derivation parameters.
+	for _, params := range [][3]int32{{1 << 30, 8, 1}, {3 << 10, 8, 1}, {1 << 10, 0, 1}, {1 << 10, 1 << 20, 1 << 20}} {
+		header.Version = keyStoreVersion
+		header.ScryptN, header.ScryptR, header.ScryptP = params[0], params[1], params[2]
+		f.Header = header.marshal(nil)
+		if err := ioutil.WriteFile(filename, f.marshal(nil), 0600); err != nil {
+			t.Fatalf("WriteFile: %s", err)
+		}
+		if _, err := Read(filename, passphrase, engine); err != ErrParameters {
+			t.Errorf("Parameters %v accepted: %v", params, err)
+		}
+	}
+}
@@ -0,0 +1,540 @@
+package messages
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"errors"
+
+	"assuredrelease.com/cypherlock-pe/binencode"
+	"assuredrelease.com/cypherlock-pe/memprotect"
+	"assuredrelease.com/cypherlock-pe/merkletree"
+	"assuredrelease.com/cypherlock-pe/protectedcrypto"
+	"assuredrelease.com/cypherlock-pe/signalstore"
+	"assuredrelease.com/cypherlock-pe/symmetriccrypto"
+)
+
+/*
+BSPRelay
+- Encrypt to long-term key node A: (SK: Ephemeral. RK: Long Term Key)
+    - Message Type: Relay.
+    - URL and signature key of node B.
+    - BSPShare.
+    - Padding.
+- Sent in an envelope to node A, the response is an empty ack encrypted to the single response key.
+- Node A only relays to its configured BSP peers. It fetches the signed config of node B and verifies it with the
+  signature key of node B before it accepts and before it delivers a relay.
+
+BSPShare
+- Encrypt to long term key node B. (SK: Ephemeral. RK: Long Term Key)
+    - Message Type: Share.
+    - List of signature keys and URLs of all nodes in BSP round.
+    - Proof of Share Image: Merkle root over the images of all shares of the round, path of this share's image.
+    - Share.
+    - Encrypted to BSP key: (BSP Key is symmetric)
+        - Oracle Message.
+
+Node A only learns the address of node B, node B only learns that the share was relayed. The client does not
+contact node B itself.
+
+The image of a share is its SHA256. A node can show that its share belongs to the round by its path, without
+learning the other shares. Clients publish the round root to audit the nodes.
+*/
+
+const BSPRelayMsgTypeID = 1009
+const BSPShareMsgTypeID = 1010
+const BSPRelayEncType = 0xf2
+const BSPShareEncType = 0xf3
+const BSPRelayEnvelopeType = 1024
+
+// BSPRelayPadSize is the size to which relay messages are padded, so that their size does not reveal the round.
+const BSPRelayPadSize = 4096
+
+// MaxBSPNodes is the maximum number of nodes in a BSP round.
+const MaxBSPNodes = 64
+
+var (
+	ErrBSPNodes   = errors.New("messages: Invalid BSP node list")
+	ErrBSPRound   = errors.New("messages: Share not in BSP round")
+	ErrBSPNode    = errors.New("oracle: Not a node of the BSP round")
+	ErrShareImage = errors.New("oracle: Share does not match its image")
+	ErrBSPRelay   = errors.New("oracle: Invalid relay")
+	ErrRelayQueue = errors.New("oracle: Relay queue full")
+	ErrNoRelay    = errors.New("oracle: Oracle does not relay")
+	ErrBSPPeer    = errors.New("oracle: Relay target is not a BSP peer")
+	ErrPeerConfig = errors.New("oracle: Config of BSP peer not verified")
+)
+
+// BSPNode is a node of a BSP round.
+type BSPNode struct {
+	SignatureKey [32]byte // Long term signature key of the node.
+	URL          []byte   // URL at which the node receives BSPShare messages.
+}
+
+// marshalBSPNodes packs nodes into a single byte slice.
+func marshalBSPNodes(nodes []BSPNode) []byte {
+	var r []byte
+	for i := range nodes {
+		d, err := binencode.Encode(nil, binencode.SlicePointer(nodes[i].SignatureKey[:]), &nodes[i].URL)
+		if err != nil {
+			panic(err)
+		}
+		r = append(r, d...)
+	}
+	return r
+}
+
+// unmarshalBSPNodes reads count nodes packed by marshalBSPNodes.
+func unmarshalBSPNodes(d []byte, count int32) ([]BSPNode, error) {
+	if count < 0 || count > MaxBSPNodes {
+		return nil, ErrBSPNodes
+	}
+	nodes := make([]BSPNode, count)
+	var err error
+	for i := range nodes {
+		d, err = binencode.Decode(d, binencode.SlicePointer(nodes[i].SignatureKey[:]), &nodes[i].URL)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(d) != 0 {
+		return nil, ErrBSPNodes
+	}
+	return nodes, nil
+}
+
+// bspHash is the hash of the merkle tree over the share images.
+const bspHash = crypto.SHA256
+
+// ShareImage returns the image of share that is committed to in the root of a BSP round.
+func ShareImage(share []byte) [32]byte {
+	return sha256.Sum256(share)
+}
+
+// BSPRound commits to the images of all shares of a BSP round.
+type BSPRound struct {
+	Root   []byte   // Root of the merkle tree over the share images. Publish it to audit the round.
+	Proofs [][]byte // Marshalled path of each share image, in the order of the shares.
+}
+
+// NewBSPRound returns the BSPRound of shares.
+func NewBSPRound(shares [][]byte) (*BSPRound, error) {
+	if len(shares) == 0 || len(shares) > MaxBSPNodes {
+		return nil, ErrBSPNodes
+	}
+	images := make([][]byte, len(shares))
+	for i, share := range shares {
+		image := ShareImage(share)
+		images[i] = image[:]
+	}
+	paths := merkletree.NewMerkleTree(images, bspHash).Paths()
+	r := &BSPRound{
+		Proofs: make([][]byte, len(paths)),
+	}
+	for i, path := range paths {
+		r.Proofs[i] = path.Compress().Marshall()
+	}
+	root, _ := paths[0].GetRoot()
+	r.Root = root.Hash
+	return r, nil
+}
+
+// bspProofElementSize is the size of a marshalled path element: Flags and depth, followed by the hash.
+const (
+	bspProofPrefixSize  = 1 + 1 + 1 + 4
+	bspProofElementSize = bspProofPrefixSize + sha256.Size
+)
+
+// verifyShareProof returns true if proof is the path of the image of share to root, in a round of count shares.
+// Malformed proofs are refused before they are passed to merkletree. The proof of the only share of a round may
+// consist of the leaf alone, the path is completed with root.
+func verifyShareProof(root, proof, share []byte, count int) bool {
+	if len(root) != bspProofElementSize || len(proof) == 0 || len(proof)%bspProofElementSize != 0 {
+		return false
+	}
+	if count == 1 && len(proof) == bspProofElementSize {
+		proof = append(append([]byte{}, proof...), root...)
+	}
+	if !validProofShape(proof, count) {
+		return false
+	}
+	ok, path := merkletree.UnMarshallPath(proof, bspHash)
+	if !ok {
+		return false
+	}
+	image := ShareImage(share)
+	if !path.Verify1(image[:], bspHash) {
+		return false
+	}
+	pathRoot, ok := path.GetRoot()
+	return ok && bytes.Equal(pathRoot.Hash, root)
+}
+
+// validProofShape returns true if proof has the structure of a path in a round of count shares. The structure, the
+// flags and depth of each element, only depends on the number of shares and the position of the share. proof is
+// compared to the paths of a tree over count placeholders, so merkletree only verifies paths of the structure it
+// creates itself.
+func validProofShape(proof []byte, count int) bool {
+	if count < 1 || count > MaxBSPNodes {
+		return false
+	}
+	placeholders := make([][]byte, count)
+	for i := range placeholders {
+		placeholders[i] = []byte{byte(i)}
+	}
+PathLoop:
+	for _, path := range merkletree.NewMerkleTree(placeholders, bspHash).Paths() {
+		path = path.Compress()
+		if len(path)*bspProofElementSize != len(proof) {
+			continue
+		}
+		for i, e := range path {
+			if !bytes.Equal(e.Hash[:bspProofPrefixSize], proof[i*bspProofElementSize:i*bspProofElementSize+bspProofPrefixSize]) {
+				continue PathLoop
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// BSPShareMsg carries a share from a client to node B, relayed by node A.
+type BSPShareMsg struct {
+	Nodes         []BSPNode // All nodes of the BSP round.
+	RoundRoot     []byte    // Root of the BSP round.
+	ShareProof    []byte    // Path of the image of Share to RoundRoot.
+	Share         []byte    // Share contents.
+	OracleMessage []byte    // Oracle message, encrypted to the BSP key.
+}
+
+// NewBSPShare returns a BSPShareMsg for the share with index in round. nodes are the nodes of the round, one for each
+// share. oracleMessage is encrypted with the symmetric bspKey.
+func NewBSPShare(nodes []BSPNode, round *BSPRound, index int, share, oracleMessage, bspKey []byte) (*BSPShareMsg, error) {
+	if len(nodes) == 0 || len(nodes) > MaxBSPNodes || len(nodes) != len(round.Proofs) {
+		return nil, ErrBSPNodes
+	}
+	if len(share) > MaxShareSize {
+		return nil, ErrBufferSize
+	}
+	if index < 0 || index >= len(round.Proofs) || !verifyShareProof(round.Root, round.Proofs[index], share, len(round.Proofs)) {
+		return nil, ErrBSPRound
+	}
+	enc, err := symmetriccrypto.Encrypt(bspKey, oracleMessage, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &BSPShareMsg{
+		Nodes:         nodes,
+		RoundRoot:     round.Root,
+		ShareProof:    round.Proofs[index],
+		Share:         share,
+		OracleMessage: enc,
+	}, nil
+}
+
+// Marshal BSPShareMsg. If out ==nil, a new output slice will be allocated.
+func (self *BSPShareMsg) Marshal(out []byte) []byte {
+	count := int32(len(self.Nodes))
+	nodes := marshalBSPNodes(self.Nodes)
+	d, err := binencode.Encode(out, 2,
+		count,
+		&nodes,
+		&self.RoundRoot,
+		&self.ShareProof,
+		&self.Share,
+		&self.OracleMessage,
+	)
+	if err != nil {
+		panic(err)
+	}
+	binencode.SetType(d, BSPShareMsgTypeID)
+	return d
+}
+
+// Unmarshal BSPShareMsg. If receiver is nil, a new receiver is created. Otherwise the receiver is used.
+func (self *BSPShareMsg) Unmarshal(d []byte) (r *BSPShareMsg, remainder []byte, err error) {
+	var count int32
+	var nodes []byte
+	if err := binencode.GetTypeExpect(d, BSPShareMsgTypeID); err != nil {
+		return nil, nil, err
+	}
+	if self != nil {
+		r = self
+	} else {
+		r = new(BSPShareMsg)
+	}
+	remainder, err = binencode.Decode(d, 2,
+		&count,
+		&nodes,
+		&r.RoundRoot,
+		&r.ShareProof,
+		&r.Share,
+		&r.OracleMessage,
+	)
+	if err != nil {
+		return nil, remainder, err
+	}
+	if r.Nodes, err = unmarshalBSPNodes(nodes, count); err != nil {
+		return nil, remainder, err
+	}
+	return r, remainder, nil
+}
+
+// VerifyRound returns nil if the share belongs to the BSP round with root, which has a share for each node. Clients
+// use it to audit the share a node received.
+func (self *BSPShareMsg) VerifyRound(root []byte) error {
+	if !bytes.Equal(self.RoundRoot, root) {
+		return ErrBSPRound
+	}
+	if len(self.Share) > MaxShareSize || !verifyShareProof(self.RoundRoot, self.ShareProof, self.Share, len(self.Nodes)) {
+		return ErrShareImage
+	}
+	return nil
+}
+
+// verify returns nil if the node with signatureKey is part of the round and the share matches its image.
+func (self *BSPShareMsg) verify(signatureKey *[32]byte) error {
+	if len(self.Nodes) == 0 || len(self.Nodes) > MaxBSPNodes {
+		return ErrBSPNodes
+	}
+	for _, node := range self.Nodes {
+		if node.SignatureKey == *signatureKey {
+			return self.VerifyRound(self.RoundRoot)
+		}
+	}
+	return ErrBSPNode
+}
+
+// DecryptOracleMessage returns the oracle message contained in the BSPShareMsg.
+func (self *BSPShareMsg) DecryptOracleMessage(bspKey []byte) ([]byte, error) {
+	return symmetriccrypto.Decrypt(bspKey, self.OracleMessage, nil)
+}
+
+// Encrypt the BSPShareMsg to the long-term key of node B.
+func (self *BSPShareMsg) Encrypt(longTermOraclePublicKey *[32]byte, memEngine memprotect.Engine) ([]byte, error) {
+	return encryptToLongTermKey(BSPShareEncType, self.Marshal(nil), longTermOraclePublicKey, memEngine)
+}
+
+func (self *BSPShareMsg) decrypt(key *protectedcrypto.Curve25519, memEngine memprotect.Engine, msg []byte) (*BSPShareMsg, error) {
+	decrypted, err := decryptFromLongTermKey(BSPShareEncType, key, memEngine, msg)
+	if err != nil {
+		return nil, err
+	}
+	r, _, err := self.Unmarshal(decrypted)
+	return r, err
+}
+
+// BSPRelayMsg asks node A to forward an encrypted BSPShareMsg to node B.
+type BSPRelayMsg struct {
+	URL          []byte   // URL of node B.
+	SignatureKey [32]byte // Long term signature key of node B.
+	Share        []byte   // BSPShareMsg encrypted to node B.
+}
+
+// Marshal BSPRelayMsg. If out ==nil, a new output slice will be allocated.
+func (self *BSPRelayMsg) Marshal(out []byte) []byte {
+	d, err := binencode.Encode(out, 2, &self.URL, binencode.SlicePointer(self.SignatureKey[:]), &self.Share)
+	if err != nil {
+		panic(err)
+	}
+	binencode.SetType(d, BSPRelayMsgTypeID)
+	return d
+}
+
+// Unmarshal BSPRelayMsg. If receiver is nil, a new receiver is created. Otherwise the receiver is used.
+func (self *BSPRelayMsg) Unmarshal(d []byte) (r *BSPRelayMsg, remainder []byte, err error) {
+	if err := binencode.GetTypeExpect(d, BSPRelayMsgTypeID); err != nil {
+		return nil, nil, err
+	}
+	if self != nil {
+		r = self
+	} else {
+		r = new(BSPRelayMsg)
+	}
+	remainder, err = binencode.Decode(d, 2, &r.URL, binencode.SlicePointer(r.SignatureKey[:]), &r.Share)
+	if err != nil {
+		return nil, remainder, err
+	}
+	return r, remainder, nil
+}
+
+// Encrypt the BSPRelayMsg to the long-term key of node A. The message is padded to BSPRelayPadSize.
+func (self *BSPRelayMsg) Encrypt(longTermOraclePublicKey *[32]byte, memEngine memprotect.Engine) ([]byte, error) {
+	padded, err := symmetriccrypto.AddPadding(self.Marshal(nil), nil, BSPRelayPadSize, nil)
+	if err != nil {
+		return nil, err
+	}
+	return encryptToLongTermKey(BSPRelayEncType, padded, longTermOraclePublicKey, memEngine)
+}
+
+func (self *BSPRelayMsg) decrypt(key *protectedcrypto.Curve25519, memEngine memprotect.Engine, msg []byte) (*BSPRelayMsg, error) {
+	padded, err := decryptFromLongTermKey(BSPRelayEncType, key, memEngine, msg)
+	if err != nil {
+		return nil, err
+	}
+	decrypted, err := symmetriccrypto.RemovePadding(padded)
+	if err != nil {
+		return nil, err
+	}
+	r, _, err := self.Unmarshal(decrypted)
+	return r, err
+}
+
+// SendBSPRelay prepares a relay request from a message encrypted with BSPRelayMsg.Encrypt. The request is sent to
+// node A at url, its answer is checked with OracleFuture.ReceiveAck.
+func SendBSPRelay(url string, longTermOraclePublicKey *[32]byte, encrypted []byte, stkf ShortTermKeyFactory, memEngine memprotect.Engine) (*OracleFuture, error) {
+	ret := &OracleFuture{
+		URL:               []byte(url),
+		OracleLongTermKey: append([]byte{}, longTermOraclePublicKey[:]...),
+		engine:            memEngine,
+	}
+	if err := ret.envelope(BSPRelayEnvelopeType, encrypted, stkf); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// BSPPeer is an oracle that relays are delivered to. Relays to other nodes are refused.
+type BSPPeer struct {
+	URL          string   // URL at which the peer receives BSPShare messages.
+	SignatureKey [32]byte // Long term signature key of the peer.
+	ConfigURL    string   // URL at which the peer publishes its signed config.
+}
+
+// bspPeer is a configured BSPPeer and the result of the last verification of its config.
+type bspPeer struct {
+	signatureKey [32]byte
+	configURL    string
+	verified     bool
+}
+
+// SetBSPPeers sets the peers the oracle relays BSP shares to. Their configs are verified by RunRelayService.
+func (self *Oracle) SetBSPPeers(peers ...BSPPeer) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.bspPeers = make(map[string]*bspPeer, len(peers))
+	for _, peer := range peers {
+		self.bspPeers[peer.URL] = &bspPeer{signatureKey: peer.SignatureKey, configURL: peer.ConfigURL}
+	}
+}
+
+// verifyBSPPeer fetches the config of the peer at url and verifies it against the signature key of the peer.
+// The result is recorded for bspRelayHandler.
+func (self *Oracle) verifyBSPPeer(fetchConfig ConfigFunc, url string) error {
+	self.mutex.Lock()
+	peer, ok := self.bspPeers[url]
+	self.mutex.Unlock()
+	if !ok {
+		return ErrBSPPeer
+	}
+	d, err := fetchConfig(peer.configURL)
+	if err == nil {
+		_, err = VerifyOracleConfig(d, &peer.signatureKey)
+	}
+	self.mutex.Lock()
+	peer.verified = err == nil
+	self.mutex.Unlock()
+	return err
+}
+
+// verifyBSPPeers verifies the configs of all peers. Failures are logged.
+func (self *Oracle) verifyBSPPeers(fetchConfig ConfigFunc) {
+	self.mutex.Lock()
+	urls := make([]string, 0, len(self.bspPeers))
+	for url := range self.bspPeers {
+		urls = append(urls, url)
+	}
+	self.mutex.Unlock()
+	for _, url := range urls {
+		if err := self.verifyBSPPeer(fetchConfig, url); err != nil {
+			self.logf("oracle: Config of BSP peer %s not verified: %s", url, err)
+		}
+	}
+}
+
+// relayQueueSize is the number of relays an oracle queues for RunRelayService.
+const relayQueueSize = 64
+
+// bspRelay is a relay queued for RunRelayService.
+type bspRelay struct {
+	url          string
+	signatureKey [32]byte
+	message      []byte
+}
+
+// bspRelayHandler queues the BSPShareMsg of a relay request for RunRelayService. The payload is empty on success.
+// Relays are refused unless RunRelayService is running, and unless node B is a BSP peer with a verified config.
+func (self *Oracle) bspRelayHandler(d []byte) *OracleResponseMsg {
+	if !self.relaying {
+		return newOracleResponse(nil, ErrNoRelay)
+	}
+	var msg *BSPRelayMsg
+	msg, err := msg.decrypt(self.longTermKey, self.exportEngine, d)
+	if err != nil {
+		return newOracleResponse(nil, ErrDecrypt)
+	}
+	if len(msg.URL) == 0 || len(msg.Share) == 0 || msg.SignatureKey == zero32bytes {
+		return newOracleResponse(nil, ErrBSPRelay)
+	}
+	peer, ok := self.bspPeers[string(msg.URL)]
+	if !ok || peer.signatureKey != msg.SignatureKey {
+		return newOracleResponse(nil, ErrBSPPeer)
+	}
+	if !peer.verified {
+		return newOracleResponse(nil, ErrPeerConfig)
+	}
+	select {
+	case self.relays <- bspRelay{url: string(msg.URL), signatureKey: msg.SignatureKey, message: msg.Share}:
+		return newOracleResponse(nil, nil)
+	default:
+		return newOracleResponse(nil, ErrRelayQueue)
+	}
+}
+
+// ReceiveBSPShare decrypts a BSPShareMsg relayed to the oracle. It verifies that the oracle is a node of the round
+// and that the share matches its image. The share is recorded in the signal store, encrypted as received, and can be
+// retrieved with BSPShare.
+func (self *Oracle) ReceiveBSPShare(d []byte) (*BSPShareMsg, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	var msg *BSPShareMsg
+	msg, err := msg.decrypt(self.longTermKey, self.exportEngine, d)
+	if err != nil {
+		return nil, err
+	}
+	signatureKey, err := self.signatureKey.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+	var key [32]byte
+	copy(key[:], signatureKey)
+	if err := msg.verify(&key); err != nil {
+		return nil, err
+	}
+	if err := self.signals.SetShare(msg.RoundRoot, d); err == signalstore.ErrShareRecorded {
+		// Accept the same share encrypted again.
+		recorded, rerr := self.bspShare(msg.RoundRoot)
+		if rerr != nil || !bytes.Equal(recorded.Marshal(nil), msg.Marshal(nil)) {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// BSPShare returns the share received for the BSP round with root. It returns signalstore.ErrNoShare if none was received.
+func (self *Oracle) BSPShare(root []byte) (*BSPShareMsg, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.bspShare(root)
+}
+
+func (self *Oracle) bspShare(root []byte) (*BSPShareMsg, error) {
+	d, err := self.signals.Share(root)
+	if err != nil {
+		return nil, err
+	}
+	var msg *BSPShareMsg
+	return msg.decrypt(self.longTermKey, self.exportEngine, d)
+}
@@ -0,0 +1,256 @@
+package messages
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"assuredrelease.com/cypherlock-pe/memprotect"
+	"assuredrelease.com/cypherlock-pe/signalstore"
+)
+
+func TestOracleBSPRelay(t *testing.T) {
+	engine := new(memprotect.Unprotected)
+	engine.Init(new(memprotect.Unprotected).Cell(32))
+	newOracle := func() *Oracle {
+		oracle := NewOracle(signalstore.NewMemory(), engine)
+		if err := oracle.Generate(time.Now().Unix(), 1000000, 100000); err != nil {
+			t.Fatalf("Oracle.Generate: %s", err)
+		}
+		return oracle
+	}
+	nodeA, nodeB := newOracle(), newOracle()
+	longTermKeyA, shortTermKeyA := nodeA.PublicKeys()
+	longTermKeyB, _ := nodeB.PublicKeys()
+	signatureKeyA, _ := nodeA.SignaturePublicKey()
+	signatureKeyB, _ := nodeB.SignaturePublicKey()
+	stkf := func(url string, longTermKey *[32]byte) (*[32]byte, error) { return shortTermKeyA, nil }
+	nodes := []BSPNode{
+		{SignatureKey: *signatureKeyA, URL: []byte("http://nodea.com")},
+		{SignatureKey: *signatureKeyB, URL: []byte("http://nodeb.com")},
+	}
+	bspKey := bytes.Repeat([]byte{0x07}, 32)
+	share := []byte("Share of node B")
+	round, err := NewBSPRound([][]byte{[]byte("Share of node A"), share})
+	if err != nil {
+		t.Fatalf("NewBSPRound: %s", err)
+	}
+	oracleMessage := []byte("Oracle message for node B")
+
+	relay := func(msg *BSPRelayMsg) error {
+		encrypted, err := msg.Encrypt(longTermKeyA, engine)
+		if err != nil {
+			t.Fatalf("BSPRelayMsg.Encrypt: %s", err)
+		}
+		future, err := SendBSPRelay("http://nodea.com", longTermKeyA, encrypted, stkf, engine)
+		if err != nil {
+			t.Fatalf("SendBSPRelay: %s", err)
+		}
+		response, err := nodeA.ReceiveMsg(future.Message)
+		if err != nil {
+			t.Fatalf("ReceiveMsg: %s", err)
+		}
+		return future.ReceiveAck(response)
+	}
+
+	if _, err := NewBSPShare(nodes, round, 0, share, oracleMessage, bspKey); err != ErrBSPRound {
+		t.Errorf("Share with wrong index: %v", err)
+	}
+	bspShare, err := NewBSPShare(nodes, round, 1, share, oracleMessage, bspKey)
+	if err != nil {
+		t.Fatalf("NewBSPShare: %s", err)
+	}
+	encryptedShare, err := bspShare.Encrypt(longTermKeyB, engine)
+	if err != nil {
+		t.Fatalf("BSPShareMsg.Encrypt: %s", err)
+	}
+	if err := relay(&BSPRelayMsg{URL: nodes[1].URL, SignatureKey: *signatureKeyB, Share: encryptedShare}); err != ErrNoRelay {
+		t.Fatalf("Relay without relay service: %v", err)
+	}
+
+	nodeA.SetBSPPeers(BSPPeer{URL: "http://nodeb.com", SignatureKey: *signatureKeyB, ConfigURL: "http://nodeb.com/config"})
+	configMutex := new(sync.Mutex)
+	configNode := nodeB
+	fetchConfig := func(url string) ([]byte, error) {
+		if url != "http://nodeb.com/config" {
+			t.Errorf("Config fetched from wrong node: %s", url)
+		}
+		configMutex.Lock()
+		defer configMutex.Unlock()
+		return configNode.GetConfig()
+	}
+	relayed := make(chan []byte, 4)
+	nodeA.RunRelayService(func(url string, signatureKey *[32]byte, message []byte) error {
+		if url != "http://nodeb.com" || *signatureKey != *signatureKeyB {
+			t.Errorf("Relayed to wrong node: %s", url)
+		}
+		relayed <- message
+		return nil
+	}, fetchConfig)
+	defer nodeA.StopServices()
+	if err := relay(&BSPRelayMsg{URL: []byte("http://internal.example"), SignatureKey: *signatureKeyB, Share: encryptedShare}); err != ErrBSPPeer {
+		t.Errorf("Relay to other URL: %v", err)
+	}
+	if err := relay(&BSPRelayMsg{URL: nodes[1].URL, SignatureKey: *signatureKeyA, Share: encryptedShare}); err != ErrBSPPeer {
+		t.Errorf("Relay with wrong signature key: %v", err)
+	}
+	if err := relay(&BSPRelayMsg{URL: nodes[1].URL, SignatureKey: *signatureKeyB, Share: encryptedShare}); err != nil {
+		t.Fatalf("Relay: %s", err)
+	}
+	var message []byte
+	select {
+	case message = <-relayed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Relay not delivered")
+	}
+	received, err := nodeB.ReceiveBSPShare(message)
+	if err != nil {
+		t.Fatalf("ReceiveBSPShare: %s", err)
+	}
+	if !bytes.Equal(received.Share, share) || len(received.Nodes) != 2 || !bytes.Equal(received.Nodes[1].URL, nodes[1].URL) {
+		t.Error("Share not received")
+	}
+	if err := received.VerifyRound(round.Root); err != nil {
+		t.Errorf("VerifyRound: %s", err)
+	}
+	if err := received.VerifyRound(round.Proofs[0]); err != ErrBSPRound {
+		t.Errorf("VerifyRound with wrong root: %v", err)
+	}
+	if d, err := received.DecryptOracleMessage(bspKey); err != nil || !bytes.Equal(d, oracleMessage) {
+		t.Errorf("DecryptOracleMessage: %v", err)
+	}
+	if _, err := nodeA.ReceiveBSPShare(message); err == nil {
+		t.Error("Share decrypted by relaying node")
+	}
+	stored, err := nodeB.BSPShare(round.Root)
+	if err != nil || !bytes.Equal(stored.Marshal(nil), received.Marshal(nil)) {
+		t.Errorf("Received share not stored: %v", err)
+	}
+	if _, err := nodeB.BSPShare(round.Proofs[0]); err != signalstore.ErrNoShare {
+		t.Errorf("Share of unknown round: %v", err)
+	}
+	// The same share encrypted again is accepted, another share of the round is not.
+	encryptedShare, _ = bspShare.Encrypt(longTermKeyB, engine)
+	if _, err := nodeB.ReceiveBSPShare(encryptedShare); err != nil {
+		t.Errorf("Share received again: %s", err)
+	}
+	otherShare, _ := NewBSPShare(nodes, round, 1, share, []byte("Other oracle message"), bspKey)
+	encryptedOther, _ := otherShare.Encrypt(longTermKeyB, engine)
+	if _, err := nodeB.ReceiveBSPShare(encryptedOther); err != signalstore.ErrShareRecorded {
+		t.Errorf("Other share of round accepted: %v", err)
+	}
+
+	if err := relay(&BSPRelayMsg{SignatureKey: *signatureKeyB, Share: encryptedShare}); err != ErrBSPRelay {
+		t.Errorf("Relay without URL: %v", err)
+	}
+
+	// The peer publishes a config signed by another key: Relays are dropped and then refused.
+	configMutex.Lock()
+	configNode = nodeA
+	configMutex.Unlock()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		err := relay(&BSPRelayMsg{URL: nodes[1].URL, SignatureKey: *signatureKeyB, Share: encryptedShare})
+		if err == ErrPeerConfig {
+			break
+		}
+		if err != nil || time.Now().After(deadline) {
+			t.Fatalf("Relay to peer with wrong config: %v", err)
+		}
+	}
+	select {
+	case <-relayed:
+		t.Error("Relay delivered to peer with wrong config")
+	default:
+	}
+
+	// Node B is not part of the round.
+	if _, err := NewBSPShare(nodes[:1], round, 1, share, oracleMessage, bspKey); err != ErrBSPNodes {
+		t.Errorf("Nodes not matching round: %v", err)
+	}
+	bspShare, _ = NewBSPShare(nodes, round, 1, share, oracleMessage, bspKey)
+	bspShare.Nodes = nodes[:1]
+	encryptedShare, _ = bspShare.Encrypt(longTermKeyB, engine)
+	if _, err := nodeB.ReceiveBSPShare(encryptedShare); err != ErrBSPNode {
+		t.Errorf("Share for other round: %v", err)
+	}
+	// The share does not match its image.
+	for _, proof := range [][]byte{round.Proofs[0], round.Proofs[1][:40], bytes.Repeat([]byte{0x01}, 3*39)} {
+		bspShare, _ = NewBSPShare(nodes, round, 1, share, oracleMessage, bspKey)
+		bspShare.ShareProof = proof
+		encryptedShare, _ = bspShare.Encrypt(longTermKeyB, engine)
+		if _, err := nodeB.ReceiveBSPShare(encryptedShare); err != ErrShareImage {
+			t.Errorf("Wrong proof accepted: %v", err)
+		}
+	}
+	bspShare, _ = NewBSPShare(nodes, round, 1, share, oracleMessage, bspKey)
+	bspShare.Share = []byte("Other share")
+	encryptedShare, _ = bspShare.Encrypt(longTermKeyB, engine)
+	if _, err := nodeB.ReceiveBSPShare(encryptedShare); err != ErrShareImage {
+		t.Errorf("Share not matching image: %v", err)
+	}
+}
+
+func TestBSPRound(t *testing.T) {
+	shares := make([][]byte, 5)
+	for i := range shares {
+		shares[i] = []byte{byte(i), 0x01, 0x02}
+	}
+	round, err := NewBSPRound(shares)
+	if err != nil {
+		t.Fatalf("NewBSPRound: %s", err)
+	}
+	for i, share := range shares {
+		if !verifyShareProof(round.Root, round.Proofs[i], share, len(shares)) {
+			t.Errorf("Proof %d not verified", i)
+		}
+		if verifyShareProof(round.Root, round.Proofs[(i+1)%len(shares)], share, len(shares)) {
+			t.Errorf("Proof %d verified for other share", i)
+		}
+		if verifyShareProof(round.Root, round.Proofs[i], share, 2) {
+			t.Errorf("Proof %d verified for round of two shares", i)
+		}
+		// Malformed proofs are refused without reaching merkletree.
+		for j := range round.Proofs[i] {
+			proof := append([]byte{}, round.Proofs[i]...)
+			proof[j] ^= 0x01
+			if verifyShareProof(round.Root, proof, share, len(shares)) {
+				t.Errorf("Modified proof %d accepted at %d", i, j)
+			}
+		}
+		for j := 0; j < len(round.Proofs[i]); j += bspProofElementSize / 2 {
+			if verifyShareProof(round.Root, round.Proofs[i][:j], share, len(shares)) {
+				t.Errorf("Truncated proof %d accepted at %d", i, j)
+			}
+		}
+	}
+	for n := 1; n <= MaxBSPNodes; n++ {
+		for _, size := range []int{1, 2, 3, 8} {
+			if verifyShareProof(round.Root, bytes.Repeat([]byte{0x01}, size*bspProofElementSize), shares[0], n) {
+				t.Errorf("Garbage proof of %d elements accepted for %d shares", size, n)
+			}
+		}
+	}
+	if _, err := NewBSPRound(nil); err != ErrBSPNodes {
+		t.Errorf("Empty round: %v", err)
+	}
+
+	// A round with a single share.
+	round, err = NewBSPRound(shares[:1])
+	if err != nil {
+		t.Fatalf("NewBSPRound single: %s", err)
+	}
+	if !verifyShareProof(round.Root, round.Proofs[0], shares[0], 1) {
+		t.Error("Single share proof not verified")
+	}
+	leaf := round.Proofs[0][:bspProofElementSize]
+	if !verifyShareProof(round.Root, leaf, shares[0], 1) {
+		t.Error("Single share leaf proof not verified")
+	}
+	if verifyShareProof(round.Root, leaf, shares[1], 1) {
+		t.Error("Single share leaf proof verified for other share")
+	}
+	if verifyShareProof(round.Root, leaf, shares[0], 2) {
+		t.Error("Leaf proof verified for round of two shares")
+	}
+}
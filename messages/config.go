@@ -0,0 +1,174 @@
+package messages
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/ed25519"
+
+	"assuredrelease.com/cypherlock-pe/binencode"
+	"assuredrelease.com/cypherlock-pe/protectedcrypto"
+)
+
+/*
+GetConfig
+- Return the node's configuration:
+    - URLs of the node.
+    - Node's long term signature key.
+    - Node's short term signature key.
+    - Node's long term encryption key.
+    - Node's short term encryption key.
+    - Node's timelock list location and range configuration.
+    - Key validity time range.
+- Response is additionally signed by the node's long term signature key.
+*/
+
+var (
+	ErrSignature    = errors.New("messages: Signature invalid")
+	ErrSignatureKey = errors.New("messages: Signed by unexpected key")
+)
+
+const OracleConfigTypeID = 1003
+const SignedOracleConfigTypeID = 1004
+
+// urlSeparator separates the URLs in the encoded config. URLs cannot contain it.
+const urlSeparator = "\n"
+
+// OracleConfig is the configuration an oracle publishes.
+type OracleConfig struct {
+	URLs                   []string // URLs at which the oracle listens.
+	LongTermSignatureKey   [32]byte // ED25519 key that signs the config.
+	ShortTermSignatureKey  [32]byte // ED25519 key that signs responses.
+	LongTermEncryptionKey  [32]byte // Curve25519 key to which oracle messages are encrypted.
+	ShortTermEncryptionKey [32]byte // Curve25519 key to which oracle message envelopes are encrypted.
+	TimeLockURL            []byte   // Location of the timelock list.
+	TimeLockStartTime      int64    // Start of the timelock ratchet.
+	TimeLockRatchetTime    int64    // Seconds between timelock ratchet advances.
+	ValidFrom              int64    // The short term keys are valid from.
+	ValidTo                int64    // The short term keys are valid until. Fetch a new config afterwards.
+}
+
+// Marshal OracleConfig. If out ==nil, a new output slice will be allocated.
+func (self *OracleConfig) Marshal(out []byte) []byte {
+	urls := []byte(strings.Join(self.URLs, urlSeparator))
+	d, err := binencode.Encode(out, 2,
+		&urls,
+		binencode.SlicePointer(self.LongTermSignatureKey[:]),
+		binencode.SlicePointer(self.ShortTermSignatureKey[:]),
+		binencode.SlicePointer(self.LongTermEncryptionKey[:]),
+		binencode.SlicePointer(self.ShortTermEncryptionKey[:]),
+		&self.TimeLockURL,
+		self.TimeLockStartTime,
+		self.TimeLockRatchetTime,
+		self.ValidFrom,
+		self.ValidTo,
+	)
+	if err != nil {
+		panic(err)
+	}
+	binencode.SetType(d, OracleConfigTypeID)
+	return d
+}
+
+// Unmarshal OracleConfig. If receiver is nil, a new receiver is created. Otherwise the receiver is used.
+func (self *OracleConfig) Unmarshal(d []byte) (r *OracleConfig, remainder []byte, err error) {
+	var urls []byte
+	if err := binencode.GetTypeExpect(d, OracleConfigTypeID); err != nil {
+		return nil, nil, err
+	}
+	if self != nil {
+		r = self
+	} else {
+		r = new(OracleConfig)
+	}
+	remainder, err = binencode.Decode(d, 2,
+		&urls,
+		binencode.SlicePointer(r.LongTermSignatureKey[:]),
+		binencode.SlicePointer(r.ShortTermSignatureKey[:]),
+		binencode.SlicePointer(r.LongTermEncryptionKey[:]),
+		binencode.SlicePointer(r.ShortTermEncryptionKey[:]),
+		&r.TimeLockURL,
+		&r.TimeLockStartTime,
+		&r.TimeLockRatchetTime,
+		&r.ValidFrom,
+		&r.ValidTo,
+	)
+	if err != nil {
+		return nil, remainder, err
+	}
+	r.URLs = nil
+	if len(urls) > 0 {
+		r.URLs = strings.Split(string(urls), urlSeparator)
+	}
+	return r, remainder, nil
+}
+
+// SignedOracleConfig is an encoded OracleConfig with the signature of its long term signature key.
+type SignedOracleConfig struct {
+	Config    []byte // Marshalled OracleConfig.
+	Signature []byte // ED25519 signature over Config.
+}
+
+// Marshal SignedOracleConfig. If out ==nil, a new output slice will be allocated.
+func (self *SignedOracleConfig) Marshal(out []byte) []byte {
+	d, err := binencode.Encode(out, 2, &self.Config, &self.Signature)
+	if err != nil {
+		panic(err)
+	}
+	binencode.SetType(d, SignedOracleConfigTypeID)
+	return d
+}
+
+// Unmarshal SignedOracleConfig. If receiver is nil, a new receiver is created. Otherwise the receiver is used.
+func (self *SignedOracleConfig) Unmarshal(d []byte) (r *SignedOracleConfig, remainder []byte, err error) {
+	if err := binencode.GetTypeExpect(d, SignedOracleConfigTypeID); err != nil {
+		return nil, nil, err
+	}
+	if self != nil {
+		r = self
+	} else {
+		r = new(SignedOracleConfig)
+	}
+	remainder, err = binencode.Decode(d, 2, &r.Config, &r.Signature)
+	if err != nil {
+		return nil, remainder, err
+	}
+	return r, remainder, nil
+}
+
+// Sign config with the long term signature key.
+func (self *OracleConfig) Sign(key *protectedcrypto.ED25519) (*SignedOracleConfig, error) {
+	config := self.Marshal(nil)
+	sig, err := key.Sign(config)
+	if err != nil {
+		return nil, err
+	}
+	return &SignedOracleConfig{Config: config, Signature: sig}, nil
+}
+
+// Verify the signature and return the contained config. If signatureKey is not nil, the config must be signed by it.
+// Otherwise the long term signature key contained in the config is trusted and callers must verify the other keys
+// of the config themselves, ie. by comparing LongTermEncryptionKey to a known key.
+func (self *SignedOracleConfig) Verify(signatureKey *[32]byte) (*OracleConfig, error) {
+	config, _, err := new(OracleConfig).Unmarshal(self.Config)
+	if err != nil {
+		return nil, err
+	}
+	if signatureKey != nil && !bytes.Equal(signatureKey[:], config.LongTermSignatureKey[:]) {
+		return nil, ErrSignatureKey
+	}
+	if !protectedcrypto.ED25519Verify(ed25519.PublicKey(config.LongTermSignatureKey[:]), self.Config, self.Signature) {
+		return nil, ErrSignature
+	}
+	return config, nil
+}
+
+// VerifyOracleConfig parses a GetConfig response and verifies it. See SignedOracleConfig.Verify.
+func VerifyOracleConfig(d []byte, signatureKey *[32]byte) (*OracleConfig, error) {
+	signed, _, err := new(SignedOracleConfig).Unmarshal(d)
+	if err != nil {
+		return nil, err
+	}
+	return signed.Verify(signatureKey)
+}
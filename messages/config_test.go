@@ -0,0 +1,49 @@
+package messages
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestOracleConfig(t *testing.T) {
+	oracle, _, _, cleanup := newTestOracle(t)
+	defer cleanup()
+	oracle.SetURLs("http://testoracle.com/timelocks", "http://testoracle.com/oracle", "http://backup.testoracle.com/oracle")
+	d, err := oracle.GetConfig()
+	if err != nil {
+		t.Fatalf("GetConfig: %s", err)
+	}
+	signatureKey, err := oracle.SignaturePublicKey()
+	if err != nil {
+		t.Fatalf("SignaturePublicKey: %s", err)
+	}
+	config, err := VerifyOracleConfig(d, signatureKey)
+	if err != nil {
+		t.Fatalf("VerifyOracleConfig: %s", err)
+	}
+	expected, err := oracle.Config()
+	if err != nil {
+		t.Fatalf("Config: %s", err)
+	}
+	if !reflect.DeepEqual(config, expected) {
+		t.Errorf("Config not decoded: %+v != %+v", config, expected)
+	}
+	longTermKey, shortTermKey := oracle.PublicKeys()
+	if config.LongTermEncryptionKey != *longTermKey || config.ShortTermEncryptionKey != *shortTermKey {
+		t.Error("Wrong encryption keys")
+	}
+	if config.ValidTo <= config.ValidFrom || config.TimeLockRatchetTime != 1000000 {
+		t.Errorf("Wrong ranges: %+v", config)
+	}
+	if _, err := VerifyOracleConfig(d, &[32]byte{0x01}); err != ErrSignatureKey {
+		t.Errorf("Config accepted for wrong key: %v", err)
+	}
+	signed, _, err := new(SignedOracleConfig).Unmarshal(d)
+	if err != nil {
+		t.Fatalf("Unmarshal: %s", err)
+	}
+	signed.Config[len(signed.Config)-1] ^= 0x01
+	if _, err := signed.Verify(nil); err != ErrSignature {
+		t.Errorf("Modified config accepted: %v", err)
+	}
+}
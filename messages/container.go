@@ -1,6 +1,9 @@
 package messages
 
 import (
+	"bytes"
+	"errors"
+
 	"assuredrelease.com/cypherlock-pe/binencode"
 	"assuredrelease.com/cypherlock-pe/hybridcrypto"
 	"assuredrelease.com/cypherlock-pe/memprotect"
@@ -82,54 +85,161 @@ func (self *OracleMessageContainer) Decrypt(key, d []byte) (*OracleMessageContai
 	return r, err
 }
 
-// ShortTermKeyFactory returns the short term key for an oracle url.
-type ShortTermKeyFactory func(url string) (*[32]byte, error)
+var (
+	ErrOracleResponse = errors.New("oracle: Unknown error response")
+	ErrWrongOracle    = errors.New("oracle: Share from wrong oracle")
+	ErrNoRenew        = errors.New("oracle: Request cannot be renewed")
+)
+
+// ShortTermKeyFactory returns the short term key for the oracle at url with the long term key longTermKey.
+type ShortTermKeyFactory func(url string, longTermKey *[32]byte) (*[32]byte, error)
 
 // OracleFuture contains the information required to send and receive an oraclemessage exchange.
 type OracleFuture struct {
-	Message                 []byte // The encrypted oracle message
-	URL                     []byte // The URL to which the message is sent
-	ShareThreshold          int32  // Reconstruction threshold
-	ResponsePrivateKey      []byte // The private key required to decrypt the response
-	ShareMsgKey             []byte // The symmetric key to decrypt the share message
-	SingleResponsePrivatKey []byte // Single-use response decryption key.
+	Message                 []byte             // The encrypted oracle message
+	URL                     []byte             // The URL to which the message is sent
+	ShareThreshold          int32              // Reconstruction threshold
+	ResponsePrivateKey      []byte             // The private key required to decrypt the response
+	ShareMsgKey             []byte             // The symmetric key to decrypt the share message
+	SingleResponsePrivatKey []byte             // Single-use response decryption key.
+	OracleLongTermKey       []byte             // Long Term public key of oracle
+	Signed                  bool               // The response is signed by the oracle.
+	OracleSignatureKey      *[32]byte          // Long term signature key of the oracle. If set, receipts must be signed under it.
+	Receipt                 *SignedResponse    // Verified signed response, set by Receive if Signed.
+	Response                *OracleResponseMsg // Decoded response, set by Receive.
 	engine                  memprotect.Engine
+	messageType             uint16              // Envelope type, for Renew.
+	payload                 []byte              // Enveloped request, for Renew.
+	stkf                    ShortTermKeyFactory // For Renew.
 }
 
 const OracleMessageEnvelopeType = 1020
 const OracleResponseMessageType = 1021
 
-func (self *OracleFuture) Receive() ([]byte, error) {
-	// tsc2 := &hybridcrypto.SecretCalculator{
-	// 	Combiner:           protectedcrypto.NewSecretCombiner(self.exportEngine),
-	// 	MessageType:        OracleResponseMessageType,
-	// 	Nonce:              nil,
-	// 	DeterministicNonce: nil,
-	// 	Keys: []hybridcrypto.KeyContainer{
-	// 		hybridcrypto.KeyContainer{
-	// 			SecretGenerator: self.shortTermKey,
-	// 			MyPublicKey:     self.shortTermKey.PublicKey(),
-	// 			PeerPublicKey:   nil,
-	// 		},
-	// 		hybridcrypto.KeyContainer{
-	// 			SecretGenerator: self.longTermKey,
-	// 			MyPublicKey:     self.longTermKey.PublicKey(),
-	// 			PeerPublicKey:   nil,
-	// 		},
-	// 		hybridcrypto.KeyContainer{
-	// 			SecretGenerator: self.shortTermKey,
-	// 			MyPublicKey:     self.shortTermKey.PublicKey(),
-	// 			PeerPublicKey:   nil,
-	// 		},
-	// 	},
-	// }
-	// ToDo
-	panic("Not implemented: self *OracleFuture) Receive()")
-	return nil, nil
+// curve25519FromBytes creates a Curve25519 key from a private key.
+func curve25519FromBytes(privateKey []byte, memEngine memprotect.Engine) (*protectedcrypto.Curve25519, error) {
+	if len(privateKey) != 32 {
+		return nil, memprotect.ErrSize
+	}
+	element := memEngine.Element(32)
+	element.Melt()
+	b, err := element.Bytes()
+	if err != nil {
+		element.Destroy()
+		return nil, err
+	}
+	copy(b, privateKey)
+	element.Seal()
+	key := protectedcrypto.NewCurve25519(memEngine)
+	if err := key.SetSecure(element); err != nil {
+		element.Destroy()
+		return nil, err
+	}
+	return key, nil
+}
+
+func (self *OracleFuture) decryptResponse(response []byte, singleResponseKey, responseKey *protectedcrypto.Curve25519) ([]byte, error) {
+	tsc := &hybridcrypto.SecretCalculator{
+		Combiner:           protectedcrypto.NewSecretCombiner(self.engine),
+		MessageType:        OracleResponseMessageType,
+		Nonce:              nil,
+		DeterministicNonce: nil,
+		Keys: []hybridcrypto.KeyContainer{
+			hybridcrypto.KeyContainer{
+				SecretGenerator: singleResponseKey,
+				MyPublicKey:     nil,
+				PeerPublicKey:   nil,
+			},
+			hybridcrypto.KeyContainer{
+				SecretGenerator: singleResponseKey,
+				MyPublicKey:     nil,
+				PeerPublicKey:   nil,
+			},
+			hybridcrypto.KeyContainer{
+				SecretGenerator: responseKey,
+				MyPublicKey:     nil,
+				PeerPublicKey:   nil,
+			},
+		},
+	}
+	return tsc.Decrypt(response, nil)
+}
+
+// Receive decrypts the response of an oracle and returns the share contained in it. If the oracle
+// refused the request, the error it returned is given instead (ErrTimePolicy, ErrSignalSet, ...). The decoded
+// response is recorded in self.Response, ie. for its RetryAfter.
+func (self *OracleFuture) Receive(response []byte) ([]byte, error) {
+	singleResponseKey, err := curve25519FromBytes(self.SingleResponsePrivatKey, self.engine)
+	if err != nil {
+		return nil, err
+	}
+	defer singleResponseKey.PrivateKey().Destroy()
+	responseKey, err := curve25519FromBytes(self.ResponsePrivateKey, self.engine)
+	if err != nil {
+		return nil, err
+	}
+	defer responseKey.PrivateKey().Destroy()
+	payload, err := self.decryptResponse(response, singleResponseKey, responseKey)
+	if err == memprotect.ErrKeyNotFound {
+		// The oracle could not decrypt the inner message and thus did not learn the response key.
+		payload, err = self.decryptResponse(response, singleResponseKey, singleResponseKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if payload, err = self.unwrapSigned(payload); err != nil {
+		return nil, err
+	}
+	if payload, err = self.parseResponse(payload); err != nil {
+		return nil, err
+	}
+	shm, err := new(ShareMsg).Decrypt(payload, self.ShareMsgKey, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(self.OracleLongTermKey) > 0 && !bytes.Equal(shm.OracleKey[:], self.OracleLongTermKey) {
+		return nil, ErrWrongOracle
+	}
+	return shm.Share, nil
+}
+
+// receiveSingle decrypts the response to a request that is only encrypted to the single response key.
+func (self *OracleFuture) receiveSingle(response []byte) ([]byte, error) {
+	singleResponseKey, err := curve25519FromBytes(self.SingleResponsePrivatKey, self.engine)
+	if err != nil {
+		return nil, err
+	}
+	defer singleResponseKey.PrivateKey().Destroy()
+	payload, err := self.decryptResponse(response, singleResponseKey, singleResponseKey)
+	if err != nil {
+		return nil, err
+	}
+	return self.unwrapSigned(payload)
+}
+
+// ReceiveAck decrypts the response of an oracle to a request that carries no share, like SetSemaphore.
+// It returns nil if the oracle accepted the request, or the error it returned.
+func (self *OracleFuture) ReceiveAck(response []byte) error {
+	payload, err := self.receiveSingle(response)
+	if err != nil {
+		return err
+	}
+	_, err = self.parseResponse(payload)
+	return err
 }
 
 // Send an oracle message from a container.
 func (self *OracleMessageContainer) Send(key, d []byte, stkf ShortTermKeyFactory, memEngine memprotect.Engine) (*OracleFuture, error) {
+	return self.send(key, d, stkf, memEngine, false)
+}
+
+// SendSigned sends an oracle message like Send, but requests a signed response. Receive records it in
+// OracleFuture.Receipt, also if the oracle refused the request.
+func (self *OracleMessageContainer) SendSigned(key, d []byte, stkf ShortTermKeyFactory, memEngine memprotect.Engine) (*OracleFuture, error) {
+	return self.send(key, d, stkf, memEngine, true)
+}
+
+func (self *OracleMessageContainer) send(key, d []byte, stkf ShortTermKeyFactory, memEngine memprotect.Engine, signed bool) (*OracleFuture, error) {
 	container, err := self.Decrypt(key, d)
 	if err != nil {
 		return nil, err
@@ -145,27 +255,52 @@ func (self *OracleMessageContainer) Send(key, d []byte, stkf ShortTermKeyFactory
 		ShareThreshold:     container.ShareThreshold,
 		ResponsePrivateKey: container.ResponsePrivateKey,
 		ShareMsgKey:        container.ShareMsgKey,
+		OracleLongTermKey:  container.OracleLongTermKey,
+		Signed:             signed,
 		engine:             memEngine,
 	}
-	singleResponseKey := protectedcrypto.NewCurve25519(memEngine)
-	if err = singleResponseKey.Generate(); err != nil {
+	if err := ret.envelope(OracleMessageEnvelopeType, container.OracleMessage, stkf); err != nil {
 		return nil, err
 	}
+	return ret, nil
+}
+
+// Renew encrypts the request again, to the short term key the ShortTermKeyFactory returns now. It replaces
+// self.Message and the single response key. Use it when the oracle rejected the envelope, ie. because it was
+// restarted with a new short term key before the old one expired.
+func (self *OracleFuture) Renew() error {
+	if self.stkf == nil {
+		return ErrNoRenew
+	}
+	return self.envelope(self.messageType, self.payload, self.stkf)
+}
+
+// envelope encrypts payload of messageType to the short and long term keys of the oracle at self.URL and sets
+// self.Message and self.SingleResponsePrivatKey. If self.Signed, a signed response is requested.
+func (self *OracleFuture) envelope(messageType uint16, payload []byte, stkf ShortTermKeyFactory) error {
+	self.messageType, self.payload, self.stkf = messageType, payload, stkf
+	if self.Signed {
+		messageType |= SignedEnvelopeFlag
+	}
+	singleResponseKey := protectedcrypto.NewCurve25519(self.engine)
+	if err := singleResponseKey.Generate(); err != nil {
+		return err
+	}
 	defer singleResponseKey.PrivateKey().Seal()
 	pkt, err := singleResponseKey.PrivateKey().Bytes()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	ret.SingleResponsePrivatKey = make([]byte, len(pkt))
-	copy(ret.SingleResponsePrivatKey, pkt)
-	shortTermKey, err := stkf(string(ret.URL))
+	self.SingleResponsePrivatKey = make([]byte, len(pkt))
+	copy(self.SingleResponsePrivatKey, pkt)
+	shortTermKey, err := stkf(string(self.URL), unsafeconvert.To32(self.OracleLongTermKey))
 	if err != nil {
-		return nil, err
+		return err
 	}
 	// Encrypt with the collected keys
 	tsc := &hybridcrypto.SecretCalculator{
-		Combiner:           protectedcrypto.NewSecretCombiner(memEngine),
-		MessageType:        OracleMessageEnvelopeType,
+		Combiner:           protectedcrypto.NewSecretCombiner(self.engine),
+		MessageType:        messageType,
 		Nonce:              nil,
 		DeterministicNonce: nil,
 		Keys: []hybridcrypto.KeyContainer{
@@ -181,10 +316,64 @@ func (self *OracleMessageContainer) Send(key, d []byte, stkf ShortTermKeyFactory
 			},
 		},
 	}
-	enc, err := tsc.Encrypt(self.OracleMessage, nil)
+	enc, err := tsc.Encrypt(payload, nil)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	ret.Message = enc
-	return ret, nil
+	self.Message = enc
+	return nil
+}
+
+// encryptToLongTermKey encrypts d of encType from an ephemeral key to a static key, usually the long-term key of
+// an oracle.
+func encryptToLongTermKey(encType uint16, d []byte, longTermOraclePublicKey *[32]byte, memEngine memprotect.Engine) ([]byte, error) {
+	ephemeralGenerator := protectedcrypto.NewCurve25519Ephemeral(memEngine)
+	tsc := &hybridcrypto.SecretCalculator{
+		Combiner:           protectedcrypto.NewSecretCombiner(memEngine),
+		MessageType:        encType,
+		Nonce:              nil,
+		DeterministicNonce: nil,
+		Keys: []hybridcrypto.KeyContainer{
+			hybridcrypto.KeyContainer{
+				SecretGenerator: ephemeralGenerator,
+				MyPublicKey:     nil,
+				PeerPublicKey:   longTermOraclePublicKey,
+			},
+			hybridcrypto.KeyContainer{
+				SecretGenerator: ephemeralGenerator,
+				MyPublicKey:     nil,
+				PeerPublicKey:   longTermOraclePublicKey,
+			},
+		},
+	}
+	return tsc.Encrypt(d, nil)
+}
+
+// receivingKey is a static key messages are encrypted to, like *protectedcrypto.Curve25519.
+type receivingKey interface {
+	hybridcrypto.SecretGenerator
+	PublicKey() *[32]byte
+}
+
+// decryptFromLongTermKey decrypts a message of encType encrypted with encryptToLongTermKey.
+func decryptFromLongTermKey(encType uint16, key receivingKey, memEngine memprotect.Engine, msg []byte) ([]byte, error) {
+	tsc := &hybridcrypto.SecretCalculator{
+		Combiner:           protectedcrypto.NewSecretCombiner(memEngine),
+		MessageType:        encType,
+		Nonce:              nil,
+		DeterministicNonce: nil,
+		Keys: []hybridcrypto.KeyContainer{
+			hybridcrypto.KeyContainer{
+				SecretGenerator: key,
+				MyPublicKey:     key.PublicKey(),
+				PeerPublicKey:   nil,
+			},
+			hybridcrypto.KeyContainer{
+				SecretGenerator: key,
+				MyPublicKey:     key.PublicKey(),
+				PeerPublicKey:   nil,
+			},
+		},
+	}
+	return tsc.Decrypt(msg, nil)
 }
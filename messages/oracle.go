@@ -2,6 +2,8 @@ package messages
 
 import (
 	"errors"
+	"log"
+	"sync"
 	"time"
 
 	// "assuredrelease.com/cypherlock-pe/hybridcrypto"
@@ -16,21 +18,44 @@ import (
 var timeNow = func() int64 { return int64(time.Now().Unix()) }
 
 type Oracle struct {
+	mutex             *sync.Mutex // Protects the keys.
 	engine            memprotect.Engine
 	exportEngine      memprotect.Engine
 	timeLockKey       *protectedcrypto.Curve25519Ratchet
 	timeLockGenerator memprotect.Curve25519RatchetGenerator
 	longTermKey       *protectedcrypto.Curve25519
 	shortTermKey      *protectedcrypto.Curve25519Rotating
-	signals           *signalstore.Store
+	signatureKey      *protectedcrypto.ED25519
+	shortSignatureKey *protectedcrypto.ED25519
+	signals           signalstore.SignalStore
+	urls              []string
+	timeLockURL       string
+	maxSemaphores     int
+	logger            *log.Logger
+	services          *sync.WaitGroup
+	stopServices      chan struct{}
+	stopOnce          *sync.Once
+	relays            chan bspRelay
+	relaying          bool // RunRelayService is running.
+	bspPeers          map[string]*bspPeer
+	recoverPosition   bool // Restore accepts a ratchet without recorded position.
 }
 
+// DefaultMaxSemaphores is the default number of semaphores of each kind an oracle accepts in a message.
+const DefaultMaxSemaphores = 16
+
 // NewOracle
-func NewOracle(storage *signalstore.Store, engine memprotect.Engine, exportEngine ...memprotect.Engine) *Oracle {
+func NewOracle(storage signalstore.SignalStore, engine memprotect.Engine, exportEngine ...memprotect.Engine) *Oracle {
 	r := &Oracle{
-		engine:       engine,
-		exportEngine: engine,
-		signals:      storage,
+		mutex:         new(sync.Mutex),
+		engine:        engine,
+		exportEngine:  engine,
+		signals:       storage,
+		maxSemaphores: DefaultMaxSemaphores,
+		services:      new(sync.WaitGroup),
+		stopServices:  make(chan struct{}),
+		stopOnce:      new(sync.Once),
+		relays:        make(chan bspRelay, relayQueueSize),
 	}
 	if len(exportEngine) > 0 {
 		r.exportEngine = exportEngine[0]
@@ -41,6 +66,8 @@ func NewOracle(storage *signalstore.Store, engine memprotect.Engine, exportEngin
 // Generate new oracle keys. Ratchet starts with startTime and refreshes with ratchetTime. timeToExpire determines the
 // lifetime of the shortTermKey.
 func (self *Oracle) Generate(startTime, ratchetTime, timeToExpire int64) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
 	var err error
 	if self.shortTermKey, err = protectedcrypto.NewCurve25519Rotating(timeToExpire, self.engine, self.exportEngine); err != nil {
 		return err
@@ -56,14 +83,34 @@ func (self *Oracle) Generate(startTime, ratchetTime, timeToExpire int64) error {
 	if err = self.longTermKey.Generate(); err != nil {
 		return err
 	}
-	return nil
+	self.signatureKey = protectedcrypto.NewED25519(self.engine)
+	if err = self.signatureKey.Generate(); err != nil {
+		return err
+	}
+	if err = self.recordRatchetPosition(); err != nil {
+		return err
+	}
+	return self.generateShortSignatureKey()
+}
+
+func (self *Oracle) generateShortSignatureKey() error {
+	self.shortSignatureKey = protectedcrypto.NewED25519(self.engine)
+	return self.shortSignatureKey.Generate()
 }
 
 func (self *Oracle) PublicKeys() (longTerm, shortTerm *[32]byte) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
 	return self.longTermKey.PublicKey(), self.shortTermKey.PublicKey()
 }
 
 func (self *Oracle) TimelockKeys(count int) (*types.RatchetPublicKey, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.timelockKeys(count)
+}
+
+func (self *Oracle) timelockKeys(count int) (*types.RatchetPublicKey, error) {
 	var err error
 	if self.timeLockGenerator, err = self.timeLockKey.Generator(); err != nil {
 		return nil, err
@@ -71,54 +118,278 @@ func (self *Oracle) TimelockKeys(count int) (*types.RatchetPublicKey, error) {
 	return self.timeLockGenerator.PublicKeys(count), nil
 }
 
-func (self *Oracle) Save() (longTermKey, timeLockKey memprotect.Element) {
-	return self.longTermKey.PrivateKey(), self.timeLockKey.PrivateKey()
+func (self *Oracle) Save() (longTermKey, timeLockKey, signatureKey memprotect.Element) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.longTermKey.PrivateKey(), self.timeLockKey.PrivateKey(), self.signatureKey.PrivateKey()
 }
 
-func (self *Oracle) Restore(longTermKey, timeLockKey memprotect.Element, timeToExpire int64) error {
-	var err error
-	if self.shortTermKey, err = protectedcrypto.NewCurve25519Rotating(timeToExpire, self.engine, self.exportEngine); err != nil {
+// Restore the oracle from saved keys. The timelock ratchet is refused if no position is recorded for it in the signal
+// store, unless SetRecoverRatchetPosition was called, or if it is behind that position. Otherwise it is advanced to the
+// present and its position recorded. Refused keys are destroyed and the oracle is left unchanged.
+func (self *Oracle) Restore(longTermKey, timeLockKey, signatureKey memprotect.Element, timeToExpire int64) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	destroy := func() {
+		longTermKey.Destroy()
+		timeLockKey.Destroy()
+		signatureKey.Destroy()
+	}
+	timeLock := protectedcrypto.NewCurve25519Ratchet(self.engine, self.exportEngine)
+	if err := timeLock.SetSecure(timeLockKey); err != nil {
+		destroy()
 		return err
 	}
-	self.timeLockKey = protectedcrypto.NewCurve25519Ratchet(self.engine, self.exportEngine)
-	if err = self.timeLockKey.SetSecure(timeLockKey); err != nil {
+	longTerm := protectedcrypto.NewCurve25519(self.engine, self.exportEngine)
+	if err := longTerm.SetSecure(longTermKey); err != nil {
+		destroy()
 		return err
 	}
-	self.longTermKey = protectedcrypto.NewCurve25519(self.engine, self.exportEngine)
-	if err = self.longTermKey.SetSecure(longTermKey); err != nil {
+	signature := protectedcrypto.NewED25519(self.engine)
+	if err := signature.SetSecure(signatureKey); err != nil {
+		destroy()
+		return err
+	}
+	if err := self.checkRatchetPosition(timeLock, longTerm); err != nil {
+		destroy()
+		return err
+	}
+	shortTerm, err := protectedcrypto.NewCurve25519Rotating(timeToExpire, self.engine, self.exportEngine)
+	if err != nil {
+		destroy()
+		return err
+	}
+	if _, _, err = timeLock.AdvanceTo(timeNow()); err != nil {
+		destroy()
+		return err
+	}
+	self.shortTermKey, self.timeLockKey, self.longTermKey, self.signatureKey = shortTerm, timeLock, longTerm, signature
+	if err = self.recordRatchetPosition(); err != nil {
+		return err
+	}
+	return self.generateShortSignatureKey()
+}
+
+func wipeBytes(d []byte) {
+	for i := range d {
+		d[i] = 0x00
+	}
+}
+
+// checkRatchetPosition returns ErrRatchetBackwards if the timelock ratchet is behind the position recorded for
+// longTermKey, and ErrNoRatchetPosition if no position is recorded and recovery was not requested.
+func (self *Oracle) checkRatchetPosition(timeLockKey *protectedcrypto.Curve25519Ratchet, longTermKey *protectedcrypto.Curve25519) error {
+	if self.signals == nil {
+		return nil
+	}
+	startTime, _, err := timeLockKey.Position()
+	if err != nil {
+		return err
+	}
+	position, err := self.signals.Position(longTermKey.PublicKey()[:])
+	switch {
+	case err == signalstore.ErrNoPosition && self.recoverPosition:
+		return nil
+	case err == signalstore.ErrNoPosition:
+		return ErrNoRatchetPosition
+	case err == signalstore.ErrBackwards || (err == nil && startTime < position):
+		return ErrRatchetBackwards
+	}
+	return err
+}
+
+// recordRatchetPosition records the position of the timelock ratchet in the signal store, keyed by the long term
+// public key. The store authenticates it with a key of its own, which is not part of the saved oracle keys.
+func (self *Oracle) recordRatchetPosition() error {
+	if self.signals == nil {
+		return nil
+	}
+	startTime, _, err := self.timeLockKey.Position()
+	if err != nil {
+		return err
+	}
+	if err := self.signals.SetPosition(self.longTermKey.PublicKey()[:], startTime); err == signalstore.ErrBackwards {
+		return ErrRatchetBackwards
+	} else if err != nil {
 		return err
 	}
 	return nil
 }
 
+// GetTimeLock returns the current and count-1 future timelock keys, signed by the long term signature key.
+func (self *Oracle) GetTimeLock(count int) ([]byte, error) {
+	if count <= 0 || count > MaxTimeLockKeys {
+		return nil, ErrTimeLockList
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	timeLocks, err := self.timelockKeys(count)
+	if err != nil {
+		return nil, err
+	}
+	list := &TimeLockList{
+		LongTermEncryptionKey: *self.longTermKey.PublicKey(),
+		StartTime:             timeLocks.StartTime,
+		RatchetTime:           timeLocks.RatchetTime,
+		Keys:                  timeLocks.Key,
+	}
+	signed, err := list.Sign(self.signatureKey)
+	if err != nil {
+		return nil, err
+	}
+	return signed.Marshal(nil), nil
+}
+
+// SetMaxSemaphores sets the number of semaphores of each kind accepted in a message, up to MaxSemaphores.
+// Messages with more semaphores are refused with ErrTooManySemaphores.
+func (self *Oracle) SetMaxSemaphores(n int) {
+	if n > MaxSemaphores {
+		n = MaxSemaphores
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.maxSemaphores = n
+}
+
+// SetRecoverRatchetPosition makes Restore accept a timelock ratchet for which the signal store records no position,
+// and record its position. It is only meant to recover an oracle whose signal store was lost: while it is set, a
+// restored old keystore can move the ratchet back and reveal timelock keys that were already used.
+func (self *Oracle) SetRecoverRatchetPosition(recover bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.recoverPosition = recover
+}
+
+// SetURLs sets the URLs and the timelock list location published in the config.
+func (self *Oracle) SetURLs(timeLockURL string, urls ...string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.timeLockURL = timeLockURL
+	self.urls = urls
+}
+
+// SignaturePublicKey returns the long term signature key of the oracle.
+func (self *Oracle) SignaturePublicKey() (*[32]byte, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	pubkey, err := self.signatureKey.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+	r := new([32]byte)
+	copy(r[:], pubkey)
+	return r, nil
+}
+
+// Config returns the current configuration of the oracle.
+func (self *Oracle) Config() (*OracleConfig, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.config()
+}
+
+func (self *Oracle) config() (*OracleConfig, error) {
+	config := &OracleConfig{
+		URLs:                   self.urls,
+		LongTermEncryptionKey:  *self.longTermKey.PublicKey(),
+		ShortTermEncryptionKey: *self.shortTermKey.PublicKey(),
+		TimeLockURL:            []byte(self.timeLockURL),
+	}
+	longTermSignatureKey, err := self.signatureKey.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+	shortTermSignatureKey, err := self.shortSignatureKey.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+	copy(config.LongTermSignatureKey[:], longTermSignatureKey)
+	copy(config.ShortTermSignatureKey[:], shortTermSignatureKey)
+	timeLocks, err := self.timelockKeys(0)
+	if err != nil {
+		return nil, err
+	}
+	config.TimeLockStartTime, config.TimeLockRatchetTime = timeLocks.StartTime, timeLocks.RatchetTime
+	config.ValidFrom, config.ValidTo = self.shortTermKey.Validity()
+	return config, nil
+}
+
+// GetConfig returns the marshalled config, signed by the long term signature key.
+// It always contains the current short term key.
+func (self *Oracle) GetConfig() ([]byte, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	config, err := self.config()
+	if err != nil {
+		return nil, err
+	}
+	signed, err := config.Sign(self.signatureKey)
+	if err != nil {
+		return nil, err
+	}
+	return signed.Marshal(nil), nil
+}
+
 func (self *Oracle) decryptOracleMessage(d []byte) (*OracleMessage, error) {
 	var r *OracleMessage
 	return r.decrypt(self.longTermKey, self.exportEngine, d)
 }
 
-func (self *Oracle) oracleMessageHandler(d []byte) ([]byte, []byte) {
+func (self *Oracle) oracleMessageHandler(d []byte) (*OracleResponseMsg, []byte) {
 	msg, err := self.decryptOracleMessage(d)
 	if err != nil {
-		return []byte(err.Error()), nil
+		if err != ErrWrongResponseKey {
+			err = ErrDecrypt
+		}
+		return newOracleResponse(nil, err), nil
 	}
 	payload, err := self.verifyOracleMessage(msg)
+	response := newOracleResponse(payload, err)
+	if err == ErrTimePolicy && msg.ValidFrom > timeNow() {
+		response.RetryAfter = msg.ValidFrom
+	}
+	return response, msg.ResponsePublicKey[:]
+}
+
+// setSemaphoreHandler sets the semaphore of a standalone SetSemaphore request. The payload is empty on success.
+func (self *Oracle) setSemaphoreHandler(d []byte) *OracleResponseMsg {
+	var msg *SetSemaphoreMsg
+	msg, err := msg.decrypt(self.longTermKey, self.exportEngine, d)
 	if err != nil {
-		return []byte(err.Error()), msg.ResponsePublicKey[:]
+		return newOracleResponse(nil, ErrDecrypt)
+	}
+	if msg.Name == zero32bytes || !(SemaphoreWindow{SetFrom: msg.SetFrom, SetTo: msg.SetTo}).valid() {
+		return newOracleResponse(nil, ErrInvalidSemaphore)
 	}
-	return payload, msg.ResponsePublicKey[:]
+	return newOracleResponse(nil, self.signals.SetSignal(msg.Name[:], msg.SetFrom, msg.SetTo))
 }
 
 var (
+	ErrInvalidSemaphore     = errors.New("oracle: Invalid semaphore")
+	ErrTooManySemaphores    = errors.New("oracle: Too many semaphores")
 	ErrTimePolicy           = errors.New("oracle: Time policy")
 	ErrSignalSet            = errors.New("oracle: Signal is set")
 	ErrWrongResponseKey     = errors.New("oracle: Wrong response key")
 	ErrUnhandledMessageType = errors.New("oracle: Unhandled message type")
+	ErrRatchetBackwards     = errors.New("oracle: Timelock ratchet behind recorded position")
+	ErrNoRatchetPosition    = errors.New("oracle: No timelock ratchet position recorded")
 )
 
+// setSignals sets the semaphores of msg for their time windows. Invalid windows are skipped and reported.
 func (self *Oracle) setSignals(msg *OracleMessage) error {
 	var err error
-	for _, s := range msg.SetSemaphores {
-		terr := self.signals.SetSignal(s[:], 0, 0)
+	for i, s := range msg.SetSemaphores {
+		if unusedSemaphore(&s) {
+			continue
+		}
+		w := msg.window(i)
+		if !w.valid() {
+			if err == nil {
+				err = ErrInvalidSemaphore
+			}
+			continue
+		}
+		terr := self.signals.SetSignal(s[:], w.SetFrom, w.SetTo)
 		if err == nil && terr != nil {
 			err = terr
 		}
@@ -128,6 +399,9 @@ func (self *Oracle) setSignals(msg *OracleMessage) error {
 
 func (self *Oracle) testSignals(msg *OracleMessage) error {
 	for _, s := range msg.TestSemaphores {
+		if unusedSemaphore(&s) {
+			continue
+		}
 		if !self.signals.TestSignal(s[:]) {
 			return ErrSignalSet
 		}
@@ -136,9 +410,14 @@ func (self *Oracle) testSignals(msg *OracleMessage) error {
 }
 
 func (self *Oracle) verifyOracleMessage(msg *OracleMessage) ([]byte, error) {
-	// Set semaphores first. This is most important to prevent distress to not be suppressed.
-	if err := self.setSignals(msg); err != nil {
-		return nil, err
+	// Set semaphores first. This is most important to prevent distress to not be suppressed. The lists are
+	// bounded by the wire format, oversized lists are refused only after their semaphores are set.
+	serr := self.setSignals(msg)
+	if test, set := msg.semaphoreCount(); test > self.maxSemaphores || set > self.maxSemaphores {
+		return nil, ErrTooManySemaphores
+	}
+	if serr != nil {
+		return nil, serr
 	}
 	// Verify time policy.
 	if msg.ValidFrom > 0 && msg.ValidFrom > timeNow() {
@@ -154,14 +433,17 @@ func (self *Oracle) verifyOracleMessage(msg *OracleMessage) ([]byte, error) {
 	// Decrypt share
 	err := msg.decryptShare(self.longTermKey, self.timeLockKey, self.exportEngine)
 	if err != nil {
-		return nil, err
+		return nil, ErrDecrypt
 	}
 	return msg.Share, nil
 }
 
 // ReceiveMsg receives and processes a message to the oracle.
 func (self *Oracle) ReceiveMsg(d []byte) ([]byte, error) {
-	var response, responseKey []byte
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	var response *OracleResponseMsg
+	var responseKey []byte
 	tsc := &hybridcrypto.SecretCalculator{
 		Combiner:           protectedcrypto.NewSecretCombiner(self.exportEngine),
 		MessageType:        0,
@@ -184,15 +466,37 @@ func (self *Oracle) ReceiveMsg(d []byte) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	switch tsc.MessageType {
+	switch tsc.MessageType &^ SignedEnvelopeFlag {
 	case OracleMessageEnvelopeType:
 		response, responseKey = self.oracleMessageHandler(msg)
 		if responseKey == nil {
 			responseKey = tsc.Keys[1].PeerPublicKey[:]
 		}
+	case SetSemaphoreEnvelopeType:
+		response, responseKey = self.setSemaphoreHandler(msg), tsc.Keys[1].PeerPublicKey[:]
+	case QuerySemaphoreEnvelopeType:
+		response, responseKey = self.querySemaphoreHandler(msg), tsc.Keys[1].PeerPublicKey[:]
+	case BSPRelayEnvelopeType:
+		response, responseKey = self.bspRelayHandler(msg), tsc.Keys[1].PeerPublicKey[:]
 	default:
 		return nil, ErrUnhandledMessageType
 	}
+	payload := response.Marshal(nil)
+	if tsc.MessageType&SignedEnvelopeFlag != 0 {
+		config, err := self.config()
+		if err != nil {
+			return nil, err
+		}
+		signedConfig, err := config.Sign(self.signatureKey)
+		if err != nil {
+			return nil, err
+		}
+		signed, err := signResponse(self.shortSignatureKey, signedConfig, d, payload)
+		if err != nil {
+			return nil, err
+		}
+		payload = signed.Marshal(nil)
+	}
 	tsc2 := &hybridcrypto.SecretCalculator{
 		Combiner:           protectedcrypto.NewSecretCombiner(self.exportEngine),
 		MessageType:        OracleResponseMessageType,
@@ -216,5 +520,5 @@ func (self *Oracle) ReceiveMsg(d []byte) ([]byte, error) {
 			},
 		},
 	}
-	return tsc2.Encrypt(response, nil)
+	return tsc2.Encrypt(payload, nil)
 }
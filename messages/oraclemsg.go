@@ -16,8 +16,8 @@ import (
 //   - Response public key.
 //   - Encrypted to node long term encryption key: (SK: ephemeral, response public key. RK: Long Term)
 // ---------------------------
-//     - [0-3]Semaphore Values. If set, verify that semaphores are not set.
-//     - [0-3]Semaphore Values with SetFrom/SetTo. If set, set semaphores.
+//     - [0-n]Semaphore Values. If set, verify that semaphores are not set.
+//     - [0-n]Semaphore Values with SetFrom/SetTo. If set, set semaphores.
 //     - ValidFrom time. 0x00... to disable.
 //     - ValidTo time. 0x00... to disable..
 //     - Timelock public key. 0x00... to disable.
@@ -28,72 +28,236 @@ import (
 var zero32bytes = [32]byte{}
 
 const OracleMessageEncType = 0xf0
-const OracleMsgTypeID = 1098
+const OracleMsgTypeID = 1098   // Version 1: Three semaphores of each kind, set forever.
+const OracleMsgV2TypeID = 1099 // Version 2: Three semaphores of each kind, each set semaphore has a time window.
+const OracleMsgV3TypeID = 1100 // Version 3: Variable-length semaphore lists with time windows.
 const OracleMsgContainerTypeID = 1080
 
+// MaxSemaphores is the maximum number of semaphores of each kind in an OracleMessage. Oracles may accept fewer.
+const MaxSemaphores = 256
+
+// MaxOracleRequestSize bounds the size of an enveloped OracleMessage with MaxSemaphores semaphores of each kind, as
+// sent to an oracle. Each test semaphore takes 32 bytes, each set semaphore 48 bytes with its window. The keys,
+// times, padded share and both layers of encryption take less than 2048 bytes.
+const MaxOracleRequestSize = MaxSemaphores*(32+48) + 2048
+
+// legacySemaphores is the number of semaphores of each kind in versions 1 and 2.
+const legacySemaphores = 3
+
+// SemaphoreWindow is the time during which a semaphore is set. SetFrom 0 means since the beginning of time,
+// SetTo 0 means forever.
+type SemaphoreWindow struct {
+	SetFrom int64
+	SetTo   int64
+}
+
+// valid returns false if the window cannot contain any time.
+func (self SemaphoreWindow) valid() bool {
+	return self.SetFrom >= 0 && self.SetTo >= 0 && (self.SetTo == 0 || self.SetTo > self.SetFrom)
+}
+
 // OracleMessage contains the data of an oracle message. Exported fields must be set.
 type OracleMessage struct {
-	OracleURL               []byte      // URL where the Oracle listens.
-	LongTermOraclePublicKey [32]byte    // The long-term oracle public key.
-	TimelockPublicKey       [32]byte    // Timelock key to use, ignore if all zeros.
-	TestSemaphores          [3][32]byte // Test these for non-existence
-	SetSemaphores           [3][32]byte // Set these
-	ValidFrom               int64       // Decrypt only after
-	ValidTo                 int64       // Decrypt only before
+	OracleURL               []byte            // URL where the Oracle listens.
+	LongTermOraclePublicKey [32]byte          // The long-term oracle public key.
+	TimelockPublicKey       [32]byte          // Timelock key to use, ignore if all zeros.
+	TestSemaphores          [][32]byte        // Test these for non-existence. All zero entries are ignored.
+	SetSemaphores           [][32]byte        // Set these. All zero entries are ignored.
+	SetSemaphoreWindows     []SemaphoreWindow // Time windows of SetSemaphores by index. Missing or zero sets them forever.
+	ValidFrom               int64             // Decrypt only after
+	ValidTo                 int64             // Decrypt only before
 
 	ResponsePublicKey [32]byte // The public key to which to encrypt the response
 	Share             []byte   // Share  to embed
 	ShareThreshold    int32    // Reconstruction threshold
 }
 
+// window returns the time window of SetSemaphores[i].
+func (self *OracleMessage) window(i int) SemaphoreWindow {
+	if i < len(self.SetSemaphoreWindows) {
+		return self.SetSemaphoreWindows[i]
+	}
+	return SemaphoreWindow{}
+}
+
+// hasWindows returns true if any set semaphore has a time window.
+func (self *OracleMessage) hasWindows() bool {
+	for i := range self.SetSemaphores {
+		if self.window(i) != (SemaphoreWindow{}) {
+			return true
+		}
+	}
+	return false
+}
+
+// isLegacy returns true if the semaphores fit into the fixed lists of versions 1 and 2.
+func (self *OracleMessage) isLegacy() bool {
+	return len(self.TestSemaphores) <= legacySemaphores && len(self.SetSemaphores) <= legacySemaphores
+}
+
+// unusedSemaphore returns true if s marks an unused entry of a semaphore list. Versions 1 and 2 pad the lists with
+// them, oracles neither set nor test them.
+func unusedSemaphore(s *[32]byte) bool {
+	return *s == zero32bytes
+}
+
+// semaphoreCount returns the number of semaphores in use of each kind.
+func (self *OracleMessage) semaphoreCount() (test, set int) {
+	for i := range self.TestSemaphores {
+		if !unusedSemaphore(&self.TestSemaphores[i]) {
+			test++
+		}
+	}
+	for i := range self.SetSemaphores {
+		if !unusedSemaphore(&self.SetSemaphores[i]) {
+			set++
+		}
+	}
+	return test, set
+}
+
+// legacySemaphores returns the semaphores padded to the fixed lists of versions 1 and 2.
+func (self *OracleMessage) legacySemaphores() (test, set [legacySemaphores][32]byte, windows [legacySemaphores]SemaphoreWindow) {
+	copy(test[:], self.TestSemaphores)
+	copy(set[:], self.SetSemaphores)
+	for i := range windows {
+		windows[i] = self.window(i)
+	}
+	return test, set, windows
+}
+
+// marshal the OracleMessage. The oldest version that can contain the message is written, so that oracles that
+// do not know later versions can still read it.
 func (self *OracleMessage) marshal(out []byte) []byte {
-	d, err := binencode.Encode(out, 2,
+	fields := []interface{}{
+		2, // Skip type.
 		binencode.SlicePointer(self.ResponsePublicKey[:]),
 		binencode.SlicePointer(self.LongTermOraclePublicKey[:]),
 		binencode.SlicePointer(self.TimelockPublicKey[:]),
-		binencode.SlicePointer(self.TestSemaphores[0][:]),
-		binencode.SlicePointer(self.TestSemaphores[1][:]),
-		binencode.SlicePointer(self.TestSemaphores[2][:]),
-		binencode.SlicePointer(self.SetSemaphores[0][:]),
-		binencode.SlicePointer(self.SetSemaphores[1][:]),
-		binencode.SlicePointer(self.SetSemaphores[2][:]),
-		self.ValidFrom,
-		self.ValidTo,
-		&self.Share,
-	)
+	}
+	var typeID uint16
+	if self.isLegacy() {
+		test, set, windows := self.legacySemaphores()
+		for i := range test {
+			fields = append(fields, binencode.SlicePointer(test[i][:]))
+		}
+		for i := range set {
+			fields = append(fields, binencode.SlicePointer(set[i][:]))
+		}
+		typeID = OracleMsgTypeID
+		if self.hasWindows() {
+			typeID = OracleMsgV2TypeID
+			for i := range windows {
+				fields = append(fields, windows[i].SetFrom, windows[i].SetTo)
+			}
+		}
+	} else {
+		typeID = OracleMsgV3TypeID
+		fields = append(fields, self.packTestSemaphores(), self.packSetSemaphores())
+	}
+	fields = append(fields, self.ValidFrom, self.ValidTo, &self.Share)
+	d, err := binencode.Encode(out, fields...)
 	if err != nil {
 		panic(err)
 	}
-	binencode.SetType(d, OracleMsgTypeID)
+	binencode.SetType(d, typeID)
 	return d
 }
 
+// packTestSemaphores returns the test semaphores concatenated.
+func (self *OracleMessage) packTestSemaphores() []byte {
+	r := make([]byte, 0, len(self.TestSemaphores)*32)
+	for _, s := range self.TestSemaphores {
+		r = append(r, s[:]...)
+	}
+	return r
+}
+
+// packSetSemaphores returns the set semaphores concatenated, each followed by SetFrom and SetTo.
+func (self *OracleMessage) packSetSemaphores() []byte {
+	r := make([]byte, 0, len(self.SetSemaphores)*48)
+	window := make([]byte, 16)
+	for i, s := range self.SetSemaphores {
+		w := self.window(i)
+		binary.BigEndian.PutUint64(window[0:8], uint64(w.SetFrom))
+		binary.BigEndian.PutUint64(window[8:], uint64(w.SetTo))
+		r = append(append(r, s[:]...), window...)
+	}
+	return r
+}
+
+func (self *OracleMessage) unpackSemaphores(test, set []byte) error {
+	if len(test)%32 != 0 || len(set)%48 != 0 {
+		return binencode.ErrSlizeExpected
+	}
+	if len(test)/32 > MaxSemaphores || len(set)/48 > MaxSemaphores {
+		return ErrTooManySemaphores
+	}
+	self.TestSemaphores = make([][32]byte, len(test)/32)
+	for i := range self.TestSemaphores {
+		copy(self.TestSemaphores[i][:], test[i*32:])
+	}
+	self.SetSemaphores = make([][32]byte, len(set)/48)
+	self.SetSemaphoreWindows = make([]SemaphoreWindow, len(set)/48)
+	for i := range self.SetSemaphores {
+		e := set[i*48 : (i+1)*48]
+		copy(self.SetSemaphores[i][:], e)
+		self.SetSemaphoreWindows[i].SetFrom = int64(binary.BigEndian.Uint64(e[32:40]))
+		self.SetSemaphoreWindows[i].SetTo = int64(binary.BigEndian.Uint64(e[40:48]))
+	}
+	return nil
+}
+
 func (self *OracleMessage) unmarshal(d []byte) (r *OracleMessage, remainder []byte, err error) {
-	if err := binencode.GetTypeExpect(d, OracleMsgTypeID); err != nil {
+	typeID, err := binencode.GetType(d)
+	if err != nil {
 		return nil, nil, err
 	}
+	if typeID != OracleMsgTypeID && typeID != OracleMsgV2TypeID && typeID != OracleMsgV3TypeID {
+		return nil, nil, binencode.ErrType
+	}
 	if self != nil {
 		r = self
 	} else {
 		r = new(OracleMessage)
 	}
-	remainder, err = binencode.Decode(d, 2,
+	fields := []interface{}{
+		2, // Skip type.
 		binencode.SlicePointer(r.ResponsePublicKey[:]),
 		binencode.SlicePointer(r.LongTermOraclePublicKey[:]),
 		binencode.SlicePointer(r.TimelockPublicKey[:]),
-		binencode.SlicePointer(r.TestSemaphores[0][:]),
-		binencode.SlicePointer(r.TestSemaphores[1][:]),
-		binencode.SlicePointer(r.TestSemaphores[2][:]),
-		binencode.SlicePointer(r.SetSemaphores[0][:]),
-		binencode.SlicePointer(r.SetSemaphores[1][:]),
-		binencode.SlicePointer(r.SetSemaphores[2][:]),
-		&r.ValidFrom,
-		&r.ValidTo,
-		&r.Share,
-	)
+	}
+	var test, set [legacySemaphores][32]byte
+	var windows [legacySemaphores]SemaphoreWindow
+	var packedTest, packedSet []byte
+	switch typeID {
+	case OracleMsgTypeID, OracleMsgV2TypeID:
+		for i := range test {
+			fields = append(fields, binencode.SlicePointer(test[i][:]))
+		}
+		for i := range set {
+			fields = append(fields, binencode.SlicePointer(set[i][:]))
+		}
+		if typeID == OracleMsgV2TypeID {
+			for i := range windows {
+				fields = append(fields, &windows[i].SetFrom, &windows[i].SetTo)
+			}
+		}
+	case OracleMsgV3TypeID:
+		fields = append(fields, &packedTest, &packedSet)
+	}
+	fields = append(fields, &r.ValidFrom, &r.ValidTo, &r.Share)
+	remainder, err = binencode.Decode(d, fields...)
 	if err != nil {
 		return nil, remainder, err
 	}
+	if typeID == OracleMsgV3TypeID {
+		if err := r.unpackSemaphores(packedTest, packedSet); err != nil {
+			return nil, remainder, err
+		}
+	} else {
+		r.TestSemaphores, r.SetSemaphores, r.SetSemaphoreWindows = test[:], set[:], windows[:]
+	}
 	return r, remainder, nil
 }
 
@@ -144,10 +308,13 @@ func (self *OracleMessage) decrypt(key *protectedcrypto.Curve25519, memEngine me
 		return nil, err
 	}
 	ret, _, err := self.unmarshal(decrypted)
+	if err != nil {
+		return nil, err
+	}
 	if !bytes.Equal(ret.ResponsePublicKey[:], tsc.Keys[1].PeerPublicKey[:]) {
 		return nil, ErrWrongResponseKey
 	}
-	return ret, err
+	return ret, nil
 }
 
 func GenerateSemaphore(longTermOraclePublicKey, semaphore *[32]byte) *[32]byte {
@@ -158,13 +325,13 @@ func GenerateSemaphore(longTermOraclePublicKey, semaphore *[32]byte) *[32]byte {
 
 func (self *OracleMessage) setSemaphores() {
 	for i := 0; i < len(self.TestSemaphores); i++ {
-		if self.TestSemaphores[i] != zero32bytes {
+		if !unusedSemaphore(&self.TestSemaphores[i]) {
 			a := GenerateSemaphore(&self.LongTermOraclePublicKey, &self.TestSemaphores[i])
 			copy(self.TestSemaphores[i][:], a[:])
 		}
 	}
 	for i := 0; i < len(self.SetSemaphores); i++ {
-		if self.SetSemaphores[i] != zero32bytes {
+		if !unusedSemaphore(&self.SetSemaphores[i]) {
 			a := GenerateSemaphore(&self.LongTermOraclePublicKey, &self.SetSemaphores[i])
 			copy(self.SetSemaphores[i][:], a[:])
 		}
@@ -180,11 +347,29 @@ func (self *OracleMessage) deterministicNonce() *[32]byte {
 	h.Write(valids)
 	h.Write(self.LongTermOraclePublicKey[:])
 	h.Write(self.TimelockPublicKey[:])
-	for _, v := range self.TestSemaphores {
-		h.Write(v[:])
-	}
-	for _, v := range self.SetSemaphores {
-		h.Write(v[:])
+	if self.isLegacy() {
+		// Identical to versions 1 and 2 for existing containers. Version 1 messages are not bound to windows.
+		test, set, windows := self.legacySemaphores()
+		for _, v := range test {
+			h.Write(v[:])
+		}
+		for _, v := range set {
+			h.Write(v[:])
+		}
+		if self.hasWindows() {
+			for _, w := range windows {
+				binary.BigEndian.PutUint64(valids[0:8], uint64(w.SetFrom))
+				binary.BigEndian.PutUint64(valids[8:], uint64(w.SetTo))
+				h.Write(valids)
+			}
+		}
+	} else {
+		// Lengths make the boundary between the lists unambiguous.
+		binary.BigEndian.PutUint64(valids[0:8], uint64(len(self.TestSemaphores)))
+		binary.BigEndian.PutUint64(valids[8:], uint64(len(self.SetSemaphores)))
+		h.Write(valids)
+		h.Write(self.packTestSemaphores())
+		h.Write(self.packSetSemaphores())
 	}
 	r := h.Sum(nil)
 	h.Reset()
@@ -310,8 +495,7 @@ func (self *OracleMessage) Encrypt(containerKey []byte, memEngine memprotect.Eng
 	if err = self.encryptShare(memEngine); err != nil {
 		return nil, err
 	}
-	shareBuffer.Seal()
-	shareBuffer.Destroy()
+	// Without timelock, Share still points into shareBuffer which is destroyed on return.
 	if container.OracleMessage, err = self.encrypt(responseKey, memEngine); err != nil {
 		return nil, err
 	}
@@ -1,11 +1,13 @@
 package messages
 
 import (
+	"bytes"
 	"io/ioutil"
 	"os"
 	"testing"
 	"time"
 
+	"assuredrelease.com/cypherlock-pe/binencode"
 	"assuredrelease.com/cypherlock-pe/memprotect"
 	"assuredrelease.com/cypherlock-pe/signalstore"
 )
@@ -35,15 +37,14 @@ func TestOracleMsg(t *testing.T) {
 	}
 	timeLockKey := timeLockKeylist.SelectKey(time.Now().Unix())
 	// spew.Dump(timeLockKey)
-	_ = shortTermKey
 	key := [32]byte{0x00, 0x01, 0x02}
 	td := &OracleMessage{
 		ShareThreshold:          2,
 		OracleURL:               []byte("http://testoracle.com"),
 		LongTermOraclePublicKey: *longTermKey,
 		TimelockPublicKey:       timeLockKey.PublicKey,
-		TestSemaphores:          [3][32]byte{[32]byte{0x01, 0x01}, [32]byte{0x02, 0x01}, [32]byte{0x02, 0x01}},
-		SetSemaphores:           [3][32]byte{[32]byte{0x01}, [32]byte{0x02}, [32]byte{0x02}},
+		TestSemaphores:          [][32]byte{[32]byte{0x01, 0x01}, [32]byte{0x02, 0x01}, [32]byte{0x02, 0x01}},
+		SetSemaphores:           [][32]byte{[32]byte{0x01}, [32]byte{0x02}, [32]byte{0x02}},
 		ValidFrom:               timeLockKey.ValidFrom,
 		ValidTo:                 timeLockKey.ValidTo,
 		Share:                   []byte("secret"),
@@ -52,7 +53,7 @@ func TestOracleMsg(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Encrypt: %s", err)
 	}
-	future, err := new(OracleMessageContainer).Send(key[:], container, func(url string) (*[32]byte, error) { return shortTermKey, nil }, engine)
+	future, err := new(OracleMessageContainer).Send(key[:], container, func(url string, longTermKey *[32]byte) (*[32]byte, error) { return shortTermKey, nil }, engine)
 	if err != nil {
 		t.Errorf("Send: %s", err)
 	}
@@ -60,20 +61,348 @@ func TestOracleMsg(t *testing.T) {
 	if err != nil {
 		t.Errorf("ReceiveMsg: %s", err)
 	}
-	_ = response
-	// spew.Dump(response)
-	// containerDec, err := new(OracleMessageContainer).Decrypt(key[:], container)
-	// if err != nil {
-	// 	t.Fatalf("Decrypt: %s", err)
-	// }
-
-	// oracleMsg, err := oracle.decryptOracleMessage(containerDec.OracleMessage)
-	// if err != nil {
-	// 	t.Errorf("decryptOracleMessage: %s", err)
-	// }
-	// msg, err := oracle.verifyOracleMessage(oracleMsg)
-	// if err != nil {
-	// 	t.Errorf("verifyOracleMessage: %s", err)
-	// }
-	// _ = msg
+	share, err := future.Receive(response)
+	if err != nil {
+		t.Fatalf("Receive: %s", err)
+	}
+	if !bytes.Equal(share, []byte("secret")) {
+		t.Error("Share not equal")
+	}
+	// The set semaphores are now recorded and make a second request fail.
+	td.TestSemaphores = [][32]byte{[32]byte{0x01}}
+	td.SetSemaphores = nil
+	td.Share = []byte("secret")
+	container, err = td.Encrypt(key[:], engine)
+	if err != nil {
+		t.Fatalf("Encrypt 2: %s", err)
+	}
+	future, err = new(OracleMessageContainer).Send(key[:], container, func(url string, longTermKey *[32]byte) (*[32]byte, error) { return shortTermKey, nil }, engine)
+	if err != nil {
+		t.Fatalf("Send 2: %s", err)
+	}
+	response, err = oracle.ReceiveMsg(future.Message)
+	if err != nil {
+		t.Fatalf("ReceiveMsg 2: %s", err)
+	}
+	if _, err := future.Receive(response); err != ErrSignalSet {
+		t.Errorf("Receive 2 returned wrong error: %v", err)
+	}
+}
+
+func TestOracleSetSemaphore(t *testing.T) {
+	oracle, _, engine, cleanup := newTestOracle(t)
+	defer cleanup()
+	longTermKey, shortTermKey := oracle.PublicKeys()
+	stkf := func(url string, longTermKey *[32]byte) (*[32]byte, error) { return shortTermKey, nil }
+	setSemaphore := func(msg *SetSemaphoreMsg) error {
+		encrypted, err := msg.Encrypt(longTermKey, engine)
+		if err != nil {
+			t.Fatalf("Encrypt: %s", err)
+		}
+		future, err := SendSetSemaphore("http://testoracle.com", longTermKey, encrypted, stkf, engine)
+		if err != nil {
+			t.Fatalf("SendSetSemaphore: %s", err)
+		}
+		response, err := oracle.ReceiveMsg(future.Message)
+		if err != nil {
+			t.Fatalf("ReceiveMsg: %s", err)
+		}
+		return future.ReceiveAck(response)
+	}
+	timeLockKeylist, err := oracle.TimelockKeys(1)
+	if err != nil {
+		t.Fatalf("TimelockKeys: %s", err)
+	}
+	timeLockKey := timeLockKeylist.SelectKey(time.Now().Unix())
+	key := [32]byte{0x01}
+	request := func() error {
+		td := &OracleMessage{
+			OracleURL:               []byte("http://testoracle.com"),
+			LongTermOraclePublicKey: *longTermKey,
+			TimelockPublicKey:       timeLockKey.PublicKey,
+			TestSemaphores:          [][32]byte{[32]byte{0x05}},
+			ValidFrom:               timeLockKey.ValidFrom,
+			ValidTo:                 timeLockKey.ValidTo,
+			Share:                   []byte("secret"),
+		}
+		container, err := td.Encrypt(key[:], engine)
+		if err != nil {
+			t.Fatalf("Encrypt: %s", err)
+		}
+		future, err := new(OracleMessageContainer).Send(key[:], container, stkf, engine)
+		if err != nil {
+			t.Fatalf("Send: %s", err)
+		}
+		response, err := oracle.ReceiveMsg(future.Message)
+		if err != nil {
+			t.Fatalf("ReceiveMsg: %s", err)
+		}
+		_, err = future.Receive(response)
+		return err
+	}
+
+	if err := setSemaphore(&SetSemaphoreMsg{SetFrom: 10, SetTo: 5, Name: [32]byte{0x05}}); err != ErrInvalidSemaphore {
+		t.Errorf("Invalid window accepted: %v", err)
+	}
+	if _, err := new(SetSemaphoreMsg).Encrypt(longTermKey, engine); err != ErrInvalidSemaphore {
+		t.Errorf("Empty name accepted: %v", err)
+	}
+	// Scheduled in the future: Requests are still answered.
+	if err := setSemaphore(&SetSemaphoreMsg{SetFrom: time.Now().Unix() + 1000, Name: [32]byte{0x05}}); err != nil {
+		t.Fatalf("Schedule semaphore: %s", err)
+	}
+	if err := request(); err != nil {
+		t.Errorf("Request with scheduled semaphore: %s", err)
+	}
+	// Tripped now.
+	if err := setSemaphore(&SetSemaphoreMsg{Name: [32]byte{0x05}}); err != nil {
+		t.Fatalf("Set semaphore: %s", err)
+	}
+	if err := request(); err != ErrSignalSet {
+		t.Errorf("Request with set semaphore: %v", err)
+	}
+}
+
+// versionTestMsg returns a message without windows and with short lists, encoded as version 1.
+func versionTestMsg() *OracleMessage {
+	return &OracleMessage{
+		LongTermOraclePublicKey: [32]byte{0x01},
+		SetSemaphores:           [][32]byte{[32]byte{0x02}, [32]byte{0x03}},
+		ValidFrom:               10,
+		ValidTo:                 20,
+		Share:                   []byte("share"),
+	}
+}
+
+func TestOracleMsgVersion1(t *testing.T) {
+	msg := versionTestMsg()
+	d := msg.marshal(nil)
+	if typeID, _ := binencode.GetType(d); typeID != OracleMsgTypeID {
+		t.Errorf("Message without windows not version 1: %d", typeID)
+	}
+	decoded := &OracleMessage{SetSemaphoreWindows: []SemaphoreWindow{{SetFrom: 1}}}
+	if _, _, err := decoded.unmarshal(d); err != nil {
+		t.Fatalf("unmarshal version 1: %s", err)
+	}
+	if decoded.hasWindows() || len(decoded.SetSemaphores) != 3 || decoded.SetSemaphores[1] != msg.SetSemaphores[1] || decoded.ValidTo != 20 || !bytes.Equal(decoded.Share, msg.Share) {
+		t.Errorf("Version 1 decoded wrong: %v", decoded)
+	}
+}
+
+// TestOracleMsgPaddedSemaphores checks that the entries padding the lists of version 1 are neither set nor tested.
+func TestOracleMsgPaddedSemaphores(t *testing.T) {
+	store := signalstore.NewMemory()
+	defer store.Close()
+	engine := new(memprotect.Unprotected)
+	engine.Init(new(memprotect.Unprotected).Cell(32))
+	oracle := NewOracle(store, engine)
+
+	msg := versionTestMsg()
+	msg.TestSemaphores = [][32]byte{[32]byte{0x04}}
+	decoded, _, err := new(OracleMessage).unmarshal(msg.marshal(nil))
+	if err != nil {
+		t.Fatalf("unmarshal version 1: %s", err)
+	}
+	if len(decoded.TestSemaphores) != 3 || len(decoded.SetSemaphores) != 3 {
+		t.Fatalf("Lists not padded: %d %d", len(decoded.TestSemaphores), len(decoded.SetSemaphores))
+	}
+	if test, set := decoded.semaphoreCount(); test != 1 || set != 2 {
+		t.Errorf("Padding counted: %d %d", test, set)
+	}
+	if err := oracle.setSignals(decoded); err != nil {
+		t.Fatalf("setSignals: %s", err)
+	}
+	if !store.TestSignal(zero32bytes[:]) {
+		t.Error("Padding set")
+	}
+	if store.TestSignal(msg.SetSemaphores[1][:]) {
+		t.Error("Semaphore not set")
+	}
+
+	if err := store.SetSignal(zero32bytes[:], 0, 0); err != nil {
+		t.Fatalf("SetSignal: %s", err)
+	}
+	if err := oracle.testSignals(decoded); err != nil {
+		t.Errorf("Padding tested: %s", err)
+	}
+	decoded.TestSemaphores[2] = msg.SetSemaphores[0]
+	if err := oracle.testSignals(decoded); err != ErrSignalSet {
+		t.Errorf("Set semaphore not tested: %v", err)
+	}
+}
+
+func TestOracleMsgVersion2(t *testing.T) {
+	msg := versionTestMsg()
+	msg.SetSemaphoreWindows = []SemaphoreWindow{{}, {SetFrom: 100, SetTo: 200}}
+	d := msg.marshal(nil)
+	if typeID, _ := binencode.GetType(d); typeID != OracleMsgV2TypeID {
+		t.Errorf("Message with windows not version 2: %d", typeID)
+	}
+	decoded, _, err := new(OracleMessage).unmarshal(d)
+	if err != nil {
+		t.Fatalf("unmarshal version 2: %s", err)
+	}
+	if decoded.window(1) != msg.window(1) || decoded.window(0) != msg.window(0) || decoded.SetSemaphores[1] != msg.SetSemaphores[1] || decoded.ValidFrom != 10 || !bytes.Equal(decoded.Share, msg.Share) {
+		t.Errorf("Version 2 decoded wrong: %v", decoded)
+	}
+	// The nonce of a decoded message matches the nonce of the message encoded.
+	if *decoded.deterministicNonce() != *msg.deterministicNonce() {
+		t.Error("Version 2 nonce differs after decoding")
+	}
+	if *msg.deterministicNonce() == *(&OracleMessage{LongTermOraclePublicKey: msg.LongTermOraclePublicKey, SetSemaphores: msg.SetSemaphores, ValidFrom: 10, ValidTo: 20}).deterministicNonce() {
+		t.Error("Windows not bound to share encryption")
+	}
+}
+
+func TestOracleMsgVersion3(t *testing.T) {
+	msg := versionTestMsg()
+	msg.SetSemaphoreWindows = []SemaphoreWindow{{}, {SetFrom: 100, SetTo: 200}}
+	// More semaphores than versions 1 and 2 can carry.
+	msg.TestSemaphores = [][32]byte{{0x10}, {0x11}, {0x12}, {0x13}, {0x14}}
+	d := msg.marshal(nil)
+	if typeID, _ := binencode.GetType(d); typeID != OracleMsgV3TypeID {
+		t.Errorf("Message with long list not version 3: %d", typeID)
+	}
+	decoded, _, err := new(OracleMessage).unmarshal(d)
+	if err != nil {
+		t.Fatalf("unmarshal version 3: %s", err)
+	}
+	if len(decoded.TestSemaphores) != 5 || decoded.TestSemaphores[4] != msg.TestSemaphores[4] || len(decoded.SetSemaphores) != 2 || decoded.window(1) != msg.window(1) || !bytes.Equal(decoded.Share, msg.Share) {
+		t.Errorf("Version 3 decoded wrong: %v", decoded)
+	}
+	if *decoded.deterministicNonce() != *msg.deterministicNonce() {
+		t.Error("Version 3 nonce differs after decoding")
+	}
+	moved := &OracleMessage{LongTermOraclePublicKey: msg.LongTermOraclePublicKey, TestSemaphores: msg.TestSemaphores[:4], SetSemaphores: append([][32]byte{msg.TestSemaphores[4]}, msg.SetSemaphores...), ValidFrom: 10, ValidTo: 20}
+	if *moved.deterministicNonce() == *msg.deterministicNonce() {
+		t.Error("Nonce does not separate the lists")
+	}
+	msg.TestSemaphores = make([][32]byte, MaxSemaphores+1)
+	if _, _, err := new(OracleMessage).unmarshal(msg.marshal(nil)); err != ErrTooManySemaphores {
+		t.Errorf("Oversized list decoded: %v", err)
+	}
+}
+
+func TestOracleMsgSemaphoreWindow(t *testing.T) {
+	oracle, _, engine, cleanup := newTestOracle(t)
+	defer cleanup()
+	longTermKey, shortTermKey := oracle.PublicKeys()
+	stkf := func(url string, longTermKey *[32]byte) (*[32]byte, error) { return shortTermKey, nil }
+	testSemaphores := [][32]byte{[32]byte{0x07}}
+	setSemaphores := [][32]byte{[32]byte{0x07}}
+	request := func(window SemaphoreWindow) error {
+		td := &OracleMessage{
+			OracleURL:               []byte("http://testoracle.com"),
+			LongTermOraclePublicKey: *longTermKey,
+			TestSemaphores:          append([][32]byte{}, testSemaphores...),
+			SetSemaphores:           append([][32]byte{}, setSemaphores...),
+			SetSemaphoreWindows:     []SemaphoreWindow{window},
+			Share:                   []byte("secret"),
+		}
+		key := [32]byte{0x01}
+		container, err := td.Encrypt(key[:], engine)
+		if err != nil {
+			t.Fatalf("Encrypt: %s", err)
+		}
+		future, err := new(OracleMessageContainer).Send(key[:], container, stkf, engine)
+		if err != nil {
+			t.Fatalf("Send: %s", err)
+		}
+		response, err := oracle.ReceiveMsg(future.Message)
+		if err != nil {
+			t.Fatalf("ReceiveMsg: %s", err)
+		}
+		_, err = future.Receive(response)
+		return err
+	}
+	now := time.Now().Unix()
+	if err := request(SemaphoreWindow{SetFrom: now + 100, SetTo: now + 50}); err != ErrInvalidSemaphore {
+		t.Errorf("Invalid window accepted: %v", err)
+	}
+	if err := request(SemaphoreWindow{SetFrom: now + 1000, SetTo: now + 2000}); err != nil {
+		t.Errorf("Scheduled semaphore set now: %s", err)
+	}
+	if err := request(SemaphoreWindow{SetFrom: now - 10, SetTo: now + 2000}); err != ErrSignalSet {
+		t.Errorf("Semaphore not set in window: %v", err)
+	}
+
+	// Lists beyond the legacy size up to the oracle limit.
+	oracle.SetMaxSemaphores(4)
+	testSemaphores = [][32]byte{{0x08}, {0x09}, {0x0a}, {0x0b}}
+	if err := request(SemaphoreWindow{}); err != nil {
+		t.Errorf("Request within limit: %s", err)
+	}
+	testSemaphores = [][32]byte{{0x08}, {0x09}, {0x0a}, {0x0b}, {0x0c}}
+	if err := request(SemaphoreWindow{}); err != ErrTooManySemaphores {
+		t.Errorf("Request over limit: %v", err)
+	}
+	// Semaphores of refused oversized messages are still set.
+	setSemaphores = [][32]byte{{0x0d}}
+	if err := request(SemaphoreWindow{}); err != ErrTooManySemaphores {
+		t.Errorf("Request over limit: %v", err)
+	}
+	testSemaphores, setSemaphores = [][32]byte{{0x0d}}, [][32]byte{{0x0e}}
+	if err := request(SemaphoreWindow{}); err != ErrSignalSet {
+		t.Errorf("Semaphore of oversized message not set: %v", err)
+	}
+}
+
+func TestOracleQuerySemaphore(t *testing.T) {
+	oracle, _, engine, cleanup := newTestOracle(t)
+	defer cleanup()
+	longTermKey, shortTermKey := oracle.PublicKeys()
+	stkf := func(url string, longTermKey *[32]byte) (*[32]byte, error) { return shortTermKey, nil }
+	query := func(name [32]byte) *SemaphoreStatusMsg {
+		future, err := SendQuerySemaphore("http://testoracle.com", longTermKey, &name, stkf, engine)
+		if err != nil {
+			t.Fatalf("SendQuerySemaphore: %s", err)
+		}
+		response, err := oracle.ReceiveMsg(future.Message)
+		if err != nil {
+			t.Fatalf("ReceiveMsg: %s", err)
+		}
+		status, err := future.ReceiveSemaphoreStatus(response)
+		if err != nil {
+			t.Fatalf("ReceiveSemaphoreStatus: %s", err)
+		}
+		return status
+	}
+	setSemaphore := func(msg *SetSemaphoreMsg) {
+		encrypted, err := msg.Encrypt(longTermKey, engine)
+		if err != nil {
+			t.Fatalf("Encrypt: %s", err)
+		}
+		future, err := SendSetSemaphore("http://testoracle.com", longTermKey, encrypted, stkf, engine)
+		if err != nil {
+			t.Fatalf("SendSetSemaphore: %s", err)
+		}
+		response, err := oracle.ReceiveMsg(future.Message)
+		if err != nil {
+			t.Fatalf("ReceiveMsg: %s", err)
+		}
+		if err := future.ReceiveAck(response); err != nil {
+			t.Fatalf("ReceiveAck: %s", err)
+		}
+	}
+
+	name := [32]byte{0x09}
+	if _, err := SendQuerySemaphore("http://testoracle.com", longTermKey, &[32]byte{}, stkf, engine); err != ErrInvalidSemaphore {
+		t.Errorf("Query for empty semaphore: %v", err)
+	}
+	if status := query(name); status.Status != SemaphoreUnknown {
+		t.Errorf("Unset semaphore: %v", status)
+	}
+	from := time.Now().Unix() + 1000
+	setSemaphore(&SetSemaphoreMsg{SetFrom: from, SetTo: from + 1000, Name: name})
+	if status := query(name); status.Status != SemaphoreInactive || status.SetFrom != from || status.SetTo != from+1000 {
+		t.Errorf("Scheduled semaphore: %v", status)
+	}
+	setSemaphore(&SetSemaphoreMsg{Name: name})
+	if status := query(name); status.Status != SemaphoreSet || status.SetFrom != 0 || status.SetTo != 0 {
+		t.Errorf("Set semaphore: %v", status)
+	}
+	// The stored value does not answer queries.
+	if status := query(*GenerateSemaphore(longTermKey, &name)); status.Status != SemaphoreUnknown {
+		t.Errorf("Stored semaphore answered: %v", status)
+	}
 }
@@ -0,0 +1,175 @@
+package messages
+
+import (
+	"log"
+	"time"
+)
+
+// minServiceWait is the shortest time a service waits between runs.
+const minServiceWait = time.Second
+
+// Clock provides the time to the services of the oracle.
+type Clock interface {
+	Now() int64                             // Current unix time in seconds.
+	After(d time.Duration) <-chan time.Time // Like time.After.
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() int64 { return timeNow() }
+
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// SetLogger sets the logger for service events. A nil logger disables logging.
+func (self *Oracle) SetLogger(logger *log.Logger) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.logger = logger
+}
+
+func (self *Oracle) logf(format string, v ...interface{}) {
+	self.mutex.Lock()
+	logger := self.logger
+	self.mutex.Unlock()
+	if logger != nil {
+		logger.Printf(format, v...)
+	}
+}
+
+// RotateShortTermKey replaces the short term key. The previous key is accepted until the new key expires.
+func (self *Oracle) RotateShortTermKey() (*[32]byte, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.shortTermKey.Rotate()
+}
+
+// rotationWait returns the time until the short term key expires.
+func (self *Oracle) rotationWait() time.Duration {
+	self.mutex.Lock()
+	_, expire := self.shortTermKey.Validity()
+	self.mutex.Unlock()
+	wait := time.Duration(expire-timeNow()) * time.Second
+	if wait < minServiceWait {
+		return minServiceWait
+	}
+	return wait
+}
+
+// RunRotationService rotates the short term key whenever it expires, until StopServices is called.
+// GetConfig returns the new key immediately after rotation.
+func (self *Oracle) RunRotationService() {
+	self.services.Add(1)
+	go func() {
+		defer self.services.Done()
+		for {
+			timer := time.NewTimer(self.rotationWait())
+			select {
+			case <-timer.C:
+				self.RotateShortTermKey() // Retried after minServiceWait on error since the key remains expired.
+			case <-self.stopServices:
+				timer.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// AdvanceRatchet advances the timelock ratchet to now, erasing the private keys of past periods, and records the
+// new position. It returns the number of periods advanced and the time until the next advance is due.
+func (self *Oracle) AdvanceRatchet(now int64) (steps int, wait time.Duration, err error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	steps, w, err := self.timeLockKey.AdvanceTo(now)
+	if err != nil {
+		return 0, 0, err
+	}
+	if steps > 0 {
+		if err := self.recordRatchetPosition(); err != nil {
+			return steps, 0, err
+		}
+	}
+	// The ratchet advances once the current period has fully passed.
+	return steps, time.Duration(w+1) * time.Second, nil
+}
+
+// RunRatchetService advances the timelock ratchet whenever a period ends, until StopServices is called.
+// If clock is nil the system clock is used. Catching up on more than one period, ie. after downtime, is logged.
+func (self *Oracle) RunRatchetService(clock Clock) {
+	if clock == nil {
+		clock = systemClock{}
+	}
+	self.services.Add(1)
+	go func() {
+		defer self.services.Done()
+		for {
+			steps, wait, err := self.AdvanceRatchet(clock.Now())
+			if err != nil {
+				self.logf("oracle: Timelock ratchet advance failed: %s", err)
+			} else if steps > 1 {
+				self.logf("oracle: Timelock ratchet caught up %d periods", steps)
+			}
+			if wait < minServiceWait {
+				wait = minServiceWait
+			}
+			select {
+			case <-clock.After(wait):
+			case <-self.stopServices:
+				return
+			}
+		}
+	}()
+}
+
+// StopServices stops all background services of the oracle and waits for them to return.
+func (self *Oracle) StopServices() {
+	self.stopOnce.Do(func() { close(self.stopServices) })
+	self.services.Wait()
+}
+
+// RelayFunc delivers a relayed BSPShareMsg to the node with signatureKey at url.
+type RelayFunc func(url string, signatureKey *[32]byte, message []byte) error
+
+// ConfigFunc fetches the signed config published at url.
+type ConfigFunc func(url string) ([]byte, error)
+
+// bspPeerVerifyInterval is the interval in which RunRelayService verifies the configs of all BSP peers.
+var bspPeerVerifyInterval = 10 * time.Minute
+
+// RunRelayService delivers queued BSP relays with relay, until StopServices is called. It verifies the configs of
+// all BSP peers with fetchConfig before it returns, and again every bspPeerVerifyInterval. Relays to peers without
+// verified config are refused. Before each delivery the config of the peer is verified again. Failed deliveries are
+// logged and dropped, the client learns of them from the missing shares. Without a running relay service the oracle
+// refuses relay requests with ErrNoRelay.
+func (self *Oracle) RunRelayService(relay RelayFunc, fetchConfig ConfigFunc) {
+	self.verifyBSPPeers(fetchConfig)
+	self.mutex.Lock()
+	self.relaying = true
+	self.mutex.Unlock()
+	self.services.Add(1)
+	go func() {
+		defer self.services.Done()
+		defer func() {
+			self.mutex.Lock()
+			self.relaying = false
+			self.mutex.Unlock()
+		}()
+		ticker := time.NewTicker(bspPeerVerifyInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case r := <-self.relays:
+				if err := self.verifyBSPPeer(fetchConfig, r.url); err != nil {
+					self.logf("oracle: Relay to %s dropped, config not verified: %s", r.url, err)
+					continue
+				}
+				if err := relay(r.url, &r.signatureKey, r.message); err != nil {
+					self.logf("oracle: Relay to %s failed: %s", r.url, err)
+				}
+			case <-ticker.C:
+				self.verifyBSPPeers(fetchConfig)
+			case <-self.stopServices:
+				return
+			}
+		}
+	}()
+}
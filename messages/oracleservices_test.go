@@ -0,0 +1,281 @@
+package messages
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"assuredrelease.com/cypherlock-pe/memprotect"
+	"assuredrelease.com/cypherlock-pe/signalstore"
+)
+
+// newTestOracle returns an oracle with generated keys, its signal store in a temporary directory and its engine.
+// cleanup closes the store and removes the directory.
+func newTestOracle(t *testing.T) (oracle *Oracle, store *signalstore.Store, engine memprotect.Engine, cleanup func()) {
+	tdir, err := ioutil.TempDir("", "CLPEtestStore")
+	if err != nil {
+		t.Fatalf("Cannot create temporary directory: %s", err)
+	}
+	store, err = signalstore.New(tdir)
+	if err != nil {
+		os.RemoveAll(tdir)
+		t.Fatalf("New store: %s", err)
+	}
+	cleanup = func() {
+		store.Close()
+		os.RemoveAll(tdir)
+	}
+	unprotected := new(memprotect.Unprotected)
+	unprotected.Init(new(memprotect.Unprotected).Cell(32))
+	oracle = NewOracle(store, unprotected)
+	if err := oracle.Generate(time.Now().Unix(), 1000000, 100000); err != nil {
+		cleanup()
+		t.Fatalf("Oracle.Generate: %s", err)
+	}
+	return oracle, store, unprotected, cleanup
+}
+
+func TestOracleRotationService(t *testing.T) {
+	oracle, _, engine, cleanup := newTestOracle(t)
+	defer cleanup()
+	if err := oracle.Generate(time.Now().Unix(), 1000000, 1); err != nil {
+		t.Fatalf("Oracle.Generate: %s", err)
+	}
+	longTermKey, firstKey := oracle.PublicKeys()
+	timeLockKeylist, err := oracle.TimelockKeys(1)
+	if err != nil {
+		t.Fatalf("TimelockKeys: %s", err)
+	}
+	timeLockKey := timeLockKeylist.SelectKey(time.Now().Unix())
+	key := [32]byte{0x01}
+	td := &OracleMessage{
+		OracleURL:               []byte("http://testoracle.com"),
+		LongTermOraclePublicKey: *longTermKey,
+		TimelockPublicKey:       timeLockKey.PublicKey,
+		ValidFrom:               timeLockKey.ValidFrom,
+		ValidTo:                 timeLockKey.ValidTo,
+		Share:                   []byte("secret"),
+	}
+	container, err := td.Encrypt(key[:], engine)
+	if err != nil {
+		t.Fatalf("Encrypt: %s", err)
+	}
+	currentKey := func(url string, longTermKey *[32]byte) (*[32]byte, error) {
+		d, err := oracle.GetConfig()
+		if err != nil {
+			return nil, err
+		}
+		config, err := VerifyOracleConfig(d, nil)
+		if err != nil {
+			return nil, err
+		}
+		return &config.ShortTermEncryptionKey, nil
+	}
+
+	oracle.RunRotationService()
+	stop := time.Now().Add(2500 * time.Millisecond)
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(stop) {
+				future, err := new(OracleMessageContainer).Send(key[:], container, currentKey, engine)
+				if err != nil {
+					t.Errorf("Send: %s", err)
+					return
+				}
+				response, err := oracle.ReceiveMsg(future.Message)
+				if err != nil {
+					t.Errorf("ReceiveMsg: %s", err)
+					return
+				}
+				share, err := future.Receive(response)
+				if err != nil || !bytes.Equal(share, []byte("secret")) {
+					t.Errorf("Receive: %s %v", share, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	oracle.StopServices()
+	oracle.StopServices()
+	if _, shortTermKey := oracle.PublicKeys(); *shortTermKey == *firstKey {
+		t.Error("Short term key not rotated")
+	}
+}
+
+type testClock struct {
+	mutex *sync.Mutex
+	now   int64
+	waits chan time.Duration
+	fire  chan time.Time
+}
+
+func (self *testClock) Now() int64 {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.now
+}
+
+func (self *testClock) set(now int64) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.now = now
+}
+
+func (self *testClock) After(d time.Duration) <-chan time.Time {
+	self.waits <- d
+	return self.fire
+}
+
+type syncBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (self *syncBuffer) Write(p []byte) (int, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.buf.Write(p)
+}
+
+func (self *syncBuffer) String() string {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.buf.String()
+}
+
+func TestOracleRatchetService(t *testing.T) {
+	oracle, _, _, cleanup := newTestOracle(t)
+	defer cleanup()
+	start := time.Now().Unix()
+	if err := oracle.Generate(start, 100, 100000); err != nil {
+		t.Fatalf("Oracle.Generate: %s", err)
+	}
+	before, err := oracle.TimelockKeys(12)
+	if err != nil {
+		t.Fatalf("TimelockKeys: %s", err)
+	}
+	logs := new(syncBuffer)
+	oracle.SetLogger(log.New(logs, "", 0))
+	clock := &testClock{mutex: new(sync.Mutex), now: start + 1000, waits: make(chan time.Duration), fire: make(chan time.Time)}
+	oracle.RunRatchetService(clock)
+	if wait := <-clock.waits; wait != time.Second {
+		t.Errorf("Wrong wait after catch up: %s", wait)
+	}
+	if !strings.Contains(logs.String(), "caught up 9 periods") {
+		t.Errorf("Catch up not logged: %q", logs.String())
+	}
+	clock.set(start + 1001)
+	clock.fire <- time.Now()
+	if wait := <-clock.waits; wait != 100*time.Second {
+		t.Errorf("Wrong wait after advance: %s", wait)
+	}
+	after, err := oracle.TimelockKeys(1)
+	if err != nil {
+		t.Fatalf("TimelockKeys: %s", err)
+	}
+	if after.StartTime != start+1000 || after.Key[0] != before.Key[10] {
+		t.Errorf("Ratchet not advanced: %d %d", after.StartTime-start, len(before.Key))
+	}
+	go oracle.StopServices()
+	select {
+	case <-clock.waits:
+		t.Error("Service not stopped")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestOracleRatchetPosition(t *testing.T) {
+	oracle, store, engine, cleanup := newTestOracle(t)
+	defer cleanup()
+	var err error
+	kek := engine.Cell(32)
+	backup := func(oracle *Oracle) [3][]byte {
+		var r [3][]byte
+		longTermKey, timeLockKey, signatureKey := oracle.Save()
+		for i, e := range []memprotect.Element{longTermKey, timeLockKey, signatureKey} {
+			if r[i], err = memprotect.EncryptElement(kek, e); err != nil {
+				t.Fatalf("EncryptElement: %s", err)
+			}
+		}
+		return r
+	}
+	restore := func(oracle *Oracle, b [3][]byte) error {
+		var e [3]memprotect.Element
+		for i := range b {
+			if e[i], err = memprotect.DecryptElement(kek, b[i], engine); err != nil {
+				t.Fatalf("DecryptElement: %s", err)
+			}
+		}
+		return oracle.Restore(e[0], e[1], e[2], 100)
+	}
+
+	now := time.Now().Unix()
+	if err := oracle.Generate(now, 100, 100); err != nil {
+		t.Fatalf("Oracle.Generate: %s", err)
+	}
+	old := backup(oracle)
+	if steps, _, err := oracle.AdvanceRatchet(now + 1000); err != nil || steps != 9 {
+		t.Fatalf("AdvanceRatchet: %d %v", steps, err)
+	}
+	current := backup(oracle)
+	refused := NewOracle(store, engine)
+	var e [3]memprotect.Element
+	for i := range old {
+		if e[i], err = memprotect.DecryptElement(kek, old[i], engine); err != nil {
+			t.Fatalf("DecryptElement: %s", err)
+		}
+	}
+	if err := refused.Restore(e[0], e[1], e[2], 100); err != ErrRatchetBackwards {
+		t.Errorf("Restored old ratchet: %v", err)
+	}
+	if refused.longTermKey != nil || refused.timeLockKey != nil || refused.signatureKey != nil || refused.shortTermKey != nil {
+		t.Error("Refused keys set")
+	}
+	for _, element := range e {
+		if d, _ := element.Bytes(); !bytes.Equal(d, make([]byte, len(d))) {
+			t.Error("Refused key not destroyed")
+		}
+	}
+	if err := restore(NewOracle(store, engine), current); err != nil {
+		t.Errorf("Restore current ratchet: %s", err)
+	}
+	// A store without the record is refused, unless recovery is requested explicitly.
+	lost := signalstore.NewMemory()
+	if err := restore(NewOracle(lost, engine), current); err != ErrNoRatchetPosition {
+		t.Errorf("Restored without recorded position: %v", err)
+	}
+	recovered := NewOracle(lost, engine)
+	recovered.SetRecoverRatchetPosition(true)
+	if err := restore(recovered, current); err != nil {
+		t.Errorf("Recover ratchet position: %s", err)
+	}
+	// Recovery records the position, an older backup is refused afterwards even with recovery requested.
+	recovered = NewOracle(lost, engine)
+	recovered.SetRecoverRatchetPosition(true)
+	if err := restore(recovered, old); err != ErrRatchetBackwards {
+		t.Errorf("Restored old ratchet after recovery: %v", err)
+	}
+
+	// Restore advances to the present.
+	timeNow = func() int64 { return now + 2000 }
+	defer func() { timeNow = func() int64 { return int64(time.Now().Unix()) } }()
+	restored := NewOracle(store, engine)
+	if err := restore(restored, current); err != nil {
+		t.Fatalf("Restore: %s", err)
+	}
+	if steps, _, _ := restored.AdvanceRatchet(now + 2000); steps != 0 {
+		t.Errorf("Restore did not advance ratchet: %d", steps)
+	}
+	if err := restore(NewOracle(store, engine), current); err != ErrRatchetBackwards {
+		t.Errorf("Restored ratchet behind advanced position: %v", err)
+	}
+}
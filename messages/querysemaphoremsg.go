@@ -0,0 +1,154 @@
+package messages
+
+import (
+	"assuredrelease.com/cypherlock-pe/binencode"
+	"assuredrelease.com/cypherlock-pe/memprotect"
+)
+
+/*
+QuerySemaphore
+- Encrypted to node short term and long term key (envelope):
+    - Semaphore Name, before GenerateSemaphore.
+- Response, encrypted to single response key:
+    - Status: Unknown, inactive or set.
+    - SetFrom, SetTo of the recorded window.
+
+The oracle derives the stored semaphore itself. Only the holder of the raw semaphore can query it, the stored
+values cannot be used for queries.
+*/
+
+const QuerySemaphoreMsgTypeID = 1007
+const SemaphoreStatusMsgTypeID = 1008
+const QuerySemaphoreEnvelopeType = 1023
+
+// Semaphore status values.
+const (
+	SemaphoreUnknown  = 0 // Never set.
+	SemaphoreInactive = 1 // Recorded, but not set at the current time.
+	SemaphoreSet      = 2 // Set at the current time.
+)
+
+// QuerySemaphoreMsg asks for the status of a semaphore.
+type QuerySemaphoreMsg struct {
+	Name [32]byte // The semaphore as given to OracleMessage or SetSemaphoreMsg, before GenerateSemaphore.
+}
+
+// Marshal QuerySemaphoreMsg. If out ==nil, a new output slice will be allocated.
+func (self *QuerySemaphoreMsg) Marshal(out []byte) []byte {
+	d, err := binencode.Encode(out, 2, binencode.SlicePointer(self.Name[:]))
+	if err != nil {
+		panic(err)
+	}
+	binencode.SetType(d, QuerySemaphoreMsgTypeID)
+	return d
+}
+
+// Unmarshal QuerySemaphoreMsg. If receiver is nil, a new receiver is created. Otherwise the receiver is used.
+func (self *QuerySemaphoreMsg) Unmarshal(d []byte) (r *QuerySemaphoreMsg, remainder []byte, err error) {
+	if err := binencode.GetTypeExpect(d, QuerySemaphoreMsgTypeID); err != nil {
+		return nil, nil, err
+	}
+	if self != nil {
+		r = self
+	} else {
+		r = new(QuerySemaphoreMsg)
+	}
+	remainder, err = binencode.Decode(d, 2, binencode.SlicePointer(r.Name[:]))
+	if err != nil {
+		return nil, remainder, err
+	}
+	return r, remainder, nil
+}
+
+// SemaphoreStatusMsg is the answer to a QuerySemaphoreMsg.
+type SemaphoreStatusMsg struct {
+	Status  int32 // SemaphoreUnknown, SemaphoreInactive or SemaphoreSet.
+	SetFrom int64 // Recorded window, 0 if unknown.
+	SetTo   int64
+}
+
+// Marshal SemaphoreStatusMsg. If out ==nil, a new output slice will be allocated.
+func (self *SemaphoreStatusMsg) Marshal(out []byte) []byte {
+	d, err := binencode.Encode(out, 2, &self.Status, &self.SetFrom, &self.SetTo)
+	if err != nil {
+		panic(err)
+	}
+	binencode.SetType(d, SemaphoreStatusMsgTypeID)
+	return d
+}
+
+// Unmarshal SemaphoreStatusMsg. If receiver is nil, a new receiver is created. Otherwise the receiver is used.
+func (self *SemaphoreStatusMsg) Unmarshal(d []byte) (r *SemaphoreStatusMsg, remainder []byte, err error) {
+	if err := binencode.GetTypeExpect(d, SemaphoreStatusMsgTypeID); err != nil {
+		return nil, nil, err
+	}
+	if self != nil {
+		r = self
+	} else {
+		r = new(SemaphoreStatusMsg)
+	}
+	remainder, err = binencode.Decode(d, 2, &r.Status, &r.SetFrom, &r.SetTo)
+	if err != nil {
+		return nil, remainder, err
+	}
+	return r, remainder, nil
+}
+
+// SendQuerySemaphore prepares a query for the status of semaphore name at the oracle at url. The answer is
+// decoded with OracleFuture.ReceiveSemaphoreStatus.
+func SendQuerySemaphore(url string, longTermOraclePublicKey *[32]byte, name *[32]byte, stkf ShortTermKeyFactory, memEngine memprotect.Engine) (*OracleFuture, error) {
+	if *name == zero32bytes {
+		return nil, ErrInvalidSemaphore
+	}
+	ret := &OracleFuture{
+		URL:               []byte(url),
+		OracleLongTermKey: append([]byte{}, longTermOraclePublicKey[:]...),
+		engine:            memEngine,
+	}
+	msg := &QuerySemaphoreMsg{Name: *name}
+	if err := ret.envelope(QuerySemaphoreEnvelopeType, msg.Marshal(nil), stkf); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// ReceiveSemaphoreStatus decrypts the response of an oracle to a semaphore query.
+func (self *OracleFuture) ReceiveSemaphoreStatus(response []byte) (*SemaphoreStatusMsg, error) {
+	payload, err := self.receiveSingle(response)
+	if err != nil {
+		return nil, err
+	}
+	if payload, err = self.parseResponse(payload); err != nil {
+		return nil, err
+	}
+	status, _, err := new(SemaphoreStatusMsg).Unmarshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// querySemaphoreHandler answers a semaphore query. The semaphore is derived with the long term key, values
+// as stored cannot be queried.
+func (self *Oracle) querySemaphoreHandler(d []byte) *OracleResponseMsg {
+	msg, _, err := new(QuerySemaphoreMsg).Unmarshal(d)
+	if err != nil {
+		return newOracleResponse(nil, ErrDecrypt)
+	}
+	if msg.Name == zero32bytes {
+		return newOracleResponse(nil, ErrInvalidSemaphore)
+	}
+	signal := GenerateSemaphore(self.longTermKey.PublicKey(), &msg.Name)
+	setFrom, setTo, set, found, err := self.signals.Signal(signal[:])
+	if err != nil {
+		return newOracleResponse(nil, err)
+	}
+	status := &SemaphoreStatusMsg{Status: SemaphoreUnknown}
+	if found {
+		status.Status, status.SetFrom, status.SetTo = SemaphoreInactive, setFrom, setTo
+		if set {
+			status.Status = SemaphoreSet
+		}
+	}
+	return newOracleResponse(status.Marshal(nil), nil)
+}
@@ -0,0 +1,126 @@
+package messages
+
+import (
+	"errors"
+
+	"assuredrelease.com/cypherlock-pe/binencode"
+)
+
+/*
+Oracle Response
+- Encrypted to the response keys of the request (see Oracle Message Response):
+    - Status code.
+    - RetryAfter: Time after which a request refused for the time policy may succeed. 0 if it never will.
+    - Payload if the status is StatusOK: ShareMessage, SemaphoreStatus, or empty for acks.
+*/
+
+const OracleResponseMsgTypeID = 1015
+
+// Response status values. Values are part of the protocol and must not change.
+const (
+	StatusOK                   = 0 // Request accepted, the payload is the answer.
+	StatusError                = 1 // Internal error of the oracle.
+	StatusDecrypt              = 2 // The request could not be decrypted.
+	StatusInvalidSemaphore     = 3
+	StatusTooManySemaphores    = 4
+	StatusTimePolicy           = 5
+	StatusSignalSet            = 6
+	StatusWrongResponseKey     = 7
+	StatusUnhandledMessageType = 8
+	StatusBSPRelay             = 9
+	StatusRelayQueue           = 10
+	StatusNoRelay              = 11
+	StatusBSPPeer              = 12
+	StatusPeerConfig           = 13
+)
+
+var ErrDecrypt = errors.New("oracle: Request could not be decrypted")
+
+// statusErrors are the errors reported by the status values. Errors not listed are reported as StatusError.
+var statusErrors = map[int32]error{
+	StatusDecrypt:              ErrDecrypt,
+	StatusInvalidSemaphore:     ErrInvalidSemaphore,
+	StatusTooManySemaphores:    ErrTooManySemaphores,
+	StatusTimePolicy:           ErrTimePolicy,
+	StatusSignalSet:            ErrSignalSet,
+	StatusWrongResponseKey:     ErrWrongResponseKey,
+	StatusUnhandledMessageType: ErrUnhandledMessageType,
+	StatusBSPRelay:             ErrBSPRelay,
+	StatusRelayQueue:           ErrRelayQueue,
+	StatusNoRelay:              ErrNoRelay,
+	StatusBSPPeer:              ErrBSPPeer,
+	StatusPeerConfig:           ErrPeerConfig,
+}
+
+// OracleResponseMsg is the answer of an oracle to a request.
+type OracleResponseMsg struct {
+	Status     int32  // StatusOK, or the reason the request was refused.
+	RetryAfter int64  // For StatusTimePolicy: Time after which the request may succeed, 0 if it never will.
+	Payload    []byte // Answer to the request if Status is StatusOK.
+}
+
+// newOracleResponse returns the response with payload, or the refusal for err if it is not nil.
+func newOracleResponse(payload []byte, err error) *OracleResponseMsg {
+	if err == nil {
+		return &OracleResponseMsg{Status: StatusOK, Payload: payload}
+	}
+	for status, e := range statusErrors {
+		if e == err {
+			return &OracleResponseMsg{Status: status}
+		}
+	}
+	return &OracleResponseMsg{Status: StatusError}
+}
+
+// Marshal OracleResponseMsg. If out ==nil, a new output slice will be allocated.
+func (self *OracleResponseMsg) Marshal(out []byte) []byte {
+	d, err := binencode.Encode(out, 2, &self.Status, &self.RetryAfter, &self.Payload)
+	if err != nil {
+		panic(err)
+	}
+	binencode.SetType(d, OracleResponseMsgTypeID)
+	return d
+}
+
+// Unmarshal OracleResponseMsg. If receiver is nil, a new receiver is created. Otherwise the receiver is used.
+func (self *OracleResponseMsg) Unmarshal(d []byte) (r *OracleResponseMsg, remainder []byte, err error) {
+	if err := binencode.GetTypeExpect(d, OracleResponseMsgTypeID); err != nil {
+		return nil, nil, err
+	}
+	if self != nil {
+		r = self
+	} else {
+		r = new(OracleResponseMsg)
+	}
+	remainder, err = binencode.Decode(d, 2, &r.Status, &r.RetryAfter, &r.Payload)
+	if err != nil {
+		return nil, remainder, err
+	}
+	return r, remainder, nil
+}
+
+// Err returns the error the oracle refused the request with, or nil for StatusOK. Unknown status values return
+// ErrOracleResponse.
+func (self *OracleResponseMsg) Err() error {
+	if self.Status == StatusOK {
+		return nil
+	}
+	if err, ok := statusErrors[self.Status]; ok {
+		return err
+	}
+	return ErrOracleResponse
+}
+
+// parseResponse decodes the response of an oracle, records it in self.Response and returns its payload or the
+// error the oracle refused the request with.
+func (self *OracleFuture) parseResponse(d []byte) ([]byte, error) {
+	response, _, err := new(OracleResponseMsg).Unmarshal(d)
+	if err != nil {
+		return nil, ErrOracleResponse
+	}
+	self.Response = response
+	if err := response.Err(); err != nil {
+		return nil, err
+	}
+	return response.Payload, nil
+}
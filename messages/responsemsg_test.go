@@ -0,0 +1,84 @@
+package messages
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOracleResponseMsg(t *testing.T) {
+	for _, response := range []*OracleResponseMsg{
+		newOracleResponse([]byte("payload"), nil),
+		newOracleResponse(nil, ErrSignalSet),
+		newOracleResponse(nil, ErrBSPNode), // Not reported to clients.
+		&OracleResponseMsg{Status: 9999},
+	} {
+		decoded, _, err := new(OracleResponseMsg).Unmarshal(response.Marshal(nil))
+		if err != nil {
+			t.Fatalf("Unmarshal: %s", err)
+		}
+		if decoded.Status != response.Status || string(decoded.Payload) != string(response.Payload) {
+			t.Errorf("Decoded response differs: %v %v", decoded, response)
+		}
+	}
+	if err := newOracleResponse(nil, ErrSignalSet).Err(); err != ErrSignalSet {
+		t.Errorf("Wrong error: %v", err)
+	}
+	if response := newOracleResponse(nil, ErrBSPNode); response.Status != StatusError || response.Err() != ErrOracleResponse {
+		t.Errorf("Unlisted error: %d %v", response.Status, response.Err())
+	}
+	if err := (&OracleResponseMsg{Status: 9999}).Err(); err != ErrOracleResponse {
+		t.Errorf("Unknown status: %v", err)
+	}
+	if err := newOracleResponse(nil, nil).Err(); err != nil {
+		t.Errorf("StatusOK: %v", err)
+	}
+}
+
+func TestOracleResponseRetryAfter(t *testing.T) {
+	oracle, _, engine, cleanup := newTestOracle(t)
+	defer cleanup()
+	defer func() { timeNow = func() int64 { return int64(time.Now().Unix()) } }()
+	longTermKey, shortTermKey := oracle.PublicKeys()
+	stkf := func(url string, longTermKey *[32]byte) (*[32]byte, error) { return shortTermKey, nil }
+	now := timeNow()
+	key := [32]byte{0x00, 0x01, 0x02}
+	msg := &OracleMessage{
+		ShareThreshold:          2,
+		OracleURL:               []byte("http://testoracle.com"),
+		LongTermOraclePublicKey: *longTermKey,
+		ValidFrom:               now - 10,
+		Share:                   []byte("secret"),
+	}
+	container, err := msg.Encrypt(key[:], engine)
+	if err != nil {
+		t.Fatalf("Encrypt: %s", err)
+	}
+	future, err := new(OracleMessageContainer).Send(key[:], container, stkf, engine)
+	if err != nil {
+		t.Fatalf("Send: %s", err)
+	}
+	timeNow = func() int64 { return now - 100 } // The oracle clock is behind.
+	response, err := oracle.ReceiveMsg(future.Message)
+	if err != nil {
+		t.Fatalf("ReceiveMsg: %s", err)
+	}
+	if _, err := future.Receive(response); err != ErrTimePolicy {
+		t.Fatalf("Receive returned wrong error: %v", err)
+	}
+	if future.Response.Status != StatusTimePolicy || future.Response.RetryAfter != now-10 {
+		t.Errorf("Wrong response: %d %d", future.Response.Status, future.Response.RetryAfter)
+	}
+
+	// Undecryptable oracle message.
+	future = &OracleFuture{URL: []byte("http://testoracle.com"), OracleLongTermKey: longTermKey[:], engine: engine}
+	if err := future.envelope(OracleMessageEnvelopeType, []byte("garbage"), stkf); err != nil {
+		t.Fatalf("envelope: %s", err)
+	}
+	response, err = oracle.ReceiveMsg(future.Message)
+	if err != nil {
+		t.Fatalf("ReceiveMsg: %s", err)
+	}
+	if err := future.ReceiveAck(response); err != ErrDecrypt || future.Response.Status != StatusDecrypt {
+		t.Errorf("Undecryptable message: %v", err)
+	}
+}
@@ -2,6 +2,8 @@ package messages
 
 import (
 	"assuredrelease.com/cypherlock-pe/binencode"
+	"assuredrelease.com/cypherlock-pe/memprotect"
+	"assuredrelease.com/cypherlock-pe/protectedcrypto"
 )
 
 // Notes: Only ShareMsg when decoded by client needs to be in secure memory
@@ -15,6 +17,8 @@ SetSemaphore
 */
 
 const SetSemaphoreMsgTypeID = 1001
+const SetSemaphoreEncType = 0xf1
+const SetSemaphoreEnvelopeType = 1022
 
 // SetSemaphoreMsg sets a semaphore between SetFrom and SetTo.
 type SetSemaphoreMsg struct {
@@ -49,3 +53,40 @@ func (self *SetSemaphoreMsg) Unmarshal(d []byte) (r *SetSemaphoreMsg, remainder
 	}
 	return r, remainder, nil
 }
+
+// Encrypt the SetSemaphoreMsg to the long-term key of the oracle. Name is converted with GenerateSemaphore,
+// like the semaphores of an OracleMessage. The receiver is not modified.
+func (self *SetSemaphoreMsg) Encrypt(longTermOraclePublicKey *[32]byte, memEngine memprotect.Engine) ([]byte, error) {
+	if self.Name == zero32bytes {
+		return nil, ErrInvalidSemaphore
+	}
+	msg := &SetSemaphoreMsg{
+		SetFrom: self.SetFrom,
+		SetTo:   self.SetTo,
+		Name:    *GenerateSemaphore(longTermOraclePublicKey, &self.Name),
+	}
+	return encryptToLongTermKey(SetSemaphoreEncType, msg.Marshal(nil), longTermOraclePublicKey, memEngine)
+}
+
+func (self *SetSemaphoreMsg) decrypt(key *protectedcrypto.Curve25519, memEngine memprotect.Engine, msg []byte) (*SetSemaphoreMsg, error) {
+	decrypted, err := decryptFromLongTermKey(SetSemaphoreEncType, key, memEngine, msg)
+	if err != nil {
+		return nil, err
+	}
+	r, _, err := self.Unmarshal(decrypted)
+	return r, err
+}
+
+// SendSetSemaphore prepares a standalone SetSemaphore request from a message encrypted with SetSemaphoreMsg.Encrypt.
+// The request is sent to url, the oracle's answer is checked with OracleFuture.ReceiveAck.
+func SendSetSemaphore(url string, longTermOraclePublicKey *[32]byte, encrypted []byte, stkf ShortTermKeyFactory, memEngine memprotect.Engine) (*OracleFuture, error) {
+	ret := &OracleFuture{
+		URL:               []byte(url),
+		OracleLongTermKey: append([]byte{}, longTermOraclePublicKey[:]...),
+		engine:            memEngine,
+	}
+	if err := ret.envelope(SetSemaphoreEnvelopeType, encrypted, stkf); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
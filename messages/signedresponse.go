@@ -0,0 +1,197 @@
+package messages
+
+import (
+	"bytes"
+	"crypto/sha256"
+
+	"golang.org/x/crypto/ed25519"
+
+	"assuredrelease.com/cypherlock-pe/binencode"
+	"assuredrelease.com/cypherlock-pe/protectedcrypto"
+)
+
+/*
+Signed Response
+- Requested by setting SignedEnvelopeFlag in the envelope message type.
+- Response, encrypted like the unsigned response:
+    - Receipt:
+        - SHA256 of the request envelope.
+        - Oracle time of the response.
+        - Response (OracleResponseMsg).
+    - Signature over the receipt by the node's short term signature key.
+    - The node's config at the time of the response, signed by the long term signature key.
+
+The short term signature key is regenerated whenever the oracle starts. The embedded config names it, so that the
+signed response alone proves how the oracle answered a request, ie. that it refused it because of a semaphore or
+the time policy.
+*/
+
+const ResponseReceiptTypeID = 1013
+const SignedResponseTypeID = 1014
+
+// SignedEnvelopeFlag is set in the envelope message type to request a signed response.
+const SignedEnvelopeFlag = 0x8000
+
+// ResponseReceipt records the response of an oracle to a request.
+type ResponseReceipt struct {
+	RequestHash [32]byte // SHA256 of the request envelope.
+	Time        int64    // Oracle time of the response.
+	Response    []byte   // Response payload.
+}
+
+// Marshal ResponseReceipt. If out ==nil, a new output slice will be allocated.
+func (self *ResponseReceipt) Marshal(out []byte) []byte {
+	d, err := binencode.Encode(out, 2, binencode.SlicePointer(self.RequestHash[:]), &self.Time, &self.Response)
+	if err != nil {
+		panic(err)
+	}
+	binencode.SetType(d, ResponseReceiptTypeID)
+	return d
+}
+
+// Unmarshal ResponseReceipt. If receiver is nil, a new receiver is created. Otherwise the receiver is used.
+func (self *ResponseReceipt) Unmarshal(d []byte) (r *ResponseReceipt, remainder []byte, err error) {
+	if err := binencode.GetTypeExpect(d, ResponseReceiptTypeID); err != nil {
+		return nil, nil, err
+	}
+	if self != nil {
+		r = self
+	} else {
+		r = new(ResponseReceipt)
+	}
+	remainder, err = binencode.Decode(d, 2, binencode.SlicePointer(r.RequestHash[:]), &r.Time, &r.Response)
+	if err != nil {
+		return nil, remainder, err
+	}
+	return r, remainder, nil
+}
+
+// OracleResponse returns the response recorded in the receipt.
+func (self *ResponseReceipt) OracleResponse() (*OracleResponseMsg, error) {
+	response, _, err := new(OracleResponseMsg).Unmarshal(self.Response)
+	return response, err
+}
+
+// Err returns the error the oracle refused the request with, or nil if it did not.
+func (self *ResponseReceipt) Err() error {
+	response, err := self.OracleResponse()
+	if err != nil {
+		return ErrOracleResponse
+	}
+	return response.Err()
+}
+
+// SignedResponse is a ResponseReceipt signed by the short term signature key of the oracle.
+type SignedResponse struct {
+	Receipt   []byte // Marshalled ResponseReceipt.
+	Signature []byte // ED25519 signature over Receipt.
+	Config    []byte // Marshalled SignedOracleConfig containing the short term signature key.
+}
+
+// Marshal SignedResponse. If out ==nil, a new output slice will be allocated.
+func (self *SignedResponse) Marshal(out []byte) []byte {
+	d, err := binencode.Encode(out, 2, &self.Receipt, &self.Signature, &self.Config)
+	if err != nil {
+		panic(err)
+	}
+	binencode.SetType(d, SignedResponseTypeID)
+	return d
+}
+
+// Unmarshal SignedResponse. If receiver is nil, a new receiver is created. Otherwise the receiver is used.
+func (self *SignedResponse) Unmarshal(d []byte) (r *SignedResponse, remainder []byte, err error) {
+	if err := binencode.GetTypeExpect(d, SignedResponseTypeID); err != nil {
+		return nil, nil, err
+	}
+	if self != nil {
+		r = self
+	} else {
+		r = new(SignedResponse)
+	}
+	remainder, err = binencode.Decode(d, 2, &r.Receipt, &r.Signature, &r.Config)
+	if err != nil {
+		return nil, remainder, err
+	}
+	return r, remainder, nil
+}
+
+// signResponse signs the response to request with key. config must contain the public key of key.
+func signResponse(key *protectedcrypto.ED25519, config *SignedOracleConfig, request, response []byte) (*SignedResponse, error) {
+	receipt := &ResponseReceipt{
+		RequestHash: sha256.Sum256(request),
+		Time:        timeNow(),
+		Response:    response,
+	}
+	d := receipt.Marshal(nil)
+	sig, err := key.Sign(d)
+	if err != nil {
+		return nil, err
+	}
+	return &SignedResponse{Receipt: d, Signature: sig, Config: config.Marshal(nil)}, nil
+}
+
+// OracleConfig verifies the embedded config and returns it. If signatureKey is not nil, the config must be signed
+// by it, see SignedOracleConfig.Verify.
+func (self *SignedResponse) OracleConfig(signatureKey *[32]byte) (*OracleConfig, error) {
+	return VerifyOracleConfig(self.Config, signatureKey)
+}
+
+// Verify the embedded config like OracleConfig, then the signature with its short term signature key, and return
+// the receipt.
+func (self *SignedResponse) Verify(signatureKey *[32]byte) (*ResponseReceipt, error) {
+	config, err := self.OracleConfig(signatureKey)
+	if err != nil {
+		return nil, err
+	}
+	return self.verify(config)
+}
+
+// verify the signature with the short term signature key of config and return the receipt.
+func (self *SignedResponse) verify(config *OracleConfig) (*ResponseReceipt, error) {
+	if !protectedcrypto.ED25519Verify(ed25519.PublicKey(config.ShortTermSignatureKey[:]), self.Receipt, self.Signature) {
+		return nil, ErrSignature
+	}
+	receipt, _, err := new(ResponseReceipt).Unmarshal(self.Receipt)
+	return receipt, err
+}
+
+// VerifyRequest verifies the signature like Verify, and that the receipt is for the request envelope request.
+func (self *SignedResponse) VerifyRequest(signatureKey *[32]byte, request []byte) (*ResponseReceipt, error) {
+	receipt, err := self.Verify(signatureKey)
+	if err != nil {
+		return nil, err
+	}
+	if hash := sha256.Sum256(request); !bytes.Equal(hash[:], receipt.RequestHash[:]) {
+		return nil, ErrSignature
+	}
+	return receipt, nil
+}
+
+// unwrapSigned returns the payload of a signed response and records it in self.Receipt. The receipt must be signed
+// under the config it contains, the config must name the long term key of the oracle and, if self.OracleSignatureKey
+// is set, be signed by it. Unsigned requests return payload unchanged.
+func (self *OracleFuture) unwrapSigned(payload []byte) ([]byte, error) {
+	if !self.Signed {
+		return payload, nil
+	}
+	signed, _, err := new(SignedResponse).Unmarshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	config, err := signed.OracleConfig(self.OracleSignatureKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(self.OracleLongTermKey) > 0 && !bytes.Equal(config.LongTermEncryptionKey[:], self.OracleLongTermKey) {
+		return nil, ErrSignatureKey
+	}
+	receipt, err := signed.verify(config)
+	if err != nil {
+		return nil, err
+	}
+	if receipt.RequestHash != sha256.Sum256(self.Message) {
+		return nil, ErrSignature
+	}
+	self.Receipt = signed
+	return receipt.Response, nil
+}
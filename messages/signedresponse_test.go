@@ -0,0 +1,131 @@
+package messages
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestOracleSignedResponse(t *testing.T) {
+	oracle, _, engine, cleanup := newTestOracle(t)
+	defer cleanup()
+	longTermKey, shortTermKey := oracle.PublicKeys()
+	stkf := func(url string, longTermKey *[32]byte) (*[32]byte, error) { return shortTermKey, nil }
+	signatureKey, err := oracle.SignaturePublicKey()
+	if err != nil {
+		t.Fatalf("SignaturePublicKey: %s", err)
+	}
+	signedConfig, err := oracle.GetConfig()
+	if err != nil {
+		t.Fatalf("GetConfig: %s", err)
+	}
+	config, err := VerifyOracleConfig(signedConfig, signatureKey)
+	if err != nil {
+		t.Fatalf("VerifyOracleConfig: %s", err)
+	}
+	key := [32]byte{0x00, 0x01, 0x02}
+	var pinnedKey *[32]byte
+	send := func(msg *OracleMessage) (*OracleFuture, []byte, error) {
+		msg.Share = []byte("secret") // Encrypt consumes the share.
+		container, err := msg.Encrypt(key[:], engine)
+		if err != nil {
+			t.Fatalf("Encrypt: %s", err)
+		}
+		future, err := new(OracleMessageContainer).SendSigned(key[:], container, stkf, engine)
+		if err != nil {
+			t.Fatalf("SendSigned: %s", err)
+		}
+		future.OracleSignatureKey = pinnedKey
+		response, err := oracle.ReceiveMsg(future.Message)
+		if err != nil {
+			t.Fatalf("ReceiveMsg: %s", err)
+		}
+		share, err := future.Receive(response)
+		return future, share, err
+	}
+	msg := &OracleMessage{
+		ShareThreshold:          2,
+		OracleURL:               []byte("http://testoracle.com"),
+		LongTermOraclePublicKey: *longTermKey,
+		SetSemaphores:           [][32]byte{[32]byte{0x01}},
+	}
+
+	future, share, err := send(msg)
+	if err != nil {
+		t.Fatalf("Receive: %s", err)
+	}
+	if !bytes.Equal(share, []byte("secret")) {
+		t.Error("Share not equal")
+	}
+	receipt, err := future.Receipt.VerifyRequest(signatureKey, future.Message)
+	if err != nil {
+		t.Fatalf("VerifyRequest: %s", err)
+	}
+	if receipt.Err() != nil || receipt.Time == 0 {
+		t.Errorf("Wrong receipt: %v %d", receipt.Err(), receipt.Time)
+	}
+
+	// Refused for the semaphore set by the first request.
+	msg.TestSemaphores, msg.SetSemaphores = [][32]byte{[32]byte{0x01}}, nil
+	future, _, err = send(msg)
+	if err != ErrSignalSet {
+		t.Fatalf("Receive returned wrong error: %v", err)
+	}
+	receipt, err = future.Receipt.VerifyRequest(signatureKey, future.Message)
+	if err != nil {
+		t.Fatalf("VerifyRequest: %s", err)
+	}
+	if receipt.Err() != ErrSignalSet {
+		t.Errorf("Wrong receipt error: %v", receipt.Err())
+	}
+	if _, err := future.Receipt.VerifyRequest(signatureKey, []byte("other request")); err != ErrSignature {
+		t.Errorf("Receipt for other request: %v", err)
+	}
+	// The receipt survives marshalling, but not tampering.
+	signed, _, err := new(SignedResponse).Unmarshal(future.Receipt.Marshal(nil))
+	if err != nil {
+		t.Fatalf("Unmarshal: %s", err)
+	}
+	signed.Receipt[len(signed.Receipt)-1] ^= 0x01
+	if _, err := signed.Verify(signatureKey); err != ErrSignature {
+		t.Errorf("Tampered receipt: %v", err)
+	}
+	if _, err := future.Receipt.Verify(&[32]byte{0x01}); err != ErrSignatureKey {
+		t.Errorf("Receipt of other oracle: %v", err)
+	}
+	// The receipt names its short term signature key and stays verifiable after the key changed, ie. on restart.
+	if receiptConfig, err := future.Receipt.OracleConfig(signatureKey); err != nil || receiptConfig.ShortTermSignatureKey != config.ShortTermSignatureKey {
+		t.Errorf("Receipt does not name the signature key: %v", err)
+	}
+	if err := oracle.generateShortSignatureKey(); err != nil {
+		t.Fatalf("generateShortSignatureKey: %s", err)
+	}
+	if _, err := future.Receipt.VerifyRequest(signatureKey, future.Message); err != nil {
+		t.Errorf("Receipt after key change: %s", err)
+	}
+	// Receive verifies receipts against a pinned signature key.
+	msg.TestSemaphores = nil
+	pinnedKey = signatureKey
+	if _, _, err := send(msg); err != nil {
+		t.Errorf("Receive with pinned key: %s", err)
+	}
+	pinnedKey = &[32]byte{0x01}
+	if future, _, err := send(msg); err != ErrSignatureKey || future.Receipt != nil {
+		t.Errorf("Receipt signed by other key accepted: %v", err)
+	}
+
+	// Unsigned requests have no receipt.
+	msg.TestSemaphores = nil
+	msg.Share = []byte("secret")
+	container, _ := msg.Encrypt(key[:], engine)
+	future, err = new(OracleMessageContainer).Send(key[:], container, stkf, engine)
+	if err != nil {
+		t.Fatalf("Send: %s", err)
+	}
+	response, err := oracle.ReceiveMsg(future.Message)
+	if err != nil {
+		t.Fatalf("ReceiveMsg: %s", err)
+	}
+	if _, err := future.Receive(response); err != nil || future.Receipt != nil {
+		t.Errorf("Unsigned receive: %v %v", err, future.Receipt)
+	}
+}
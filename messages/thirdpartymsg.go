@@ -0,0 +1,248 @@
+package messages
+
+import (
+	"errors"
+
+	"assuredrelease.com/cypherlock-pe/binencode"
+	"assuredrelease.com/cypherlock-pe/memprotect"
+	"assuredrelease.com/cypherlock-pe/protectedcrypto"
+)
+
+/*
+Third Party Request
+- Encrypted to Third Party Long Term Key: (SK: Ephemeral. RK: Long Term Key)
+    - Message type: Third Party Key Decryption Request
+    - ValidFrom, ValidTo of the request.
+    - Ephemeral response public key. Its private key is destroyed after ValidTo.
+    - Encrypted to own (the third party's) Long Term Key, created together with the cypherlock:
+        - Key to decrypt oracle messages
+- Response, encrypted to the ephemeral response public key: (SK: Ephemeral. RK: Response Key)
+    - Key to decrypt oracle messages
+
+The third party, ie. a trusted contact, can decrypt the key only when asked to. A response can only be read
+during the validity of the request.
+*/
+
+const ThirdPartyKeyMsgTypeID = 1011
+const ThirdPartyRequestMsgTypeID = 1012
+const ThirdPartyKeyEncType = 0xf4
+const ThirdPartyRequestEncType = 0xf5
+const ThirdPartyResponseEncType = 0xf6
+
+// MaxThirdPartyValidity is the longest time in seconds a third party request may be valid.
+const MaxThirdPartyValidity = 86400
+
+var ErrResponseKeyExpired = errors.New("messages: Response key expired")
+
+// ThirdPartyKeyMsg contains the key to decrypt oracle messages.
+type ThirdPartyKeyMsg struct {
+	Key []byte
+}
+
+// Marshal ThirdPartyKeyMsg. If out ==nil, a new output slice will be allocated.
+func (self *ThirdPartyKeyMsg) Marshal(out []byte) []byte {
+	d, err := binencode.Encode(out, 2, &self.Key)
+	if err != nil {
+		panic(err)
+	}
+	binencode.SetType(d, ThirdPartyKeyMsgTypeID)
+	return d
+}
+
+// Unmarshal ThirdPartyKeyMsg. If receiver is nil, a new receiver is created. Otherwise the receiver is used.
+func (self *ThirdPartyKeyMsg) Unmarshal(d []byte) (r *ThirdPartyKeyMsg, remainder []byte, err error) {
+	if err := binencode.GetTypeExpect(d, ThirdPartyKeyMsgTypeID); err != nil {
+		return nil, nil, err
+	}
+	if self != nil {
+		r = self
+	} else {
+		r = new(ThirdPartyKeyMsg)
+	}
+	remainder, err = binencode.Decode(d, 2, &r.Key)
+	if err != nil {
+		return nil, remainder, err
+	}
+	return r, remainder, nil
+}
+
+// EncryptThirdPartyKey encrypts key, which decrypts oracle messages, to the long term key of a third party. The
+// result is given to NewThirdPartyRequest when the third party is asked to decrypt it.
+func EncryptThirdPartyKey(key []byte, thirdPartyLongTermKey *[32]byte, memEngine memprotect.Engine) ([]byte, error) {
+	msg := &ThirdPartyKeyMsg{Key: key}
+	return encryptToLongTermKey(ThirdPartyKeyEncType, msg.Marshal(nil), thirdPartyLongTermKey, memEngine)
+}
+
+// ThirdPartyRequestMsg asks a third party to decrypt EncryptedKey.
+type ThirdPartyRequestMsg struct {
+	ValidFrom         int64    // Request is valid from
+	ValidTo           int64    // Request is valid to
+	ResponsePublicKey [32]byte // Ephemeral key to which the response is encrypted.
+	EncryptedKey      []byte   // Result of EncryptThirdPartyKey.
+}
+
+// Marshal ThirdPartyRequestMsg. If out ==nil, a new output slice will be allocated.
+func (self *ThirdPartyRequestMsg) Marshal(out []byte) []byte {
+	d, err := binencode.Encode(out, 2,
+		&self.ValidFrom,
+		&self.ValidTo,
+		binencode.SlicePointer(self.ResponsePublicKey[:]),
+		&self.EncryptedKey,
+	)
+	if err != nil {
+		panic(err)
+	}
+	binencode.SetType(d, ThirdPartyRequestMsgTypeID)
+	return d
+}
+
+// Unmarshal ThirdPartyRequestMsg. If receiver is nil, a new receiver is created. Otherwise the receiver is used.
+func (self *ThirdPartyRequestMsg) Unmarshal(d []byte) (r *ThirdPartyRequestMsg, remainder []byte, err error) {
+	if err := binencode.GetTypeExpect(d, ThirdPartyRequestMsgTypeID); err != nil {
+		return nil, nil, err
+	}
+	if self != nil {
+		r = self
+	} else {
+		r = new(ThirdPartyRequestMsg)
+	}
+	remainder, err = binencode.Decode(d, 2,
+		&r.ValidFrom,
+		&r.ValidTo,
+		binencode.SlicePointer(r.ResponsePublicKey[:]),
+		&r.EncryptedKey,
+	)
+	if err != nil {
+		return nil, remainder, err
+	}
+	return r, remainder, nil
+}
+
+// validTime returns ErrTimePolicy unless the request is valid now.
+func (self *ThirdPartyRequestMsg) validTime() error {
+	now := timeNow()
+	if self.ValidTo <= self.ValidFrom || self.ValidTo-self.ValidFrom > MaxThirdPartyValidity {
+		return ErrTimePolicy
+	}
+	if self.ValidFrom > now || self.ValidTo < now {
+		return ErrTimePolicy
+	}
+	return nil
+}
+
+// ThirdPartyRequest is a request to a third party, kept by the requester until the response arrives.
+type ThirdPartyRequest struct {
+	Message     []byte // The encrypted request, send it to the third party.
+	ValidTo     int64  // The response key is destroyed after.
+	responseKey *protectedcrypto.Curve25519EphemeralReceiver
+	engine      memprotect.Engine
+}
+
+// NewThirdPartyRequest creates a request to the third party with thirdPartyLongTermKey to decrypt encryptedKey,
+// valid from validFrom to validTo. The response key is ephemeral, it is only kept in memory and destroyed by a
+// timer after validTo.
+func NewThirdPartyRequest(thirdPartyLongTermKey *[32]byte, encryptedKey []byte, validFrom, validTo int64, memEngine memprotect.Engine) (*ThirdPartyRequest, error) {
+	responseKey, err := protectedcrypto.NewCurve25519Ephemeral(memEngine).Receiver(validTo)
+	if err != nil {
+		return nil, err
+	}
+	msg := &ThirdPartyRequestMsg{
+		ValidFrom:         validFrom,
+		ValidTo:           validTo,
+		ResponsePublicKey: *responseKey.PublicKey(),
+		EncryptedKey:      encryptedKey,
+	}
+	if err := msg.validTime(); err != nil {
+		responseKey.Destroy()
+		return nil, err
+	}
+	enc, err := encryptToLongTermKey(ThirdPartyRequestEncType, msg.Marshal(nil), thirdPartyLongTermKey, memEngine)
+	if err != nil {
+		responseKey.Destroy()
+		return nil, err
+	}
+	return &ThirdPartyRequest{
+		Message:     enc,
+		ValidTo:     validTo,
+		responseKey: responseKey,
+		engine:      memEngine,
+	}, nil
+}
+
+// Receive decrypts the response of the third party and returns the key to decrypt oracle messages. The response key
+// is destroyed afterwards, or if the request expired.
+func (self *ThirdPartyRequest) Receive(response []byte) ([]byte, error) {
+	if self.responseKey == nil {
+		return nil, ErrResponseKeyExpired
+	}
+	if self.ValidTo < timeNow() {
+		self.Destroy()
+		return nil, ErrResponseKeyExpired
+	}
+	decrypted, err := decryptFromLongTermKey(ThirdPartyResponseEncType, self.responseKey, self.engine, response)
+	if err != nil {
+		return nil, err
+	}
+	self.Destroy()
+	msg, _, err := new(ThirdPartyKeyMsg).Unmarshal(decrypted)
+	if err != nil {
+		return nil, err
+	}
+	return msg.Key, nil
+}
+
+// Destroy the response key. Responses cannot be received afterwards.
+func (self *ThirdPartyRequest) Destroy() {
+	if self.responseKey != nil {
+		self.responseKey.Destroy()
+		self.responseKey = nil
+	}
+}
+
+// ThirdParty answers third party requests.
+type ThirdParty struct {
+	longTermKey *protectedcrypto.Curve25519
+	engine      memprotect.Engine
+}
+
+// NewThirdParty returns a ThirdParty that decrypts requests with longTermKey.
+func NewThirdParty(longTermKey *protectedcrypto.Curve25519, memEngine memprotect.Engine) *ThirdParty {
+	return &ThirdParty{
+		longTermKey: longTermKey,
+		engine:      memEngine,
+	}
+}
+
+// ReceiveRequest decrypts a request. It returns ErrTimePolicy if the request is not valid now. The request
+// should be shown to the third party for approval before it is answered with Respond.
+func (self *ThirdParty) ReceiveRequest(d []byte) (*ThirdPartyRequestMsg, error) {
+	decrypted, err := decryptFromLongTermKey(ThirdPartyRequestEncType, self.longTermKey, self.engine, d)
+	if err != nil {
+		return nil, err
+	}
+	msg, _, err := new(ThirdPartyRequestMsg).Unmarshal(decrypted)
+	if err != nil {
+		return nil, err
+	}
+	if err := msg.validTime(); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// Respond decrypts the key of an approved request and encrypts it to the response key of the request. The decrypted
+// key is wiped afterwards.
+func (self *ThirdParty) Respond(request *ThirdPartyRequestMsg) ([]byte, error) {
+	if err := request.validTime(); err != nil {
+		return nil, err
+	}
+	decrypted, err := decryptFromLongTermKey(ThirdPartyKeyEncType, self.longTermKey, self.engine, request.EncryptedKey)
+	if err != nil {
+		return nil, err
+	}
+	defer wipeBytes(decrypted)
+	if _, _, err := new(ThirdPartyKeyMsg).Unmarshal(decrypted); err != nil {
+		return nil, err
+	}
+	return encryptToLongTermKey(ThirdPartyResponseEncType, decrypted, &request.ResponsePublicKey, self.engine)
+}
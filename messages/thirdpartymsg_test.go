@@ -0,0 +1,86 @@
+package messages
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"assuredrelease.com/cypherlock-pe/memprotect"
+	"assuredrelease.com/cypherlock-pe/protectedcrypto"
+)
+
+func TestThirdPartyRequest(t *testing.T) {
+	engine := new(memprotect.Unprotected)
+	engine.Init(new(memprotect.Unprotected).Cell(32))
+	defer func() { timeNow = func() int64 { return int64(time.Now().Unix()) } }()
+	longTermKey := protectedcrypto.NewCurve25519(engine)
+	if err := longTermKey.Generate(); err != nil {
+		t.Fatalf("Generate: %s", err)
+	}
+	otherKey := protectedcrypto.NewCurve25519(engine)
+	if err := otherKey.Generate(); err != nil {
+		t.Fatalf("Generate: %s", err)
+	}
+	thirdParty := NewThirdParty(longTermKey, engine)
+	key := bytes.Repeat([]byte{0x05}, 32)
+	encryptedKey, err := EncryptThirdPartyKey(key, longTermKey.PublicKey(), engine)
+	if err != nil {
+		t.Fatalf("EncryptThirdPartyKey: %s", err)
+	}
+	now := timeNow()
+
+	request, err := NewThirdPartyRequest(longTermKey.PublicKey(), encryptedKey, now-10, now+600, engine)
+	if err != nil {
+		t.Fatalf("NewThirdPartyRequest: %s", err)
+	}
+	msg, err := thirdParty.ReceiveRequest(request.Message)
+	if err != nil {
+		t.Fatalf("ReceiveRequest: %s", err)
+	}
+	if msg.ValidFrom != now-10 || msg.ValidTo != now+600 {
+		t.Errorf("Wrong validity: %d %d", msg.ValidFrom, msg.ValidTo)
+	}
+	response, err := thirdParty.Respond(msg)
+	if err != nil {
+		t.Fatalf("Respond: %s", err)
+	}
+	received, err := request.Receive(response)
+	if err != nil {
+		t.Fatalf("Receive: %s", err)
+	}
+	if !bytes.Equal(received, key) {
+		t.Error("Wrong key received")
+	}
+	if _, err := request.Receive(response); err != ErrResponseKeyExpired {
+		t.Errorf("Response key not destroyed: %v", err)
+	}
+
+	// Request to another third party.
+	if _, err := NewThirdParty(otherKey, engine).ReceiveRequest(request.Message); err == nil {
+		t.Error("Request decrypted by other third party")
+	}
+	// Validity too long.
+	if _, err := NewThirdPartyRequest(longTermKey.PublicKey(), encryptedKey, now, now+MaxThirdPartyValidity+1, engine); err != ErrTimePolicy {
+		t.Errorf("Long validity accepted: %v", err)
+	}
+	// Request expired at the third party.
+	request, err = NewThirdPartyRequest(longTermKey.PublicKey(), encryptedKey, now-10, now+600, engine)
+	if err != nil {
+		t.Fatalf("NewThirdPartyRequest: %s", err)
+	}
+	timeNow = func() int64 { return now + 601 }
+	if _, err := thirdParty.ReceiveRequest(request.Message); err != ErrTimePolicy {
+		t.Errorf("Expired request accepted: %v", err)
+	}
+	// Response received after expiry.
+	timeNow = func() int64 { return now }
+	msg, _ = thirdParty.ReceiveRequest(request.Message)
+	response, err = thirdParty.Respond(msg)
+	if err != nil {
+		t.Fatalf("Respond: %s", err)
+	}
+	timeNow = func() int64 { return now + 601 }
+	if _, err := request.Receive(response); err != ErrResponseKeyExpired {
+		t.Errorf("Response received after expiry: %v", err)
+	}
+}
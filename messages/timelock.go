@@ -0,0 +1,159 @@
+package messages
+
+import (
+	"bytes"
+	"errors"
+
+	"golang.org/x/crypto/ed25519"
+
+	"assuredrelease.com/cypherlock-pe/binencode"
+	"assuredrelease.com/cypherlock-pe/protectedcrypto"
+	"assuredrelease.com/cypherlock-pe/types"
+)
+
+/*
+GetTimeLock
+- Return a list of current and future timelock keys and their validity ranges.
+- Response is signed by the node's long term signature key.
+*/
+
+var ErrTimeLockList = errors.New("messages: Invalid timelock list")
+
+const TimeLockListTypeID = 1005
+const SignedTimeLockListTypeID = 1006
+
+// MaxTimeLockKeys is the maximum number of keys in a timelock list.
+const MaxTimeLockKeys = 4096
+
+// TimeLockList is the list of current and future timelock keys of an oracle.
+type TimeLockList struct {
+	LongTermEncryptionKey [32]byte // The long term key of the oracle to which the timelocks belong.
+	StartTime             int64    // Validity start of the first key.
+	RatchetTime           int64    // Validity duration of each key.
+	Keys                  [][32]byte
+}
+
+// Marshal TimeLockList. If out ==nil, a new output slice will be allocated.
+func (self *TimeLockList) Marshal(out []byte) []byte {
+	keys := make([]byte, 0, len(self.Keys)*32)
+	for _, k := range self.Keys {
+		keys = append(keys, k[:]...)
+	}
+	d, err := binencode.Encode(out, 2,
+		binencode.SlicePointer(self.LongTermEncryptionKey[:]),
+		self.StartTime,
+		self.RatchetTime,
+		&keys,
+	)
+	if err != nil {
+		panic(err)
+	}
+	binencode.SetType(d, TimeLockListTypeID)
+	return d
+}
+
+// Unmarshal TimeLockList. If receiver is nil, a new receiver is created. Otherwise the receiver is used.
+func (self *TimeLockList) Unmarshal(d []byte) (r *TimeLockList, remainder []byte, err error) {
+	var keys []byte
+	if err := binencode.GetTypeExpect(d, TimeLockListTypeID); err != nil {
+		return nil, nil, err
+	}
+	if self != nil {
+		r = self
+	} else {
+		r = new(TimeLockList)
+	}
+	remainder, err = binencode.Decode(d, 2,
+		binencode.SlicePointer(r.LongTermEncryptionKey[:]),
+		&r.StartTime,
+		&r.RatchetTime,
+		&keys,
+	)
+	if err != nil {
+		return nil, remainder, err
+	}
+	if len(keys)%32 != 0 || len(keys)/32 > MaxTimeLockKeys || r.RatchetTime <= 0 {
+		return nil, remainder, ErrTimeLockList
+	}
+	r.Keys = make([][32]byte, len(keys)/32)
+	for i := range r.Keys {
+		copy(r.Keys[i][:], keys[i*32:])
+	}
+	return r, remainder, nil
+}
+
+// RatchetPublicKey returns the list as RatchetPublicKey.
+func (self *TimeLockList) RatchetPublicKey() *types.RatchetPublicKey {
+	return &types.RatchetPublicKey{
+		StartTime:   self.StartTime,
+		RatchetTime: self.RatchetTime,
+		Key:         self.Keys,
+	}
+}
+
+// SignedTimeLockList is an encoded TimeLockList with the signature of the long term signature key of the oracle.
+type SignedTimeLockList struct {
+	List      []byte // Marshalled TimeLockList.
+	Signature []byte // ED25519 signature over List.
+}
+
+// Marshal SignedTimeLockList. If out ==nil, a new output slice will be allocated.
+func (self *SignedTimeLockList) Marshal(out []byte) []byte {
+	d, err := binencode.Encode(out, 2, &self.List, &self.Signature)
+	if err != nil {
+		panic(err)
+	}
+	binencode.SetType(d, SignedTimeLockListTypeID)
+	return d
+}
+
+// Unmarshal SignedTimeLockList. If receiver is nil, a new receiver is created. Otherwise the receiver is used.
+func (self *SignedTimeLockList) Unmarshal(d []byte) (r *SignedTimeLockList, remainder []byte, err error) {
+	if err := binencode.GetTypeExpect(d, SignedTimeLockListTypeID); err != nil {
+		return nil, nil, err
+	}
+	if self != nil {
+		r = self
+	} else {
+		r = new(SignedTimeLockList)
+	}
+	remainder, err = binencode.Decode(d, 2, &r.List, &r.Signature)
+	if err != nil {
+		return nil, remainder, err
+	}
+	return r, remainder, nil
+}
+
+// Sign list with the long term signature key.
+func (self *TimeLockList) Sign(key *protectedcrypto.ED25519) (*SignedTimeLockList, error) {
+	list := self.Marshal(nil)
+	sig, err := key.Sign(list)
+	if err != nil {
+		return nil, err
+	}
+	return &SignedTimeLockList{List: list, Signature: sig}, nil
+}
+
+// Verify that the list is signed by signatureKey and belongs to the oracle with longTermKey. Returns the contained list.
+func (self *SignedTimeLockList) Verify(signatureKey, longTermKey *[32]byte) (*TimeLockList, error) {
+	if !protectedcrypto.ED25519Verify(ed25519.PublicKey(signatureKey[:]), self.List, self.Signature) {
+		return nil, ErrSignature
+	}
+	list, _, err := new(TimeLockList).Unmarshal(self.List)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(list.LongTermEncryptionKey[:], longTermKey[:]) {
+		return nil, ErrSignatureKey
+	}
+	return list, nil
+}
+
+// VerifyTimeLockList parses a GetTimeLock response and verifies it. See SignedTimeLockList.Verify.
+func VerifyTimeLockList(d []byte, signatureKey, longTermKey *[32]byte) (*TimeLockList, error) {
+	signed, _, err := new(SignedTimeLockList).Unmarshal(d)
+	if err != nil {
+		return nil, err
+	}
+	return signed.Verify(signatureKey, longTermKey)
+}
@@ -0,0 +1,48 @@
+package messages
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeLockList(t *testing.T) {
+	oracle, _, _, cleanup := newTestOracle(t)
+	defer cleanup()
+	if err := oracle.Generate(time.Now().Unix(), 1000, 100000); err != nil {
+		t.Fatalf("Oracle.Generate: %s", err)
+	}
+	d, err := oracle.GetTimeLock(10)
+	if err != nil {
+		t.Fatalf("GetTimeLock: %s", err)
+	}
+	signatureKey, err := oracle.SignaturePublicKey()
+	if err != nil {
+		t.Fatalf("SignaturePublicKey: %s", err)
+	}
+	longTermKey, _ := oracle.PublicKeys()
+	list, err := VerifyTimeLockList(d, signatureKey, longTermKey)
+	if err != nil {
+		t.Fatalf("VerifyTimeLockList: %s", err)
+	}
+	expected, err := oracle.TimelockKeys(10)
+	if err != nil {
+		t.Fatalf("TimelockKeys: %s", err)
+	}
+	if list.StartTime != expected.StartTime || list.RatchetTime != expected.RatchetTime || len(list.Keys) != 10 {
+		t.Fatalf("Wrong list: %+v", list)
+	}
+	for i := range list.Keys {
+		if list.Keys[i] != expected.Key[i] {
+			t.Errorf("Wrong key %d", i)
+		}
+	}
+	if _, err := VerifyTimeLockList(d, signatureKey, &[32]byte{0x01}); err != ErrSignatureKey {
+		t.Errorf("List accepted for wrong oracle: %v", err)
+	}
+	if _, err := VerifyTimeLockList(d, &[32]byte{0x01}, longTermKey); err != ErrSignature {
+		t.Errorf("List accepted for wrong signature key: %v", err)
+	}
+	if _, err := oracle.GetTimeLock(MaxTimeLockKeys + 1); err != ErrTimeLockList {
+		t.Errorf("Count not limited: %v", err)
+	}
+}
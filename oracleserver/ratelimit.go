@@ -0,0 +1,73 @@
+package oracleserver
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter implements a token bucket per client.
+type rateLimiter struct {
+	mutex   *sync.Mutex
+	rate    float64 // Tokens added per second.
+	burst   float64 // Maximum number of tokens.
+	clients map[string]*bucket
+	calls   int
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// pruneInterval is the number of calls after which idle clients are removed.
+const pruneInterval = 1024
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		mutex:   new(sync.Mutex),
+		rate:    rate,
+		burst:   float64(burst),
+		clients: make(map[string]*bucket),
+	}
+}
+
+// allow returns true if client may make a request at time now.
+func (self *rateLimiter) allow(client string, now time.Time) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.calls++
+	if self.calls%pruneInterval == 0 {
+		self.prune(now)
+	}
+	b, ok := self.clients[client]
+	if !ok {
+		b = &bucket{tokens: self.burst, last: now}
+		self.clients[client] = b
+	}
+	b.refill(now, self.rate, self.burst)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (self *bucket) refill(now time.Time, rate, burst float64) {
+	if elapsed := now.Sub(self.last).Seconds(); elapsed > 0 {
+		self.tokens += elapsed * rate
+		if self.tokens > burst {
+			self.tokens = burst
+		}
+	}
+	self.last = now
+}
+
+// prune removes all clients whose buckets are full again.
+func (self *rateLimiter) prune(now time.Time) {
+	for client, b := range self.clients {
+		b.refill(now, self.rate, self.burst)
+		if b.tokens >= self.burst {
+			delete(self.clients, client)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+// Package oracleserver implements an HTTP frontend for a messages.Oracle.
+package oracleserver
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"assuredrelease.com/cypherlock-pe/memprotect"
+	"assuredrelease.com/cypherlock-pe/messages"
+	"assuredrelease.com/cypherlock-pe/signalstore"
+)
+
+// OraclePath is the HTTP path at which oracle messages are accepted.
+const OraclePath = "/oracle"
+
+// ConfigPath is the HTTP path at which the signed oracle config is published.
+const ConfigPath = "/config"
+
+// TimeLockPath is the HTTP path at which the signed timelock list is published.
+// The number of keys can be selected with the "count" query parameter.
+const TimeLockPath = "/timelocks"
+
+// BSPSharePath is the HTTP path at which BSPShareMsgs relayed by other oracles are accepted.
+const BSPSharePath = "/bspshare"
+
+// ContentType is the content type of requests and responses.
+const ContentType = "application/octet-stream"
+
+// Default limits.
+const (
+	DefaultMaxRequestSize = messages.MaxOracleRequestSize // Maximum size of a request body in bytes.
+	DefaultRate           = 1.0                           // Requests per second per client.
+	DefaultBurst          = 10                            // Requests a client can make at once.
+	DefaultTimeLockCount  = 365                           // Number of timelock keys returned if not requested otherwise.
+)
+
+var timeNow = time.Now
+
+// Config contains the server configuration. Zero values are replaced by defaults.
+type Config struct {
+	Addr           string  // Address to listen on.
+	MaxRequestSize int64   // Maximum size of a request body in bytes.
+	Rate           float64 // Requests per second per client.
+	Burst          int     // Requests a client can make at once.
+
+	// ShareHandler receives the verified BSP shares relayed to the oracle, after the oracle recorded them in its
+	// signal store. If nil, BSPSharePath is not served.
+	ShareHandler func(share *messages.BSPShareMsg)
+}
+
+// Server serves an oracle over HTTP.
+type Server struct {
+	oracle         *messages.Oracle
+	store          signalstore.SignalStore
+	engine         memprotect.Engine
+	maxRequestSize int64
+	limiter        *rateLimiter
+	httpServer     *http.Server
+	mutex          *sync.Mutex // Serializes access to the oracle.
+	shutdown       *sync.Once
+	shareHandler   func(share *messages.BSPShareMsg)
+}
+
+// New returns a new Server for oracle. The server owns store and engine, they are closed on Shutdown.
+func New(config Config, oracle *messages.Oracle, store signalstore.SignalStore, engine memprotect.Engine) *Server {
+	if config.MaxRequestSize <= 0 {
+		config.MaxRequestSize = DefaultMaxRequestSize
+	}
+	if config.Rate <= 0 {
+		config.Rate = DefaultRate
+	}
+	if config.Burst <= 0 {
+		config.Burst = DefaultBurst
+	}
+	r := &Server{
+		oracle:         oracle,
+		store:          store,
+		engine:         engine,
+		maxRequestSize: config.MaxRequestSize,
+		limiter:        newRateLimiter(config.Rate, config.Burst),
+		mutex:          new(sync.Mutex),
+		shutdown:       new(sync.Once),
+		shareHandler:   config.ShareHandler,
+	}
+	r.httpServer = &http.Server{
+		Addr:         config.Addr,
+		Handler:      r.Handler(),
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+	return r
+}
+
+// Handler returns the HTTP handler of the server.
+func (self *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(OraclePath, self.handleOracle)
+	mux.HandleFunc(ConfigPath, self.handleConfig)
+	mux.HandleFunc(TimeLockPath, self.handleTimeLock)
+	if self.shareHandler != nil {
+		mux.HandleFunc(BSPSharePath, self.handleBSPShare)
+	}
+	return mux
+}
+
+// clientAddress returns the address used for rate limiting.
+func clientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// readRequest returns the body of a POST request. It answers requests that are not allowed, exceed the rate limit
+// or the size limit and returns false for them.
+func (self *Server) readRequest(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+	if !self.limiter.allow(clientAddress(r), timeNow()) {
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+		return nil, false
+	}
+	if r.ContentLength > self.maxRequestSize {
+		http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, self.maxRequestSize))
+	if err != nil {
+		http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+	return body, true
+}
+
+func (self *Server) handleOracle(w http.ResponseWriter, r *http.Request) {
+	body, ok := self.readRequest(w, r)
+	if !ok {
+		return
+	}
+	response, err := self.receiveMsg(body)
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", ContentType)
+	w.Write(response)
+}
+
+func (self *Server) handleBSPShare(w http.ResponseWriter, r *http.Request) {
+	body, ok := self.readRequest(w, r)
+	if !ok {
+		return
+	}
+	share, err := self.receiveBSPShare(body)
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	self.shareHandler(share)
+	w.Header().Set("Content-Type", ContentType)
+}
+
+func (self *Server) receiveBSPShare(d []byte) (*messages.BSPShareMsg, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.oracle.ReceiveBSPShare(d)
+}
+
+func (self *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !self.limiter.allow(clientAddress(r), timeNow()) {
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+		return
+	}
+	config, err := self.getConfig()
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", ContentType)
+	w.Write(config)
+}
+
+func (self *Server) getConfig() ([]byte, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.oracle.GetConfig()
+}
+
+func (self *Server) handleTimeLock(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !self.limiter.allow(clientAddress(r), timeNow()) {
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+		return
+	}
+	count := DefaultTimeLockCount
+	if c := r.URL.Query().Get("count"); c != "" {
+		var err error
+		if count, err = strconv.Atoi(c); err != nil || count <= 0 || count > messages.MaxTimeLockKeys {
+			http.Error(w, "bad count", http.StatusBadRequest)
+			return
+		}
+	}
+	list, err := self.getTimeLock(count)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", ContentType)
+	w.Write(list)
+}
+
+func (self *Server) getTimeLock(count int) ([]byte, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.oracle.GetTimeLock(count)
+}
+
+func (self *Server) receiveMsg(d []byte) ([]byte, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.oracle.ReceiveMsg(d)
+}
+
+// ListenAndServe listens on the configured address. It returns http.ErrServerClosed after Shutdown.
+func (self *Server) ListenAndServe() error {
+	return self.httpServer.ListenAndServe()
+}
+
+// Serve accepts connections on l. It returns http.ErrServerClosed after Shutdown.
+func (self *Server) Serve(l net.Listener) error {
+	return self.httpServer.Serve(l)
+}
+
+// Shutdown stops the server gracefully, stops the services of the oracle, closes the signal store and finishes the memory engine.
+// Calls after the first return nil.
+func (self *Server) Shutdown(ctx context.Context) error {
+	var err error
+	self.shutdown.Do(func() {
+		err = self.httpServer.Shutdown(ctx)
+		self.oracle.StopServices()
+		self.mutex.Lock() // Wait for running oracle calls.
+		defer self.mutex.Unlock()
+		if serr := self.store.Close(); err == nil {
+			err = serr
+		}
+		self.engine.Finish()
+	})
+	return err
+}
@@ -0,0 +1,285 @@
+package oracleserver
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"assuredrelease.com/cypherlock-pe/memprotect"
+	"assuredrelease.com/cypherlock-pe/messages"
+	"assuredrelease.com/cypherlock-pe/signalstore"
+)
+
+func newTestServer(t *testing.T, config Config) (*Server, *messages.Oracle, memprotect.Engine, func()) {
+	tdir, err := ioutil.TempDir("", "CLPEtestStore")
+	if err != nil {
+		t.Fatalf("Cannot create temporary directory: %s", err)
+	}
+	store, err := signalstore.New(tdir)
+	if err != nil {
+		t.Fatalf("New store: %s", err)
+	}
+	engine := new(memprotect.Unprotected)
+	engine.Init(new(memprotect.Unprotected).Cell(32))
+	oracle := messages.NewOracle(store, engine)
+	if err := oracle.Generate(time.Now().Unix(), 1000000, 100000); err != nil {
+		t.Fatalf("Oracle.Generate: %s", err)
+	}
+	server := New(config, oracle, store, engine)
+	return server, oracle, engine, func() {
+		server.Shutdown(context.Background())
+		os.RemoveAll(tdir)
+	}
+}
+
+// newTestMessage returns a message to oracle with semaphores test and set semaphores. The set semaphores are set
+// forever.
+func newTestMessage(t *testing.T, oracle *messages.Oracle, engine memprotect.Engine, semaphores int) *messages.OracleFuture {
+	longTermKey, shortTermKey := oracle.PublicKeys()
+	timeLocks, err := oracle.TimelockKeys(1)
+	if err != nil {
+		t.Fatalf("TimelockKeys: %s", err)
+	}
+	timeLock := timeLocks.SelectKey(time.Now().Unix())
+	key := [32]byte{0x01}
+	msg := &messages.OracleMessage{
+		OracleURL:               []byte("http://oracle.test"),
+		LongTermOraclePublicKey: *longTermKey,
+		TimelockPublicKey:       timeLock.PublicKey,
+		ValidFrom:               timeLock.ValidFrom,
+		ValidTo:                 timeLock.ValidTo,
+		Share:                   []byte("share"),
+	}
+	for i := 0; i < semaphores; i++ {
+		msg.TestSemaphores = append(msg.TestSemaphores, [32]byte{0x01, byte(i >> 8), byte(i)})
+		msg.SetSemaphores = append(msg.SetSemaphores, [32]byte{0x02, byte(i >> 8), byte(i)})
+	}
+	container, err := msg.Encrypt(key[:], engine)
+	if err != nil {
+		t.Fatalf("Encrypt: %s", err)
+	}
+	future, err := new(messages.OracleMessageContainer).Send(key[:], container, func(url string, longTermKey *[32]byte) (*[32]byte, error) { return shortTermKey, nil }, engine)
+	if err != nil {
+		t.Fatalf("Send: %s", err)
+	}
+	return future
+}
+
+func post(t *testing.T, url string, body []byte) (int, []byte) {
+	resp, err := http.Post(url, ContentType, bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Post: %s", err)
+	}
+	defer resp.Body.Close()
+	d, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("ReadAll: %s", err)
+	}
+	return resp.StatusCode, d
+}
+
+func TestServer(t *testing.T) {
+	server, oracle, engine, cleanup := newTestServer(t, Config{MaxRequestSize: 4096, Burst: 3})
+	defer cleanup()
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+
+	future := newTestMessage(t, oracle, engine, 0)
+	status, response := post(t, ts.URL+OraclePath, future.Message)
+	if status != http.StatusOK {
+		t.Fatalf("Wrong status: %d", status)
+	}
+	share, err := future.Receive(response)
+	if err != nil {
+		t.Fatalf("Receive: %s", err)
+	}
+	if !bytes.Equal(share, []byte("share")) {
+		t.Error("Wrong share")
+	}
+	if status, _ := post(t, ts.URL+OraclePath, []byte("garbage")); status != http.StatusBadRequest {
+		t.Errorf("Garbage accepted: %d", status)
+	}
+	if status, _ := post(t, ts.URL+OraclePath, make([]byte, 4097)); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("Size limit not enforced: %d", status)
+	}
+	if status, _ := post(t, ts.URL+OraclePath, future.Message); status != http.StatusTooManyRequests {
+		t.Errorf("Rate limit not enforced: %d", status)
+	}
+	resp, err := http.Get(ts.URL + OraclePath)
+	if err != nil {
+		t.Fatalf("Get: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET accepted: %d", resp.StatusCode)
+	}
+}
+
+func TestServerMaxRequestSize(t *testing.T) {
+	server, oracle, engine, cleanup := newTestServer(t, Config{Burst: 3})
+	defer cleanup()
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+	oracle.SetMaxSemaphores(messages.MaxSemaphores)
+
+	future := newTestMessage(t, oracle, engine, messages.MaxSemaphores)
+	if len(future.Message) > DefaultMaxRequestSize {
+		t.Fatalf("Message with maximum semaphores exceeds limit: %d", len(future.Message))
+	}
+	if status, _ := post(t, ts.URL+OraclePath, future.Message); status != http.StatusOK {
+		t.Errorf("Message with maximum semaphores refused: %d", status)
+	}
+	if status, _ := post(t, ts.URL+OraclePath, make([]byte, DefaultMaxRequestSize+1)); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("Size limit not enforced: %d", status)
+	}
+}
+
+func TestServerMaxSemaphores(t *testing.T) {
+	server, oracle, engine, cleanup := newTestServer(t, Config{})
+	defer cleanup()
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+	oracle.SetMaxSemaphores(messages.MaxSemaphores)
+
+	future := newTestMessage(t, oracle, engine, messages.MaxSemaphores)
+	status, response := post(t, ts.URL+OraclePath, future.Message)
+	if status != http.StatusOK {
+		t.Fatalf("Wrong status: %d", status)
+	}
+	share, err := future.Receive(response)
+	if err != nil {
+		t.Fatalf("Receive: %s", err)
+	}
+	if !bytes.Equal(share, []byte("share")) {
+		t.Error("Wrong share")
+	}
+	longTermKey, _ := oracle.PublicKeys()
+	for i := 0; i < messages.MaxSemaphores; i++ {
+		if server.store.TestSignal(messages.GenerateSemaphore(longTermKey, &[32]byte{0x02, byte(i >> 8), byte(i)})[:]) {
+			t.Fatalf("Semaphore %d not set", i)
+		}
+		if !server.store.TestSignal(messages.GenerateSemaphore(longTermKey, &[32]byte{0x01, byte(i >> 8), byte(i)})[:]) {
+			t.Fatalf("Test semaphore %d set", i)
+		}
+	}
+}
+
+func TestServerConfig(t *testing.T) {
+	server, oracle, _, cleanup := newTestServer(t, Config{})
+	defer cleanup()
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + ConfigPath)
+	if err != nil {
+		t.Fatalf("Get: %s", err)
+	}
+	defer resp.Body.Close()
+	d, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("ReadAll: %s", err)
+	}
+	signatureKey, err := oracle.SignaturePublicKey()
+	if err != nil {
+		t.Fatalf("SignaturePublicKey: %s", err)
+	}
+	config, err := messages.VerifyOracleConfig(d, signatureKey)
+	if err != nil {
+		t.Fatalf("VerifyOracleConfig: %s", err)
+	}
+	if longTermKey, _ := oracle.PublicKeys(); config.LongTermEncryptionKey != *longTermKey {
+		t.Error("Wrong long term key")
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	server, _, _, cleanup := newTestServer(t, Config{})
+	defer cleanup()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- server.Serve(l) }()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown: %s", err)
+	}
+	if err := <-done; err != http.ErrServerClosed {
+		t.Errorf("Serve: %v", err)
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		t.Errorf("Second Shutdown: %s", err)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter(1, 2)
+	now := time.Unix(1000, 0)
+	if !limiter.allow("a", now) || !limiter.allow("a", now) {
+		t.Error("Burst not allowed")
+	}
+	if limiter.allow("a", now) {
+		t.Error("Limit not enforced")
+	}
+	if !limiter.allow("b", now) {
+		t.Error("Clients not separated")
+	}
+	if !limiter.allow("a", now.Add(time.Second)) {
+		t.Error("Tokens not refilled")
+	}
+	limiter.prune(now.Add(time.Minute))
+	if len(limiter.clients) != 0 {
+		t.Error("Idle clients not pruned")
+	}
+}
+
+func TestServerBSPShare(t *testing.T) {
+	shares := make(chan *messages.BSPShareMsg, 1)
+	server, oracle, engine, cleanup := newTestServer(t, Config{ShareHandler: func(share *messages.BSPShareMsg) { shares <- share }})
+	defer cleanup()
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+
+	longTermKey, _ := oracle.PublicKeys()
+	signatureKey, err := oracle.SignaturePublicKey()
+	if err != nil {
+		t.Fatalf("SignaturePublicKey: %s", err)
+	}
+	round, err := messages.NewBSPRound([][]byte{[]byte("share")})
+	if err != nil {
+		t.Fatalf("NewBSPRound: %s", err)
+	}
+	nodes := []messages.BSPNode{{SignatureKey: *signatureKey, URL: []byte(ts.URL + BSPSharePath)}}
+	bspShare, err := messages.NewBSPShare(nodes, round, 0, []byte("share"), []byte("oracle message"), bytes.Repeat([]byte{0x07}, 32))
+	if err != nil {
+		t.Fatalf("NewBSPShare: %s", err)
+	}
+	encrypted, err := bspShare.Encrypt(longTermKey, engine)
+	if err != nil {
+		t.Fatalf("BSPShareMsg.Encrypt: %s", err)
+	}
+	if status, _ := post(t, ts.URL+BSPSharePath, encrypted); status != http.StatusOK {
+		t.Fatalf("Wrong status: %d", status)
+	}
+	select {
+	case share := <-shares:
+		if !bytes.Equal(share.Share, []byte("share")) {
+			t.Error("Wrong share")
+		}
+	default:
+		t.Error("Share not handled")
+	}
+	if stored, err := oracle.BSPShare(round.Root); err != nil || !bytes.Equal(stored.Share, []byte("share")) {
+		t.Errorf("Delivered share not retrievable: %v", err)
+	}
+	if status, _ := post(t, ts.URL+BSPSharePath, []byte("garbage")); status != http.StatusBadRequest {
+		t.Errorf("Garbage accepted: %d", status)
+	}
+}
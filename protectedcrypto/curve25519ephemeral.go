@@ -2,6 +2,8 @@ package protectedcrypto
 
 import (
 	"io"
+	"sync"
+	"time"
 
 	"golang.org/x/crypto/curve25519"
 
@@ -34,3 +36,62 @@ func (self *Curve25519Ephemeral) SharedSecret(myPublicKey, peerPublicKey *[32]by
 	sha256Self(secret.Bytes())
 	return ephemeralPublicKey, secret, nil
 }
+
+// Curve25519EphemeralReceiver is an ephemeral key that receives messages until it expires. Its private key is
+// destroyed at expiry or by Destroy, whichever comes first.
+type Curve25519EphemeralReceiver struct {
+	mutex     *sync.Mutex // Protects key.
+	key       *Curve25519
+	publicKey *[32]byte
+	validTo   int64
+	timer     *time.Timer
+}
+
+// Receiver generates an ephemeral key that can be used until validTo (unix time). A timer destroys it afterwards.
+func (self *Curve25519Ephemeral) Receiver(validTo int64) (*Curve25519EphemeralReceiver, error) {
+	key := NewCurve25519(self.exportEngine)
+	if err := key.Generate(); err != nil {
+		return nil, err
+	}
+	r := &Curve25519EphemeralReceiver{
+		mutex:     new(sync.Mutex),
+		key:       key,
+		publicKey: key.PublicKey(),
+		validTo:   validTo,
+	}
+	r.timer = time.AfterFunc(time.Duration(validTo-timeNow()+1)*time.Second, r.Destroy)
+	return r, nil
+}
+
+func (self *Curve25519EphemeralReceiver) PublicKey() *[32]byte {
+	return self.publicKey
+}
+
+// SharedSecret calculates the shared secret like Curve25519.SharedSecret. It returns memprotect.ErrKeyNotFound once the
+// key has expired.
+func (self *Curve25519EphemeralReceiver) SharedSecret(myPublicKey, peerPublicKey *[32]byte) (myPublicKeyCopy *[32]byte, secret memprotect.Cell, err error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.key != nil && timeNow() > self.validTo {
+		self.destroy()
+	}
+	if self.key == nil {
+		return nil, nil, memprotect.ErrKeyNotFound
+	}
+	return self.key.SharedSecret(myPublicKey, peerPublicKey)
+}
+
+// Destroy the private key before it expires.
+func (self *Curve25519EphemeralReceiver) Destroy() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.destroy()
+}
+
+func (self *Curve25519EphemeralReceiver) destroy() {
+	if self.key != nil {
+		self.timer.Stop()
+		self.key.PrivateKey().Destroy()
+		self.key = nil
+	}
+}
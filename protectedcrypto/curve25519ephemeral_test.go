@@ -3,6 +3,7 @@ package protectedcrypto
 import (
 	"bytes"
 	"testing"
+	"time"
 
 	"assuredrelease.com/cypherlock-pe/memprotect"
 )
@@ -27,3 +28,49 @@ func TestECurve25519Ephemeral(t *testing.T) {
 		t.Error("SharedSecret secrets differ")
 	}
 }
+
+func TestCurve25519EphemeralReceiver(t *testing.T) {
+	engine := new(memprotect.Unprotected)
+	engine.Init(new(memprotect.Unprotected).Cell(32))
+	defer engine.Finish()
+	eph := NewCurve25519Ephemeral(engine)
+	receiver, err := eph.Receiver(timeNow() + 600)
+	if err != nil {
+		t.Fatalf("Receiver: %s", err)
+	}
+	pub, secret, err := eph.SharedSecret(nil, receiver.PublicKey())
+	if err != nil {
+		t.Fatalf("SharedSecret: %s", err)
+	}
+	_, secret2, err := receiver.SharedSecret(receiver.PublicKey(), pub)
+	if err != nil {
+		t.Fatalf("Receiver SharedSecret: %s", err)
+	}
+	if !bytes.Equal(secret.Bytes(), secret2.Bytes()) {
+		t.Error("SharedSecret secrets differ")
+	}
+	receiver.Destroy()
+	if _, _, err := receiver.SharedSecret(nil, pub); err != memprotect.ErrKeyNotFound {
+		t.Errorf("Destroyed key used: %v", err)
+	}
+
+	// The key is destroyed when it expires.
+	receiver, err = eph.Receiver(timeNow() - 1)
+	if err != nil {
+		t.Fatalf("Receiver: %s", err)
+	}
+	for i := 0; i < 100; i++ {
+		receiver.mutex.Lock()
+		destroyed := receiver.key == nil
+		receiver.mutex.Unlock()
+		if destroyed {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	if receiver.key != nil {
+		t.Error("Expired key not destroyed")
+	}
+}
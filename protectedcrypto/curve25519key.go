@@ -49,7 +49,18 @@ func (self *Curve25519) Generate() error {
 	return nil
 }
 
+// SetSecure sets the private key and calculates the matching public key.
 func (self *Curve25519) SetSecure(privateKey memprotect.Element) error {
+	if privateKey.Size() < 32 {
+		return memprotect.ErrSize
+	}
+	b, err := privateKey.Bytes()
+	if err != nil {
+		return err
+	}
+	self.pubkey = new([32]byte)
+	curve25519.ScalarBaseMult(self.pubkey, unsafeconvert.To32(b))
+	privateKey.Seal()
 	self.element = privateKey
 	return nil
 }
@@ -27,6 +27,13 @@ func TestECurve25519Key(t *testing.T) {
 	if !bytes.Equal(secret.Bytes(), secret2.Bytes()) {
 		t.Error("SharedSecret secrets differ")
 	}
+	key3 := NewCurve25519(engine)
+	if err := key3.SetSecure(key.PrivateKey()); err != nil {
+		t.Fatalf("SetSecure: %s", err)
+	}
+	if !bytes.Equal(key3.PublicKey()[:], key.PublicKey()[:]) {
+		t.Error("SetSecure public key differs")
+	}
 
 	// ephemeral, secret3, err := key.SharedSecret2DH(key2.PublicKey())
 	// if err != nil {
@@ -200,6 +200,32 @@ func (self *Curve25519Ratchet) Advance() (int64, error) {
 	return d, nil
 }
 
+// AdvanceTo advances the ratchet to time now. Private keys that are advanced past are overwritten, only the key
+// before the current one is kept. It returns the number of periods advanced and the seconds until the next advance.
+func (self *Curve25519Ratchet) AdvanceTo(now int64) (steps int, wait int64, err error) {
+	if err := self.open(); err != nil {
+		return 0, 0, err
+	}
+	self.element.Melt()
+	for self.ratchetKey.StartTime+self.ratchetKey.RatchetTime < now {
+		self.ratchetKey.advance(now)
+		steps++
+	}
+	wait = self.ratchetKey.RatchetTime - (now - self.ratchetKey.StartTime)
+	self.Seal()
+	return steps, wait, nil
+}
+
+// Position returns the start time of the current private key and the ratchet period.
+func (self *Curve25519Ratchet) Position() (startTime, ratchetTime int64, err error) {
+	if err := self.open(); err != nil {
+		return 0, 0, err
+	}
+	startTime, ratchetTime = self.ratchetKey.StartTime, self.ratchetKey.RatchetTime
+	self.Seal()
+	return startTime, ratchetTime, nil
+}
+
 func (self *Curve25519Ratchet) Generator() (memprotect.Curve25519RatchetGenerator, error) {
 	ret := new(Curve25519RatchetGenerator)
 	// Advance
@@ -65,3 +65,46 @@ func TestCurve25519Ratchet(t *testing.T) {
 		t.Error("Shared secret no match 2")
 	}
 }
+
+func TestCurve25519RatchetAdvanceTo(t *testing.T) {
+	engine := new(memprotect.Unprotected)
+	engine.Init(new(memprotect.Unprotected).Cell(32))
+	defer engine.Finish()
+
+	myKey := NewCurve25519(engine)
+	if err := myKey.Generate(); err != nil {
+		t.Fatalf("myKey.Generate: %s", err)
+	}
+	timeNow = func() int64 { return 251 }
+	key := NewCurve25519Ratchet(engine)
+	if err := key.Generate(1, 100); err != nil {
+		t.Fatalf("Generate: %s", err)
+	}
+	gen, err := key.Generator()
+	if err != nil {
+		t.Fatalf("Generator: %s", err)
+	}
+	keys := gen.PublicKeys(10)
+	steps, wait, err := key.AdvanceTo(1000)
+	if err != nil {
+		t.Fatalf("AdvanceTo: %s", err)
+	}
+	if steps != 7 || wait != 1 {
+		t.Errorf("Wrong advance: %d %d", steps, wait)
+	}
+	if startTime, ratchetTime, err := key.Position(); err != nil || startTime != 901 || ratchetTime != 100 {
+		t.Errorf("Wrong position: %d %d %v", startTime, ratchetTime, err)
+	}
+	if steps, _, _ := key.AdvanceTo(1000); steps != 0 {
+		t.Errorf("Advanced twice: %d", steps)
+	}
+	if _, _, err := key.SharedSecret(&keys.Key[7], myKey.PublicKey()); err != nil {
+		t.Errorf("Current key: %s", err)
+	}
+	if _, _, err := key.SharedSecret(&keys.Key[6], myKey.PublicKey()); err != nil {
+		t.Errorf("Previous key: %s", err)
+	}
+	if _, _, err := key.SharedSecret(&keys.Key[5], myKey.PublicKey()); err != memprotect.ErrRatchedNotFound {
+		t.Errorf("Key advanced past not erased: %v", err)
+	}
+}
@@ -68,6 +68,11 @@ func (self *Curve25519Rotating) PublicKey() (PublicKey *[32]byte) {
 	return self.currentPublicKey
 }
 
+// Validity returns the time of the last rotation and the time after which the current key should be rotated.
+func (self *Curve25519Rotating) Validity() (from, to int64) {
+	return self.expireTime - self.ttl, self.expireTime
+}
+
 func (self *Curve25519Rotating) SharedSecret(myPublicKey, peerPublicKey *[32]byte) (myPublicKeyCopy *[32]byte, secret memprotect.Cell, err error) {
 	var currentKey bool
 	var key []byte
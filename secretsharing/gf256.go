@@ -0,0 +1,37 @@
+package secretsharing
+
+// Arithmetic in GF(2^8) with the AES reduction polynomial x^8 + x^4 + x^3 + x + 1.
+// All operations avoid table lookups and data dependent branches.
+
+// gfAdd adds (and subtracts) two field elements.
+func gfAdd(a, b byte) byte {
+	return a ^ b
+}
+
+// gfMul multiplies two field elements.
+func gfMul(a, b byte) byte {
+	var r byte
+	for i := 0; i < 8; i++ {
+		r ^= a & -(b & 0x01)
+		carry := -(a >> 7)
+		a = (a << 1) ^ (0x1b & carry)
+		b >>= 1
+	}
+	return r
+}
+
+// gfInv returns the multiplicative inverse of a. The inverse of 0 is 0.
+func gfInv(a byte) byte {
+	// a^254 == a^-1
+	r := a
+	for i := 0; i < 6; i++ {
+		r = gfMul(r, r)
+		r = gfMul(r, a)
+	}
+	return gfMul(r, r)
+}
+
+// gfDiv divides a by b.
+func gfDiv(a, b byte) byte {
+	return gfMul(a, gfInv(b))
+}
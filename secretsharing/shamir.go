@@ -0,0 +1,195 @@
+// Package secretsharing implements Shamir's secret sharing over GF(256) on protected memory.
+//
+// Every share carries a header consisting of its index (the x coordinate of the share) and the
+// threshold required for recombination. This allows recombination of shares that arrive in any order.
+package secretsharing
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+
+	"assuredrelease.com/cypherlock-pe/memprotect"
+)
+
+var (
+	ErrThreshold      = errors.New("secretsharing: Invalid threshold or share count")
+	ErrShareFormat    = errors.New("secretsharing: Malformed share")
+	ErrShareCount     = errors.New("secretsharing: Not enough shares")
+	ErrDuplicateShare = errors.New("secretsharing: Duplicate share")
+)
+
+var RandomSource = rand.Reader
+
+// HeaderSize is the size of the share header.
+const HeaderSize = 2
+
+// MaxShares is the maximum number of shares that can be created.
+const MaxShares = 255
+
+// ShareSize returns the size of a share for a secret of secretSize bytes.
+func ShareSize(secretSize int) int {
+	return secretSize + HeaderSize
+}
+
+// SecretSize returns the size of the secret contained in a share of shareSize bytes.
+func SecretSize(shareSize int) int {
+	return shareSize - HeaderSize
+}
+
+// ParseHeader returns the index and threshold of a share.
+func ParseHeader(share []byte) (index, threshold int, err error) {
+	if len(share) < HeaderSize+1 || share[0] == 0 || share[1] == 0 {
+		return 0, 0, ErrShareFormat
+	}
+	return int(share[0]), int(share[1]), nil
+}
+
+// Split secret into n shares of which threshold are required to recombine the secret. The shares are
+// allocated from engine.
+func Split(secret memprotect.Element, n, threshold int, engine memprotect.Engine) ([]memprotect.Element, error) {
+	if threshold < 1 || n < threshold || n > MaxShares {
+		return nil, ErrThreshold
+	}
+	size := secret.Size()
+	if size < 1 {
+		return nil, ErrShareFormat
+	}
+	// Coefficients of the polynomials, excluding the secret.
+	coefficients := engine.Cell(size * (threshold - 1))
+	defer coefficients.Destroy()
+	if _, err := io.ReadFull(RandomSource, coefficients.Bytes()); err != nil {
+		return nil, err
+	}
+	secretBytes, err := secret.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	defer secret.Seal()
+	shares := make([]memprotect.Element, 0, n)
+	for i := 0; i < n; i++ {
+		share := engine.Element(ShareSize(size))
+		err := share.Melt()
+		if err == nil {
+			err = share.WithBytes(func(d []byte) error {
+				evaluate(d, byte(i+1), byte(threshold), secretBytes, coefficients.Bytes())
+				return nil
+			})
+		}
+		if err != nil {
+			share.Destroy()
+			destroyAll(shares)
+			return nil, err
+		}
+		shares = append(shares, share)
+	}
+	return shares, nil
+}
+
+// evaluate writes the share for index x into out.
+func evaluate(out []byte, x, threshold byte, secret, coefficients []byte) {
+	size := len(secret)
+	out[0] = x
+	out[1] = threshold
+	for j := 0; j < size; j++ {
+		// Horner's method, highest coefficient first.
+		var y byte
+		for k := int(threshold) - 2; k >= 0; k-- {
+			y = gfAdd(gfMul(y, x), coefficients[k*size+j])
+		}
+		out[HeaderSize+j] = gfAdd(gfMul(y, x), secret[j])
+	}
+}
+
+func destroyAll(elements []memprotect.Element) {
+	for _, e := range elements {
+		e.Destroy()
+	}
+}
+
+// Combine recombines the secret from shares. Shares may be given in any order, at least threshold shares
+// are required. The secret is allocated from engine.
+func Combine(shares []memprotect.Element, engine memprotect.Engine) (memprotect.Element, error) {
+	if len(shares) == 0 {
+		return nil, ErrShareCount
+	}
+	shareBytes := make([][]byte, 0, len(shares))
+	opened := 0
+	defer func() {
+		for _, s := range shares[:opened] {
+			s.Seal()
+		}
+	}()
+	var threshold, size int
+	for _, s := range shares {
+		d, err := s.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		opened++
+		shareBytes = append(shareBytes, d)
+		_, t, err := ParseHeader(d)
+		if err != nil {
+			return nil, err
+		}
+		if threshold == 0 {
+			threshold, size = t, len(d)
+		} else if t != threshold || len(d) != size {
+			return nil, ErrShareFormat
+		}
+	}
+	// Select threshold shares with distinct indices.
+	var seen [MaxShares + 1]bool
+	selected := make([][]byte, 0, threshold)
+	duplicates := false
+	for _, d := range shareBytes {
+		if seen[d[0]] {
+			duplicates = true
+			continue
+		}
+		seen[d[0]] = true
+		selected = append(selected, d)
+		if len(selected) == threshold {
+			break
+		}
+	}
+	if len(selected) < threshold {
+		if duplicates {
+			return nil, ErrDuplicateShare
+		}
+		return nil, ErrShareCount
+	}
+	secret := engine.Element(SecretSize(size))
+	err := secret.Melt()
+	if err == nil {
+		err = secret.WithBytes(func(d []byte) error {
+			interpolate(d, selected)
+			return nil
+		})
+	}
+	if err != nil {
+		secret.Destroy()
+		return nil, err
+	}
+	return secret, nil
+}
+
+// interpolate calculates the value of the polynomials defined by shares at x=0 and writes it to out.
+func interpolate(out []byte, shares [][]byte) {
+	for j := range out {
+		out[j] = 0
+	}
+	for i, si := range shares {
+		// Lagrange basis polynomial for share i at x=0.
+		basis := byte(1)
+		for m, sm := range shares {
+			if m == i {
+				continue
+			}
+			basis = gfMul(basis, gfDiv(sm[0], gfAdd(sm[0], si[0])))
+		}
+		for j := range out {
+			out[j] = gfAdd(out[j], gfMul(basis, si[HeaderSize+j]))
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package secretsharing
+
+import (
+	"bytes"
+	"testing"
+
+	"assuredrelease.com/cypherlock-pe/memprotect"
+)
+
+func TestGF256(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		if gfMul(byte(a), gfInv(byte(a))) != 1 {
+			t.Fatalf("Inverse of %d wrong", a)
+		}
+		if gfMul(byte(a), 1) != byte(a) {
+			t.Fatalf("Identity of %d wrong", a)
+		}
+	}
+	if gfMul(0x57, 0x83) != 0xc1 {
+		t.Error("Multiplication wrong")
+	}
+}
+
+func TestSplitCombine(t *testing.T) {
+	engine := new(memprotect.Unprotected)
+	engine.Init(new(memprotect.Unprotected).Cell(32))
+	defer engine.Finish()
+	secretData := []byte("This is a secret")
+	secret := engine.Element(len(secretData))
+	secret.Set(append([]byte{}, secretData...))
+	shares, err := Split(secret, 5, 3, engine)
+	if err != nil {
+		t.Fatalf("Split: %s", err)
+	}
+	for i, share := range shares {
+		d, _ := share.Bytes()
+		index, threshold, err := ParseHeader(d)
+		if err != nil || index != i+1 || threshold != 3 {
+			t.Errorf("Header wrong: %d %d %v", index, threshold, err)
+		}
+		if len(d) != ShareSize(len(secretData)) {
+			t.Errorf("Share size wrong: %d", len(d))
+		}
+	}
+	for _, selection := range [][]int{{0, 1, 2}, {4, 2, 0}, {3, 1, 4, 0}, {1, 1, 3, 2}} {
+		selected := make([]memprotect.Element, 0, len(selection))
+		for _, i := range selection {
+			selected = append(selected, shares[i])
+		}
+		combined, err := Combine(selected, engine)
+		if err != nil {
+			t.Fatalf("Combine %v: %s", selection, err)
+		}
+		d, _ := combined.Bytes()
+		if !bytes.Equal(d, secretData) {
+			t.Errorf("Combine %v: secret wrong", selection)
+		}
+	}
+	if _, err := Combine(shares[0:2], engine); err != ErrShareCount {
+		t.Errorf("Combine with too few shares: %v", err)
+	}
+	if _, err := Combine([]memprotect.Element{shares[0], shares[0], shares[1]}, engine); err != ErrDuplicateShare {
+		t.Errorf("Combine with duplicate shares: %v", err)
+	}
+	if _, err := Split(secret, 2, 3, engine); err != ErrThreshold {
+		t.Errorf("Split with threshold > n: %v", err)
+	}
+}
@@ -0,0 +1,193 @@
+package signalstore
+
+import (
+	"bytes"
+	"sync"
+	"time"
+)
+
+// window is a signal time window as recorded by Memory.
+type window struct {
+	setFrom, setTo int64
+	expiresAt      int64 // The signal is forgotten at this time, like a TTL of Store. 0 means never.
+}
+
+// Memory implements a signal store in memory. It has the same semantics as Store, but its contents are lost on Close.
+// It is meant for tests and for oracles that do not need to survive restarts.
+type Memory struct {
+	mutex          *sync.Mutex // Protects signals, positions, shares and retention settings.
+	retention      bool
+	grace          int64
+	signals        map[string]window
+	positions      map[string][]byte
+	positionMACKey []byte
+	shares         map[string][]byte
+}
+
+// NewMemory returns a new in-memory signal store. It panics if no key to authenticate positions can be created.
+func NewMemory() *Memory {
+	positionMACKey, err := newPositionMACKey()
+	if err != nil {
+		panic(err)
+	}
+	return &Memory{
+		mutex:          new(sync.Mutex),
+		signals:        make(map[string]window),
+		positions:      make(map[string][]byte),
+		positionMACKey: positionMACKey,
+		shares:         make(map[string][]byte),
+	}
+}
+
+// Close the store and forget all signals, positions and shares.
+func (self *Memory) Close() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.signals = make(map[string]window)
+	self.positions = make(map[string][]byte)
+	self.shares = make(map[string][]byte)
+	return nil
+}
+
+// SetSignal records a signal semaphore. setFrom is the time from which on the signal should be set (0 means beginning
+// of time). setTo is the time to which the signal should be set (0 means forever). times are in unixtime seconds.
+func (self *Memory) SetSignal(signal []byte, setFrom, setTo int64) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if old, ok := self.signal(signal); ok {
+		setFrom, setTo, _ = mergeTimes(old.setFrom, old.setTo, setFrom, setTo)
+	}
+	self.signals[string(signal)] = window{setFrom: setFrom, setTo: setTo, expiresAt: self.expiresAt(setTo)}
+	return nil
+}
+
+// signal returns the window recorded for signal. Signals past their expiry are forgotten. The caller must hold
+// self.mutex.
+func (self *Memory) signal(signal []byte) (window, bool) {
+	w, found := self.signals[string(signal)]
+	if found && w.expiresAt > 0 && w.expiresAt <= timeNow() {
+		delete(self.signals, string(signal))
+		return window{}, false
+	}
+	return w, found
+}
+
+// TestSignal tests the existence of signal. It returns TRUE if the signal is _not known_, signalling that
+// the process may proceed.
+func (self *Memory) TestSignal(signal []byte) (ok bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	w, found := self.signal(signal)
+	return !found || !isSignalTimeSet(w.setFrom, w.setTo)
+}
+
+// Signal returns the time window recorded for signal. found is false if the signal is not known. set is true if the
+// signal is set at the current time, like !TestSignal.
+func (self *Memory) Signal(signal []byte) (setFrom, setTo int64, set, found bool, err error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	w, found := self.signal(signal)
+	if !found {
+		return 0, 0, false, false, nil
+	}
+	return w.setFrom, w.setTo, isSignalTimeSet(w.setFrom, w.setTo), true, nil
+}
+
+// SetRetention enables the expiry of signals whose window ended more than grace ago, like Store.SetRetention.
+// New signals are forgotten after their expiry, Sweep removes signals written before.
+func (self *Memory) SetRetention(grace time.Duration) {
+	if grace < 0 {
+		grace = 0
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.retention = true
+	self.grace = int64(grace / time.Second)
+}
+
+// expiresAt returns the unix time at which a signal with window end setTo is forgotten, or 0 for never. The caller
+// must hold self.mutex.
+func (self *Memory) expiresAt(setTo int64) int64 {
+	if !self.retention || setTo <= 0 {
+		return 0
+	}
+	return setTo + self.grace
+}
+
+// Sweep removes signals whose window ended more than the grace period ago and returns how many were removed.
+// It does nothing unless SetRetention was called. Like with Store, signals past their expiry are not counted.
+func (self *Memory) Sweep() (reclaimed int, err error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if !self.retention {
+		return 0, nil
+	}
+	now := timeNow()
+	for signal, w := range self.signals {
+		if w.expiresAt > 0 && w.expiresAt <= now {
+			delete(self.signals, signal)
+			continue
+		}
+		if expiresAt := self.expiresAt(w.setTo); expiresAt > 0 && expiresAt < now && !isSignalTimeSet(w.setFrom, w.setTo) {
+			delete(self.signals, signal)
+			reclaimed++
+		}
+	}
+	return reclaimed, nil
+}
+
+// Position returns the position recorded for id. It returns ErrNoPosition if none has been recorded and
+// ErrPositionMAC if the record was not written by this store for id.
+func (self *Memory) Position(id []byte) (position int64, err error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	value, ok := self.positions[string(id)]
+	if !ok {
+		return 0, ErrNoPosition
+	}
+	return parsePosition(id, self.positionMACKey, value)
+}
+
+// SetPosition records position for id. Positions only move forward, ErrBackwards is returned if position is before
+// the recorded position. A recorded position that was not written by this store for id is not replaced.
+func (self *Memory) SetPosition(id []byte, position int64) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if value, ok := self.positions[string(id)]; ok {
+		old, err := parsePosition(id, self.positionMACKey, value)
+		if err != nil {
+			return err
+		}
+		if old > position {
+			return ErrBackwards
+		}
+	}
+	self.positions[string(id)] = positionValue(id, self.positionMACKey, position)
+	return nil
+}
+
+// Share returns the share recorded for round. It returns ErrNoShare if none has been recorded.
+func (self *Memory) Share(round []byte) (share []byte, err error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	value, ok := self.shares[string(round)]
+	if !ok {
+		return nil, ErrNoShare
+	}
+	return append([]byte{}, value...), nil
+}
+
+// SetShare records share for round. Recording the same share again succeeds, a different share for round is refused
+// with ErrShareRecorded.
+func (self *Memory) SetShare(round, share []byte) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if old, ok := self.shares[string(round)]; ok {
+		if !bytes.Equal(old, share) {
+			return ErrShareRecorded
+		}
+		return nil
+	}
+	self.shares[string(round)] = append([]byte{}, share...)
+	return nil
+}
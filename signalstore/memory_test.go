@@ -0,0 +1,81 @@
+package signalstore
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestMemory(t *testing.T) {
+	var store SignalStore = NewMemory()
+	defer store.Close()
+	defer func() { timeNow = func() int64 { return time.Now().Unix() } }()
+	s1 := []byte("Signal 1")
+	s2 := []byte("Signal 2")
+	if !store.TestSignal(s1) {
+		t.Error("Unrecorded signal found")
+	}
+	if err := store.SetSignal(s1, 0, 0); err != nil {
+		t.Errorf("SetSignal: %s", err)
+	}
+	if store.TestSignal(s1) {
+		t.Error("Signal not recorded")
+	}
+	if setFrom, setTo, set, found, err := store.Signal(s1); err != nil || !found || !set || setFrom != 0 || setTo != 0 {
+		t.Errorf("Signal: %d %d %v %v %v", setFrom, setTo, set, found, err)
+	}
+	if _, _, set, found, err := store.Signal(s2); err != nil || found || set {
+		t.Errorf("Signal unrecorded: %v %v %v", set, found, err)
+	}
+
+	if err := store.SetSignal(s2, 10, 11); err != nil {
+		t.Errorf("SetSignal: %s", err)
+	}
+	timeNow = func() int64 { return 10 }
+	if store.TestSignal(s2) {
+		t.Error("Signal within range")
+	}
+	timeNow = func() int64 { return 11 }
+	if !store.TestSignal(s2) {
+		t.Error("Signal outside range")
+	}
+	store.SetSignal(s2, 9, 0)
+	timeNow = func() int64 { return math.MaxInt64 }
+	if store.TestSignal(s2) {
+		t.Error("Changed signal within range")
+	}
+	timeNow = func() int64 { return 8 }
+	if !store.TestSignal(s2) {
+		t.Error("Signal outside range 2")
+	}
+	if setFrom, setTo, _, _, _ := store.Signal(s2); setFrom != 9 || setTo != 0 {
+		t.Errorf("Windows not merged: %d %d", setFrom, setTo)
+	}
+
+	id := []byte("ratchet")
+	if position, err := store.Position(id); err != ErrNoPosition || position != 0 {
+		t.Errorf("Unrecorded position: %d %v", position, err)
+	}
+	if err := store.SetPosition(id, 100); err != nil {
+		t.Errorf("SetPosition: %s", err)
+	}
+	if err := store.SetPosition(id, 99); err != ErrBackwards {
+		t.Errorf("SetPosition backwards: %v", err)
+	}
+	if position, err := store.Position(id); err != nil || position != 100 {
+		t.Errorf("Wrong position: %d %v", position, err)
+	}
+	other := NewMemory()
+	other.positions[string(id)] = store.(*Memory).positions[string(id)]
+	if _, err := other.Position(id); err != ErrPositionMAC {
+		t.Errorf("Position of other store accepted: %v", err)
+	}
+
+	testShares(t, store)
+}
+
+func TestMemoryRetention(t *testing.T) {
+	store := NewMemory()
+	defer store.Close()
+	testRetention(t, store)
+}
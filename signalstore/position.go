@@ -0,0 +1,126 @@
+package signalstore
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/dgraph-io/badger"
+)
+
+var (
+	ErrBackwards   = errors.New("signalstore: Position before recorded position")
+	ErrNoPosition  = errors.New("signalstore: No position recorded")
+	ErrPositionMAC = errors.New("signalstore: Recorded position not authentic")
+)
+
+// RandomSource creates the keys that authenticate positions.
+var RandomSource = rand.Reader
+
+// positionPrefix separates positions from signals, which are HMAC outputs.
+var positionPrefix = []byte("position:")
+
+// positionMACKeyName is the record of the key that authenticates positions. The key is created with the store and is
+// not derived from any secret of the oracle, so a restored keystore backup cannot be used to rewrite positions.
+var positionMACKeyName = []byte("positionmackey")
+
+func positionKey(id []byte) []byte {
+	return append(append(make([]byte, 0, len(positionPrefix)+len(id)), positionPrefix...), id...)
+}
+
+// positionValue encodes position for id, followed by its HMAC under key.
+func positionValue(id, key []byte, position int64) []byte {
+	value := make([]byte, 8, 8+sha256.Size)
+	binary.BigEndian.PutUint64(value, uint64(position))
+	return append(value, positionMAC(id, key, value)...)
+}
+
+func positionMAC(id, key, value []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(id)
+	h.Write(value)
+	return h.Sum(nil)
+}
+
+// parsePosition returns the position encoded in value. It returns ErrPositionMAC if value is not authenticated by key.
+func parsePosition(id, key, value []byte) (int64, error) {
+	if len(value) != 8+sha256.Size || !hmac.Equal(value[8:], positionMAC(id, key, value[:8])) {
+		return 0, ErrPositionMAC
+	}
+	return int64(binary.BigEndian.Uint64(value[:8])), nil
+}
+
+// newPositionMACKey returns a random key to authenticate positions.
+func newPositionMACKey() ([]byte, error) {
+	key := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(RandomSource, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// loadPositionMACKey returns the position MAC key of the database, creating it if it does not exist yet.
+func loadPositionMACKey(db *badger.DB) (key []byte, err error) {
+	err = db.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get(positionMACKeyName)
+		if err == nil {
+			key, err = item.ValueCopy(nil)
+			return err
+		} else if err != badger.ErrKeyNotFound {
+			return err
+		}
+		if key, err = newPositionMACKey(); err != nil {
+			return err
+		}
+		return txn.Set(positionMACKeyName, key)
+	})
+	return key, err
+}
+
+// Position returns the position recorded for id. It returns ErrNoPosition if none has been recorded and
+// ErrPositionMAC if the record was not written by this store for id.
+func (self *Store) Position(id []byte) (position int64, err error) {
+	err = self.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(positionKey(id))
+		if err == badger.ErrKeyNotFound {
+			return ErrNoPosition
+		} else if err != nil {
+			return err
+		}
+		value, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		position, err = parsePosition(id, self.positionMACKey, value)
+		return err
+	})
+	return position, err
+}
+
+// SetPosition records position for id. Positions only move forward, ErrBackwards is returned if position is before
+// the recorded position. A recorded position that was not written by this store for id is not replaced.
+func (self *Store) SetPosition(id []byte, position int64) error {
+	pkey := positionKey(id)
+	return self.db.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get(pkey)
+		if err == nil {
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			old, err := parsePosition(id, self.positionMACKey, value)
+			if err != nil {
+				return err
+			}
+			if old > position {
+				return ErrBackwards
+			}
+		} else if err != badger.ErrKeyNotFound {
+			return err
+		}
+		return txn.Set(pkey, positionValue(id, self.positionMACKey, position))
+	})
+}
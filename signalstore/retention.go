@@ -0,0 +1,117 @@
+package signalstore
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/dgraph-io/badger"
+)
+
+// sweepBatchSize is the number of deletions per transaction.
+const sweepBatchSize = 1000
+
+// SetRetention enables the expiry of signals whose window ended more than grace ago. Signals without end (setTo 0)
+// never expire. New signals are written with a TTL, Sweep removes signals written without one.
+// By default signals are kept forever.
+func (self *Store) SetRetention(grace time.Duration) {
+	if grace < 0 {
+		grace = 0
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.retention = true
+	self.grace = int64(grace / time.Second)
+}
+
+// expiresAt returns the unix time at which a signal with window end setTo may be removed, or 0 for never.
+func (self *Store) expiresAt(setTo int64) int64 {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if !self.retention || setTo <= 0 {
+		return 0
+	}
+	return setTo + self.grace
+}
+
+// expired returns true if the signal value d may be removed at now.
+func (self *Store) expired(d []byte, now int64) bool {
+	if len(d) != 16 { // Corrupted values are treated as set.
+		return false
+	}
+	setFrom, setTo := decodeTimes(d)
+	expiresAt := self.expiresAt(setTo)
+	return expiresAt > 0 && expiresAt < now && !isSignalTimeSet(setFrom, setTo)
+}
+
+// Sweep removes signals whose window ended more than the grace period ago and returns how many were removed.
+// It does nothing unless SetRetention was called. Signals written with a TTL are removed by the database itself
+// and are not counted.
+func (self *Store) Sweep() (reclaimed int, err error) {
+	self.mutex.Lock()
+	retention := self.retention
+	self.mutex.Unlock()
+	if !retention {
+		return 0, nil
+	}
+	now := timeNow()
+	var expired [][]byte
+	err = self.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			if bytes.HasPrefix(item.Key(), positionPrefix) || bytes.HasPrefix(item.Key(), sharePrefix) ||
+				bytes.Equal(item.Key(), positionMACKeyName) {
+				continue
+			}
+			value, err := item.Value()
+			if err != nil {
+				return err
+			}
+			if self.expired(value, now) {
+				expired = append(expired, item.KeyCopy(nil))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for len(expired) > 0 {
+		batch := expired
+		if len(batch) > sweepBatchSize {
+			batch = batch[:sweepBatchSize]
+		}
+		expired = expired[len(batch):]
+		n := 0
+		err := self.db.Update(func(txn *badger.Txn) error {
+			n = 0
+			for _, key := range batch {
+				// Check again, the signal may have been extended since it was read.
+				item, err := txn.Get(key)
+				if err == badger.ErrKeyNotFound {
+					continue
+				} else if err != nil {
+					return err
+				}
+				value, err := item.Value()
+				if err != nil {
+					return err
+				}
+				if !self.expired(value, now) {
+					continue
+				}
+				if err := txn.Delete(key); err != nil {
+					return err
+				}
+				n++
+			}
+			return nil
+		})
+		if err != nil {
+			return reclaimed, err
+		}
+		reclaimed += n
+	}
+	return reclaimed, nil
+}
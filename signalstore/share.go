@@ -0,0 +1,58 @@
+package signalstore
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/dgraph-io/badger"
+)
+
+var (
+	ErrNoShare       = errors.New("signalstore: No share recorded")
+	ErrShareRecorded = errors.New("signalstore: Other share recorded")
+)
+
+// sharePrefix separates BSP shares from signals and positions.
+var sharePrefix = []byte("bspshare:")
+
+func shareKey(round []byte) []byte {
+	return append(append(make([]byte, 0, len(sharePrefix)+len(round)), sharePrefix...), round...)
+}
+
+// Share returns the share recorded for round. It returns ErrNoShare if none has been recorded.
+func (self *Store) Share(round []byte) (share []byte, err error) {
+	err = self.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(shareKey(round))
+		if err == badger.ErrKeyNotFound {
+			return ErrNoShare
+		} else if err != nil {
+			return err
+		}
+		share, err = item.ValueCopy(nil)
+		return err
+	})
+	return share, err
+}
+
+// SetShare records share for round. Shares are kept forever. Recording the same share again succeeds, a different
+// share for round is refused with ErrShareRecorded.
+func (self *Store) SetShare(round, share []byte) error {
+	skey := shareKey(round)
+	value := append([]byte{}, share...)
+	return self.db.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get(skey)
+		if err == nil {
+			old, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(old, value) {
+				return ErrShareRecorded
+			}
+			return nil
+		} else if err != badger.ErrKeyNotFound {
+			return err
+		}
+		return txn.Set(skey, value)
+	})
+}
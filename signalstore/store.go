@@ -1,7 +1,9 @@
-// Package signalstore implements persistant storage for signals.
+// Package signalstore implements storage for signals.
 package signalstore
 
 import (
+	"context"
+	"sync"
 	"time"
 
 	"github.com/dgraph-io/badger"
@@ -11,10 +13,51 @@ const (
 	gcFactor = 0.7
 )
 
-// Store implements a signal store.
+// SignalStore records signals, the positions of ratchets and received BSP shares. Store and Memory implement it.
+type SignalStore interface {
+	// SetSignal records signal as set from setFrom to setTo. Windows of the same signal are merged.
+	SetSignal(signal []byte, setFrom, setTo int64) error
+	// TestSignal returns true if signal is not set at the current time.
+	TestSignal(signal []byte) (ok bool)
+	// Signal returns the time window recorded for signal.
+	Signal(signal []byte) (setFrom, setTo int64, set, found bool, err error)
+	// Position returns the position recorded for id, or ErrNoPosition. Positions are authenticated by a key of the
+	// store, a record that was not written by the store for id returns ErrPositionMAC.
+	Position(id []byte) (position int64, err error)
+	// SetPosition records position for id. It returns ErrBackwards if position is before the recorded position, and
+	// ErrPositionMAC if the recorded position was not written by the store for id.
+	SetPosition(id []byte, position int64) error
+	// Share returns the BSP share recorded for round, or ErrNoShare.
+	Share(round []byte) (share []byte, err error)
+	// SetShare records the BSP share for round. It returns ErrShareRecorded if a different share is recorded.
+	SetShare(round, share []byte) error
+	// Close the store.
+	Close() error
+}
+
+// Store implements a signal store in a badger database.
 type Store struct {
-	db     *badger.DB
-	stopGC chan interface{}
+	db             *badger.DB
+	positionMACKey []byte
+	mutex          *sync.Mutex // Protects retention settings, stats, closed and gcRunning.
+	retention      bool
+	grace          int64
+	stats          GCStats
+	closed         bool
+	gcRunning      bool          // RunGCService is running.
+	stop           chan struct{} // Closed by Close to stop the services.
+	services       *sync.WaitGroup
+	closeOnce      *sync.Once
+	closeErr       error
+}
+
+// GCStats reports the results of garbage collection runs.
+type GCStats struct {
+	Runs          int64 // Number of runs.
+	Reclaimed     int64 // Signals removed by Sweep in all runs.
+	LastRun       int64 // Unix time of the last run, 0 if none.
+	LastReclaimed int   // Signals removed by the last run.
+	LastError     error // Error of the last run.
 }
 
 // New returns a new signal store.
@@ -26,36 +69,93 @@ func New(dir string) (*Store, error) {
 	if err != nil {
 		return nil, err
 	}
+	positionMACKey, err := loadPositionMACKey(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
 	return &Store{
-		db:     db,
-		stopGC: make(chan interface{}, 1),
+		db:             db,
+		positionMACKey: positionMACKey,
+		mutex:          new(sync.Mutex),
+		stop:           make(chan struct{}),
+		services:       new(sync.WaitGroup),
+		closeOnce:      new(sync.Once),
 	}, nil
 }
 
-// Close the signal store.
-func (self *Store) Close() {
-	self.stopGC <- struct{}{}
-	self.db.Close()
+// Close stops the services of the store, waits for them to return and closes the database. Calls after the first
+// return the result of the first.
+func (self *Store) Close() error {
+	self.closeOnce.Do(func() {
+		self.mutex.Lock()
+		self.closed = true
+		self.mutex.Unlock()
+		close(self.stop)
+		self.services.Wait()
+		self.closeErr = self.db.Close()
+	})
+	return self.closeErr
+}
+
+// GCRun removes expired signals and runs the value log garbage collection. It returns the number of signals
+// removed. The result is also recorded in Stats.
+func (self *Store) GCRun() (reclaimed int, err error) {
+	reclaimed, err = self.Sweep()
+	if err == nil {
+		if err = self.db.RunValueLogGC(gcFactor); err == badger.ErrNoRewrite {
+			err = nil // Nothing to collect.
+		}
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.stats.Runs++
+	self.stats.Reclaimed += int64(reclaimed)
+	self.stats.LastRun = timeNow()
+	self.stats.LastReclaimed = reclaimed
+	self.stats.LastError = err
+	return reclaimed, err
 }
 
-// GCRun runs the garbage collection.
-func (self *Store) GCRun() error {
-	return self.db.RunValueLogGC(gcFactor)
+// Stats returns the results of the garbage collection runs so far.
+func (self *Store) Stats() GCStats {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.stats
 }
 
-// RunGCService runs the garbage collection serivce every duration.
-func (self *Store) RunGCService(dur time.Duration) {
+// RunGCService runs GCRun every dur until ctx is cancelled or the store is closed. Only one service runs at a time,
+// it returns false and does nothing if the service is already running or the store is closed. Close waits for the
+// service to return.
+func (self *Store) RunGCService(ctx context.Context, dur time.Duration) (started bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.closed || self.gcRunning {
+		return false
+	}
+	self.gcRunning = true
+	self.services.Add(1)
 	go func() {
+		defer self.services.Done()
+		defer func() {
+			self.mutex.Lock()
+			self.gcRunning = false
+			self.mutex.Unlock()
+		}()
 		ticker := time.NewTicker(dur)
+		defer ticker.Stop()
 		for {
 			select {
 			case <-ticker.C:
 				self.GCRun()
-			case <-self.stopGC:
-				ticker.Stop()
+			case <-ctx.Done():
+				return
+			case <-self.stop:
+				return
 			}
 		}
 	}()
+	return true
 }
 
 // SetSignal records a signal semaphore in persistant storage. setFrom is the time from which on the signal should be set
@@ -76,7 +176,12 @@ func (self *Store) SetSignal(signal []byte, setFrom, setTo int64) error {
 		}
 		newValue, changed := genTimes(value, setFrom, setTo)
 		if changed {
-			return txn.Set(signalCopy, newValue)
+			_, newSetTo := decodeTimes(newValue)
+			return txn.SetEntry(&badger.Entry{
+				Key:       signalCopy,
+				Value:     newValue,
+				ExpiresAt: uint64(self.expiresAt(newSetTo)),
+			})
 		}
 		return nil
 	})
@@ -109,3 +214,30 @@ func (self *Store) TestSignal(signal []byte) (ok bool) {
 	}
 	return ok
 }
+
+// Signal returns the time window recorded for signal. found is false if the signal is not known. set is true if the
+// signal is set at the current time, like !TestSignal.
+func (self *Store) Signal(signal []byte) (setFrom, setTo int64, set, found bool, err error) {
+	signalCopy := make([]byte, len(signal))
+	copy(signalCopy, signal)
+	err = self.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(signalCopy)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		value, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		found = true
+		setFrom, setTo = decodeTimes(value)
+		set = isSignalTimeSet(setFrom, setTo)
+		return nil
+	})
+	if err != nil {
+		return 0, 0, false, false, err
+	}
+	return setFrom, setTo, set, found, nil
+}
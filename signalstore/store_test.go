@@ -1,10 +1,15 @@
 package signalstore
 
 import (
+	"bytes"
+	"context"
 	"io/ioutil"
 	"math"
 	"os"
 	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger"
 )
 
 func TestStore(t *testing.T) {
@@ -35,6 +40,12 @@ func TestStore(t *testing.T) {
 	if err := store.SetSignal(s1, 0, 0); err != nil {
 		t.Errorf("SetSignal duplicate: %s", err)
 	}
+	if setFrom, setTo, set, found, err := store.Signal(s1); err != nil || !found || !set || setFrom != 0 || setTo != 0 {
+		t.Errorf("Signal: %d %d %v %v %v", setFrom, setTo, set, found, err)
+	}
+	if _, _, set, found, err := store.Signal(s2); err != nil || found || set {
+		t.Errorf("Signal unrecorded: %v %v %v", set, found, err)
+	}
 }
 
 func TestStoreTimes(t *testing.T) {
@@ -79,3 +90,263 @@ func TestStoreTimes(t *testing.T) {
 		t.Error("Signal outside range 3")
 	}
 }
+
+func TestStorePosition(t *testing.T) {
+	id := []byte("ratchet")
+	tdir, err := ioutil.TempDir("", "CLPEtestStore")
+	if err != nil {
+		t.Fatalf("Cannot create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tdir)
+	store, err := New(tdir)
+	if err != nil {
+		t.Fatalf("New store: %s", err)
+	}
+	defer func() { store.Close() }()
+	if position, err := store.Position(id); err != ErrNoPosition || position != 0 {
+		t.Errorf("Unrecorded position: %d %v", position, err)
+	}
+	if err := store.SetPosition(id, 100); err != nil {
+		t.Errorf("SetPosition: %s", err)
+	}
+	if err := store.SetPosition(id, 100); err != nil {
+		t.Errorf("SetPosition same: %s", err)
+	}
+	if err := store.SetPosition(id, 99); err != ErrBackwards {
+		t.Errorf("SetPosition backwards: %v", err)
+	}
+	if err := store.SetPosition(id, 200); err != nil {
+		t.Errorf("SetPosition forward: %s", err)
+	}
+	if position, err := store.Position(id); err != nil || position != 200 {
+		t.Errorf("Wrong position: %d %v", position, err)
+	}
+	// The key of the store survives a restart.
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	if store, err = New(tdir); err != nil {
+		t.Fatalf("Reopen store: %s", err)
+	}
+	if position, err := store.Position(id); err != nil || position != 200 {
+		t.Errorf("Position after reopen: %d %v", position, err)
+	}
+	// A record moved to another id does not verify.
+	if err := store.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(positionKey([]byte("other")), positionValue(id, store.positionMACKey, 300))
+	}); err != nil {
+		t.Fatalf("Update: %s", err)
+	}
+	if _, err := store.Position([]byte("other")); err != ErrPositionMAC {
+		t.Errorf("Moved position accepted: %v", err)
+	}
+	// A record written with any other key, such as one derived from the oracle's keys, does not verify.
+	if err := store.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(positionKey(id), positionValue(id, []byte("other key"), 100))
+	}); err != nil {
+		t.Fatalf("Update: %s", err)
+	}
+	if _, err := store.Position(id); err != ErrPositionMAC {
+		t.Errorf("Position with other key accepted: %v", err)
+	}
+	if err := store.SetPosition(id, 300); err != ErrPositionMAC {
+		t.Errorf("SetPosition over other key: %v", err)
+	}
+}
+
+// retentionStore is a signal store with retention. Store and Memory implement it.
+type retentionStore interface {
+	SignalStore
+	SetRetention(grace time.Duration)
+	Sweep() (reclaimed int, err error)
+}
+
+func TestStoreRetention(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "CLPEtestStore")
+	if err != nil {
+		t.Fatalf("Cannot create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tdir)
+	store, err := New(tdir)
+	if err != nil {
+		t.Fatalf("New store: %s", err)
+	}
+	defer store.Close()
+	testRetention(t, store)
+}
+
+// testRetention checks SetRetention and Sweep of store.
+func testRetention(t *testing.T, store retentionStore) {
+	timeNow = func() int64 { return time.Now().Unix() }
+	defer func() { timeNow = func() int64 { return time.Now().Unix() } }()
+	now := timeNow()
+	signals := map[string][2]int64{
+		"expired":   {now - 1000, now - 500},
+		"grace":     {now - 1000, now - 5},
+		"active":    {now - 10, now + 1000},
+		"scheduled": {now + 100, now + 200},
+		"permanent": {0, 0},
+	}
+	for name, times := range signals {
+		if err := store.SetSignal([]byte(name), times[0], times[1]); err != nil {
+			t.Fatalf("SetSignal %s: %s", name, err)
+		}
+	}
+	if err := store.SetPosition([]byte("ratchet"), 5); err != nil {
+		t.Fatalf("SetPosition: %s", err)
+	}
+	found := func(name string) bool {
+		_, _, _, found, err := store.Signal([]byte(name))
+		if err != nil {
+			t.Fatalf("Signal %s: %s", name, err)
+		}
+		return found
+	}
+	if n, err := store.Sweep(); err != nil || n != 0 {
+		t.Errorf("Sweep without retention: %d %v", n, err)
+	}
+
+	store.SetRetention(10 * time.Second)
+	if n, err := store.Sweep(); err != nil || n != 1 {
+		t.Errorf("Sweep: %d %v", n, err)
+	}
+	if found("expired") {
+		t.Error("Expired signal not removed")
+	}
+	for _, name := range []string{"grace", "active", "scheduled", "permanent"} {
+		if !found(name) {
+			t.Errorf("Signal %s removed", name)
+		}
+	}
+	// New signals expire by TTL.
+	if err := store.SetSignal([]byte("ttl"), now-1000, now-500); err != nil {
+		t.Fatalf("SetSignal ttl: %s", err)
+	}
+	if found("ttl") {
+		t.Error("Signal past TTL found")
+	}
+
+	timeNow = func() int64 { return now + 100000 }
+	if n, err := store.Sweep(); err != nil || n != 3 {
+		t.Errorf("Sweep later: %d %v", n, err)
+	}
+	if !found("permanent") {
+		t.Error("Permanent signal removed")
+	}
+	if position, err := store.Position([]byte("ratchet")); err != nil || position != 5 {
+		t.Errorf("Position removed: %d %v", position, err)
+	}
+}
+
+func TestStoreGCService(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "CLPEtestStore")
+	if err != nil {
+		t.Fatalf("Cannot create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tdir)
+
+	// Close without service, twice.
+	store, err := New(tdir)
+	if err != nil {
+		t.Fatalf("New store: %s", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Errorf("Close: %s", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Errorf("Close again: %s", err)
+	}
+	if store.RunGCService(context.Background(), time.Millisecond) {
+		t.Error("Service started on closed store")
+	}
+
+	store, err = New(tdir)
+	if err != nil {
+		t.Fatalf("New store: %s", err)
+	}
+	timeNow = func() int64 { return time.Now().Unix() }
+	now := timeNow()
+	if err := store.SetSignal([]byte("expired"), now-1000, now-500); err != nil {
+		t.Fatalf("SetSignal: %s", err)
+	}
+	store.SetRetention(time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+	if !store.RunGCService(ctx, 10*time.Millisecond) {
+		t.Fatal("Service not started")
+	}
+	if store.RunGCService(context.Background(), 10*time.Millisecond) {
+		t.Error("Service started twice")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for store.Stats().Runs < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	stats := store.Stats()
+	if stats.Runs < 2 || stats.Reclaimed != 1 || stats.LastRun == 0 || stats.LastError != nil {
+		t.Errorf("Wrong stats: %+v", stats)
+	}
+	// The service can be started again once it returned. Close stops it.
+	for !store.RunGCService(context.Background(), 10*time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Service not restarted after cancel")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	closed := make(chan error)
+	go func() { closed <- store.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Errorf("Close: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not return")
+	}
+	runs := store.Stats().Runs
+	time.Sleep(50 * time.Millisecond)
+	if store.Stats().Runs != runs {
+		t.Error("Service running after Close")
+	}
+}
+
+// testShares checks the share records of store.
+func testShares(t *testing.T, store SignalStore) {
+	round, share := []byte("round"), []byte("share")
+	if _, err := store.Share(round); err != ErrNoShare {
+		t.Errorf("Unrecorded share: %v", err)
+	}
+	if err := store.SetShare(round, share); err != nil {
+		t.Errorf("SetShare: %s", err)
+	}
+	if err := store.SetShare(round, share); err != nil {
+		t.Errorf("SetShare same: %s", err)
+	}
+	if err := store.SetShare(round, []byte("other share")); err != ErrShareRecorded {
+		t.Errorf("SetShare other: %v", err)
+	}
+	if d, err := store.Share(round); err != nil || !bytes.Equal(d, share) {
+		t.Errorf("Share: %q %v", d, err)
+	}
+}
+
+func TestStoreShare(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "CLPEtestStore")
+	if err != nil {
+		t.Fatalf("Cannot create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tdir)
+	store, err := New(tdir)
+	if err != nil {
+		t.Fatalf("New store: %s", err)
+	}
+	defer store.Close()
+	testShares(t, store)
+	store.SetRetention(0)
+	if _, err := store.Sweep(); err != nil {
+		t.Errorf("Sweep: %s", err)
+	}
+	if _, err := store.Share([]byte("round")); err != nil {
+		t.Errorf("Share removed by Sweep: %v", err)
+	}
+}
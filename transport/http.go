@@ -0,0 +1,75 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// ContentType is the content type of oracle requests and responses.
+const ContentType = "application/octet-stream"
+
+// MaxResponseSize is the largest response accepted from an oracle.
+const MaxResponseSize = 16384
+
+// MaxFetchSize is the largest published document (config, timelock list) accepted from an oracle.
+const MaxFetchSize = 262144
+
+// DefaultTimeout is the timeout of a single HTTP request.
+const DefaultTimeout = 30 * time.Second
+
+// HTTP posts oracle messages to the URL of the oracle. The URL must be the full endpoint, ie. "https://oracle.example/oracle".
+type HTTP struct {
+	Client *http.Client // The client to use. A client with DefaultTimeout is used if nil.
+}
+
+// NewHTTP returns a HTTP transport with a client that uses DefaultTimeout.
+func NewHTTP() *HTTP {
+	return &HTTP{Client: &http.Client{Timeout: DefaultTimeout}}
+}
+
+// Send posts message to url. Client errors (4xx except 429) are permanent, all others can be retried.
+func (self *HTTP) Send(ctx context.Context, url string, message []byte) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(message))
+	if err != nil {
+		return nil, Permanent(err)
+	}
+	req.Header.Set("Content-Type", ContentType)
+	return self.do(ctx, req, MaxResponseSize)
+}
+
+// Get fetches the published data at url. Errors are classified like in Send.
+func (self *HTTP) Get(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, Permanent(err)
+	}
+	return self.do(ctx, req, MaxFetchSize)
+}
+
+func (self *HTTP) do(ctx context.Context, req *http.Request, maxSize int64) ([]byte, error) {
+	client := self.Client
+	if client == nil {
+		client = &http.Client{Timeout: DefaultTimeout}
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("transport: Oracle %s returned %s", req.URL, resp.Status)
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			return nil, Permanent(err)
+		}
+		return nil, err
+	}
+	d, err := ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, maxSize))
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
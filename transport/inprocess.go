@@ -0,0 +1,50 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"assuredrelease.com/cypherlock-pe/messages"
+)
+
+var ErrUnknownOracle = errors.New("transport: Unknown oracle")
+
+// InProcess delivers oracle messages to oracles running in the same process. Calls to the oracles are serialized.
+type InProcess struct {
+	mutex   *sync.Mutex
+	oracles map[string]*messages.Oracle
+}
+
+// NewInProcess returns an InProcess transport without oracles.
+func NewInProcess() *InProcess {
+	return &InProcess{
+		mutex:   new(sync.Mutex),
+		oracles: make(map[string]*messages.Oracle),
+	}
+}
+
+// Add registers oracle under url.
+func (self *InProcess) Add(url string, oracle *messages.Oracle) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.oracles[url] = oracle
+}
+
+// Send calls ReceiveMsg of the oracle registered for url.
+func (self *InProcess) Send(ctx context.Context, url string, message []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	oracle, ok := self.oracles[url]
+	if !ok {
+		return nil, Permanent(ErrUnknownOracle)
+	}
+	response, err := oracle.ReceiveMsg(message)
+	if err != nil {
+		return nil, Permanent(err)
+	}
+	return response, nil
+}
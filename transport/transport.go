@@ -0,0 +1,195 @@
+// Package transport delivers oracle messages to oracles and collects their shares.
+package transport
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"assuredrelease.com/cypherlock-pe/messages"
+)
+
+var (
+	ErrNoShares = errors.New("transport: Not enough shares recovered")
+)
+
+// Transport delivers an oracle message to the oracle at url and returns its response.
+type Transport interface {
+	Send(ctx context.Context, url string, message []byte) (response []byte, err error)
+}
+
+// Fetcher retrieves data an oracle publishes, like its config or timelock list.
+type Fetcher interface {
+	Get(ctx context.Context, url string) (data []byte, err error)
+}
+
+// Func adapts a function to the Transport interface.
+type Func func(ctx context.Context, url string, message []byte) (response []byte, err error)
+
+// Send calls self.
+func (self Func) Send(ctx context.Context, url string, message []byte) ([]byte, error) {
+	return self(ctx, url, message)
+}
+
+type permanentError struct {
+	err error
+}
+
+func (self *permanentError) Error() string {
+	return self.err.Error()
+}
+
+// Permanent marks err as not retryable. Transports use it for errors that repeating the request cannot fix.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsPermanent returns true if err was marked by Permanent.
+func IsPermanent(err error) bool {
+	_, ok := err.(*permanentError)
+	return ok
+}
+
+// Default retry parameters.
+const (
+	DefaultAttempts   = 3
+	DefaultBackoff    = 500 * time.Millisecond
+	DefaultMaxBackoff = 5 * time.Second
+)
+
+// Retry controls how often a request is repeated. Zero values are replaced by defaults.
+type Retry struct {
+	Attempts   int           // Number of requests per future, including the first.
+	Backoff    time.Duration // Delay before the first retry. It doubles with each retry.
+	MaxBackoff time.Duration // Upper bound of the delay.
+
+	// Renew, if not nil, is called once for a future whose envelope the oracle rejected or could not decrypt, ie.
+	// because its short term key changed. If it returns nil the renewed future is sent again.
+	Renew func(future *messages.OracleFuture) error
+}
+
+func (self Retry) withDefaults() Retry {
+	if self.Attempts <= 0 {
+		self.Attempts = DefaultAttempts
+	}
+	if self.Backoff <= 0 {
+		self.Backoff = DefaultBackoff
+	}
+	if self.MaxBackoff <= 0 {
+		self.MaxBackoff = DefaultMaxBackoff
+	}
+	return self
+}
+
+// Collect sends all futures concurrently and returns the shares of the first threshold oracles that
+// answered. Outstanding requests are cancelled once threshold shares have been recovered.
+// Failed requests are retried unless the error is permanent or the oracle refused to answer.
+// If fewer than threshold shares are recovered the last error is returned.
+func Collect(ctx context.Context, transport Transport, futures []*messages.OracleFuture, threshold int, retry Retry) ([][]byte, error) {
+	if threshold <= 0 || threshold > len(futures) {
+		return nil, ErrNoShares
+	}
+	retry = retry.withDefaults()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		share []byte
+		err   error
+	}
+	results := make(chan result, len(futures))
+	wg := new(sync.WaitGroup)
+	for _, future := range futures {
+		wg.Add(1)
+		go func(future *messages.OracleFuture) {
+			defer wg.Done()
+			share, err := request(ctx, transport, future, retry)
+			results <- result{share: share, err: err}
+		}(future)
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	shares := make([][]byte, 0, threshold)
+	var lastErr error
+	for r := range results {
+		if r.err != nil {
+			lastErr = r.err
+			continue
+		}
+		if len(shares) >= threshold {
+			wipeBytes(r.share)
+			continue
+		}
+		shares = append(shares, r.share)
+		if len(shares) >= threshold {
+			cancel()
+		}
+	}
+	if len(shares) < threshold {
+		for _, share := range shares {
+			wipeBytes(share)
+		}
+		if lastErr != nil {
+			return nil, lastErr
+		}
+		return nil, ErrNoShares
+	}
+	return shares, nil
+}
+
+// request sends future until a share is recovered, the attempts are used up or ctx is cancelled. A future
+// the oracle rejected is renewed once with retry.Renew.
+func request(ctx context.Context, transport Transport, future *messages.OracleFuture, retry Retry) ([]byte, error) {
+	share, err := send(ctx, transport, future, retry)
+	if err == nil || retry.Renew == nil || !(IsPermanent(err) || err == messages.ErrDecrypt) {
+		return share, err
+	}
+	if retry.Renew(future) != nil {
+		return nil, err
+	}
+	return send(ctx, transport, future, retry)
+}
+
+// send sends future until a share is recovered, the attempts are used up or ctx is cancelled.
+func send(ctx context.Context, transport Transport, future *messages.OracleFuture, retry Retry) ([]byte, error) {
+	backoff := retry.Backoff
+	var err error
+	for attempt := 0; attempt < retry.Attempts; attempt++ {
+		if attempt > 0 {
+			timer := time.NewTimer(backoff)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, ctx.Err()
+			case <-timer.C:
+			}
+			if backoff *= 2; backoff > retry.MaxBackoff {
+				backoff = retry.MaxBackoff
+			}
+		}
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+		var response []byte
+		response, err = transport.Send(ctx, string(future.URL), future.Message)
+		if err == nil {
+			// Receive errors are answers of the oracle, repeating the request does not change them.
+			return future.Receive(response)
+		}
+		if IsPermanent(err) {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+func wipeBytes(d []byte) {
+	for i := range d {
+		d[i] = 0x00
+	}
+}
@@ -0,0 +1,176 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"assuredrelease.com/cypherlock-pe/memprotect"
+	"assuredrelease.com/cypherlock-pe/messages"
+	"assuredrelease.com/cypherlock-pe/oracleserver"
+	"assuredrelease.com/cypherlock-pe/signalstore"
+)
+
+var testRetry = Retry{Attempts: 3, Backoff: time.Millisecond}
+
+func newTestOracle(t *testing.T, engine memprotect.Engine) (*messages.Oracle, *signalstore.Store, func()) {
+	tdir, err := ioutil.TempDir("", "CLPEtestStore")
+	if err != nil {
+		t.Fatalf("Cannot create temporary directory: %s", err)
+	}
+	store, err := signalstore.New(tdir)
+	if err != nil {
+		t.Fatalf("New store: %s", err)
+	}
+	oracle := messages.NewOracle(store, engine)
+	if err := oracle.Generate(time.Now().Unix(), 1000000, 100000); err != nil {
+		t.Fatalf("Oracle.Generate: %s", err)
+	}
+	return oracle, store, func() {
+		store.Close()
+		os.RemoveAll(tdir)
+	}
+}
+
+func newTestFuture(t *testing.T, url string, oracle *messages.Oracle, share []byte, engine memprotect.Engine) *messages.OracleFuture {
+	longTermKey, shortTermKey := oracle.PublicKeys()
+	timeLocks, err := oracle.TimelockKeys(1)
+	if err != nil {
+		t.Fatalf("TimelockKeys: %s", err)
+	}
+	timeLock := timeLocks.SelectKey(time.Now().Unix())
+	key := [32]byte{0x01}
+	msg := &messages.OracleMessage{
+		OracleURL:               []byte(url),
+		LongTermOraclePublicKey: *longTermKey,
+		TimelockPublicKey:       timeLock.PublicKey,
+		ValidFrom:               timeLock.ValidFrom,
+		ValidTo:                 timeLock.ValidTo,
+		Share:                   share,
+	}
+	container, err := msg.Encrypt(key[:], engine)
+	if err != nil {
+		t.Fatalf("Encrypt: %s", err)
+	}
+	future, err := new(messages.OracleMessageContainer).Send(key[:], container, func(url string, longTermKey *[32]byte) (*[32]byte, error) { return shortTermKey, nil }, engine)
+	if err != nil {
+		t.Fatalf("Send: %s", err)
+	}
+	return future
+}
+
+func newTestEngine() memprotect.Engine {
+	engine := new(memprotect.Unprotected)
+	engine.Init(new(memprotect.Unprotected).Cell(32))
+	return engine
+}
+
+func TestCollect(t *testing.T) {
+	engine := newTestEngine()
+	inProcess := NewInProcess()
+	futures := make([]*messages.OracleFuture, 0, 3)
+	for i := 0; i < 3; i++ {
+		oracle, _, cleanup := newTestOracle(t, engine)
+		defer cleanup()
+		url := "http://oracle" + strconv.Itoa(i) + ".test"
+		inProcess.Add(url, oracle)
+		futures = append(futures, newTestFuture(t, url, oracle, []byte("share"+strconv.Itoa(i)), engine))
+	}
+	shares, err := Collect(context.Background(), inProcess, futures, 3, testRetry)
+	if err != nil {
+		t.Fatalf("Collect: %s", err)
+	}
+	if len(shares) != 3 {
+		t.Errorf("Wrong number of shares: %d", len(shares))
+	}
+
+	// Stop at threshold: the slow oracle is cancelled.
+	mutex := new(sync.Mutex)
+	calls := make(map[string]int)
+	slow := Func(func(ctx context.Context, url string, message []byte) ([]byte, error) {
+		mutex.Lock()
+		calls[url]++
+		mutex.Unlock()
+		if url == "http://oracle0.test" {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return inProcess.Send(ctx, url, message)
+	})
+	shares, err = Collect(context.Background(), slow, futures, 2, testRetry)
+	if err != nil {
+		t.Fatalf("Collect with slow oracle: %s", err)
+	}
+	if len(shares) != 2 || bytes.Equal(shares[0], []byte("share0")) || bytes.Equal(shares[1], []byte("share0")) {
+		t.Errorf("Wrong shares: %q", shares)
+	}
+	if calls["http://oracle0.test"] != 1 {
+		t.Errorf("Cancelled request was retried: %d", calls["http://oracle0.test"])
+	}
+
+	// Transient errors are retried, permanent errors are not.
+	calls = make(map[string]int)
+	flaky := Func(func(ctx context.Context, url string, message []byte) ([]byte, error) {
+		mutex.Lock()
+		calls[url]++
+		n := calls[url]
+		mutex.Unlock()
+		switch url {
+		case "http://oracle0.test":
+			return nil, Permanent(errors.New("refused"))
+		case "http://oracle1.test":
+			if n < 3 {
+				return nil, errors.New("unreachable")
+			}
+		}
+		return inProcess.Send(ctx, url, message)
+	})
+	if _, err := Collect(context.Background(), flaky, futures, 2, testRetry); err != nil {
+		t.Errorf("Collect with flaky oracle: %s", err)
+	}
+	if calls["http://oracle0.test"] != 1 || calls["http://oracle1.test"] != 3 {
+		t.Errorf("Wrong number of calls: %v", calls)
+	}
+	if _, err := Collect(context.Background(), flaky, futures, 3, testRetry); err == nil || err.Error() != "refused" {
+		t.Errorf("Collect below threshold: %v", err)
+	}
+	if _, err := Collect(context.Background(), inProcess, futures, 4, testRetry); err != ErrNoShares {
+		t.Errorf("Threshold above futures: %v", err)
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	engine := newTestEngine()
+	oracle, store, cleanup := newTestOracle(t, engine)
+	defer cleanup()
+	server := oracleserver.New(oracleserver.Config{}, oracle, store, new(memprotect.Unprotected))
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+	url := ts.URL + oracleserver.OraclePath
+	future := newTestFuture(t, url, oracle, []byte("share"), engine)
+	shares, err := Collect(context.Background(), NewHTTP(), []*messages.OracleFuture{future}, 1, testRetry)
+	if err != nil {
+		t.Fatalf("Collect: %s", err)
+	}
+	if !bytes.Equal(shares[0], []byte("share")) {
+		t.Errorf("Wrong share: %q", shares[0])
+	}
+	if _, err := NewHTTP().Send(context.Background(), url, []byte("garbage")); !IsPermanent(err) {
+		t.Errorf("Bad request not permanent: %v", err)
+	}
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+	if _, err := NewHTTP().Send(context.Background(), unavailable.URL, future.Message); err == nil || IsPermanent(err) {
+		t.Errorf("Unavailable server not retryable: %v", err)
+	}
+}